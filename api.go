@@ -1,125 +1,635 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful/swagger"
 	"io"
 	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// apiVersionPath is the prefix of the current version of the API. The routes
+// without it are deprecated aliases kept for existing clients.
+const apiVersionPath = "/v1"
+
 func initApi() {
+	v1 := new(restful.WebService)
+	v1.Path(apiVersionPath).Consumes(restful.MIME_OCTET).Produces(restful.MIME_JSON)
+	v1.ApiVersion(globalVersionNumber)
+	addApiRoutes(v1, false)
+	restful.Add(v1)
 
 	ws := new(restful.WebService)
-	filter := noAuthentication
-	if globalConfig.Username != "" && globalConfig.Password != "" {
-		filter = basicAuthenticate
-	}
-
 	ws.Consumes(restful.MIME_OCTET).Produces(restful.MIME_JSON)
+	ws.ApiVersion(globalVersionNumber)
+	addApiRoutes(ws, true)
 
-	ws.Route(ws.GET("/").Filter(filter).To(apiUsage))
-	ws.Route(ws.GET("/machines").Filter(filter).To(apiListMachines))
-	ws.Route(ws.GET("/machines/{name}").Filter(filter).To(apiGetMachine))
-	ws.Route(ws.GET("/runs").Filter(filter).To(apiListCurrentRuns))
-	ws.Route(ws.GET("/runs/{id}").Filter(filter).To(apiGetRun))
-	ws.Route(ws.POST("/runs/{machine}").Filter(filter).To(apiRunMachine))
-	ws.Route(ws.DELETE("/runs/{id}").Filter(filter).To(apiDeleteRun))
+	ws.Route(ws.GET("/").Filter(authenticate).To(apiUsage).
+		Doc("Show the version and links to the resources of the API").
+		Writes(ApiIndex{}))
+	ws.Route(ws.GET("/metrics").Filter(authenticate).Produces("text/plain").To(apiMetrics).
+		Doc("Get metrics in the Prometheus text format"))
+	ws.Route(ws.GET("/healthz").To(apiHealthz).
+		Doc("Check that the daemon is alive").
+		Writes(HealthReport{}).
+		Returns(503, "The daemon is unhealthy", HealthReport{}))
+	ws.Route(ws.GET("/readyz").To(apiReadyz).
+		Doc("Check that the daemon is ready to accept runs").
+		Writes(HealthReport{}).
+		Returns(503, "The daemon isn't ready", HealthReport{}))
+	addDashboardRoutes(ws)
 	restful.Add(ws)
+
+	swagger.LogInfo = func(format string, v ...interface{}) {
+		logDebug(nil, format, v...)
+	}
+	swagger.InstallSwaggerService(swagger.Config{
+		WebServices:      restful.RegisteredWebServices(),
+		ApiPath:          apiDocsPath,
+		ApiVersion:       globalVersionNumber,
+		PostBuildHandler: markDeprecatedOperations(v1),
+	})
 }
 
-func basicAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	encoded := req.Request.Header.Get("Authorization")
+// addApiRoutes adds the versioned routes to ws. Deprecated routes announce
+// their /v1 successor in the response headers.
+func addApiRoutes(ws *restful.WebService, deprecated bool) {
+	route := func(builder *restful.RouteBuilder) *restful.RouteBuilder {
+		if deprecated {
+			builder.Filter(deprecatedFilter)
+		}
+		return builder
+	}
+
+	runId := ws.PathParameter("id", "Id of the state machine run").DataType("integer")
+	machineName := ws.PathParameter("machine", "Name of the state machine")
+	errorModel := ApiError{}
 
-	unAuthorized := func() {
-		resp.AddHeader("WWW-Authenticate", "Basic realm=Protected Area")
-		errorResponse(401, "Not authorized", resp)
+	ws.Route(route(ws.GET("/machines")).Filter(authenticate).To(apiListMachines).
+		Doc("List the state machines").
+		Writes([]StateMachine{}))
+	ws.Route(route(ws.GET("/machines/{name}")).Filter(authenticate).To(apiGetMachine).
+		Doc("Get a state machine with its usage and states").
+		Param(ws.PathParameter("name", "Name of the state machine")).
+		Writes(StateMachine{}).
+		Returns(404, "State machine not found", errorModel))
+	ws.Route(route(ws.GET("/runs")).Filter(authenticate).To(apiListCurrentRuns).
+		Doc("List state machine runs, newest first").
+		Notes("Without the status parameter the active runs are listed.").
+		Param(ws.QueryParameter("status", "active, finished or all")).
+		Param(ws.QueryParameter("machine", "Only list runs of this state machine")).
+		Param(ws.QueryParameter("limit", "Maximum number of runs, 100 by default").DataType("integer")).
+		Writes([]RunResponse{}).
+		Returns(400, "Invalid query parameter", errorModel))
+	ws.Route(route(ws.GET("/runs/{id}")).Filter(authenticate).To(apiGetRun).
+		Doc("Get a state machine run").
+		Notes("Input is the output of the last executed state. It is embedded as JSON when it is a JSON object or array.").
+		Param(runId).
+		Writes(RunResponse{}).
+		Returns(400, "Invalid run id", errorModel).
+		Returns(404, "Run not found", errorModel))
+	ws.Route(route(ws.GET("/runs/{id}/history")).Filter(authenticate).To(apiGetRunHistory).
+		Doc("Get the state transitions of a state machine run").
+		Param(runId).
+		Writes([]HistoryEntry{}).
+		Returns(400, "Invalid run id", errorModel).
+		Returns(404, "Run not found", errorModel))
+	ws.Route(route(ws.GET("/runs/{id}/output")).Filter(authenticate).Produces(restful.MIME_OCTET, restful.MIME_JSON).To(apiGetRunOutput).
+		Doc("Download the output of the last executed state of a run as raw bytes").
+		Param(runId).
+		Returns(404, "Run not found", errorModel).
+		Returns(410, "The output was removed after BlobRetentionDays", errorModel))
+	ws.Route(route(ws.GET("/runs/{id}/files")).Filter(authenticate).To(apiGetRunFiles).
+		Doc("List the files in the workspace of a run").
+		Param(runId).
+		Writes([]WorkspaceFile{}).
+		Returns(404, "Run not found", errorModel))
+	ws.Route(route(ws.GET("/runs/{id}/files/{path:*}")).Filter(authenticate).Produces(restful.MIME_OCTET, restful.MIME_JSON).To(apiGetRunFiles).
+		Doc("Download a file from the workspace of a run, or list a directory").
+		Param(runId).
+		Param(ws.PathParameter("path", "Path of the file relative to the workspace")).
+		Returns(404, "Run or file not found", errorModel))
+	ws.Route(route(ws.POST("/runs/{machine}")).Filter(auditFilter).Filter(authenticate).Consumes(restful.MIME_OCTET, restful.MIME_JSON).To(apiRunMachine).
+		Doc("Start a state machine run").
+		Notes("An application/octet-stream body is the input of the start state. An application/json body is a RunRequest with the input, labels, a start time and a callback URL that gets the finished run POSTed to it. The Location header of the response is the new run.").
+		Param(machineName).
+		Reads(RunRequest{}).
+		Returns(202, "The run was scheduled", ExecuteResponse{}).
+		Returns(400, "Malformed run request", errorModel).
+		Returns(404, "State machine not found", errorModel).
+		Returns(413, "Input exceeds MaxInputBytes", errorModel).
+		Returns(422, "Invalid labels or callbackUrl", errorModel).
+		Returns(503, "restatemachine is draining", errorModel))
+	ws.Route(route(ws.POST("/runs/{id}/pause")).Filter(auditFilter).Filter(authenticate).Consumes(restful.MIME_OCTET, restful.MIME_JSON).To(apiPauseRun).
+		Doc("Stop executing further states of a run until it is resumed").
+		Param(runId).
+		Writes(RunResponse{}).
+		Returns(404, "Run not found", errorModel).
+		Returns(409, "The run isn't active or is executing a state", errorModel))
+	ws.Route(route(ws.POST("/runs/{id}/resume")).Filter(auditFilter).Filter(authenticate).Consumes(restful.MIME_OCTET, restful.MIME_JSON).To(apiResumeRun).
+		Doc("Resume a paused run").
+		Param(runId).
+		Writes(RunResponse{}).
+		Returns(404, "Run not found", errorModel).
+		Returns(409, "The run isn't active or is executing a state", errorModel))
+	ws.Route(route(ws.POST("/runs/{id}/retry")).Filter(auditFilter).Filter(authenticate).Consumes(restful.MIME_OCTET, restful.MIME_JSON).To(apiRetryRun).
+		Doc("Execute the next state of a run now").
+		Notes("Resumes the run if it is paused and skips the wait until NextStateRun, e.g. to retry a failing state right away.").
+		Param(runId).
+		Writes(RunResponse{}).
+		Returns(404, "Run not found", errorModel).
+		Returns(409, "The run isn't active or is executing a state", errorModel))
+	ws.Route(route(ws.DELETE("/runs/{id}")).Filter(auditFilter).Filter(authenticate).To(apiDeleteRun).
+		Doc("Cancel a state machine run").
+		Param(runId).
+		Writes(MessageResponse{}).
+		Returns(404, "Run not found", errorModel).
+		Returns(409, "The run isn't active or is executing a state", errorModel))
+	ws.Route(route(ws.GET("/tokens")).Filter(authenticate).To(apiListTokens).
+		Doc("List the API tokens").
+		Writes([]ApiToken{}))
+	ws.Route(route(ws.GET("/tokens/{id}")).Filter(authenticate).To(apiGetToken).
+		Doc("Get an API token").
+		Param(ws.PathParameter("id", "Id of the token")).
+		Writes(ApiToken{}).
+		Returns(404, "Token not found", errorModel))
+	ws.Route(route(ws.POST("/tokens")).Filter(auditFilter).Filter(authenticate).Consumes(restful.MIME_JSON).To(apiCreateToken).
+		Doc("Create an API token").
+		Notes("The token itself is only returned in this response. The Location header of the response is the new token.").
+		Reads(CreateTokenRequest{}).
+		Returns(201, "The token was created", CreateTokenResponse{}).
+		Returns(400, "Malformed token request", errorModel).
+		Returns(422, "Invalid name, scopes or expiry", errorModel))
+	ws.Route(route(ws.DELETE("/tokens/{id}")).Filter(auditFilter).Filter(authenticate).To(apiDeleteToken).
+		Doc("Delete an API token").
+		Param(ws.PathParameter("id", "Id of the token")).
+		Writes(MessageResponse{}).
+		Returns(404, "Token not found", errorModel))
+	ws.Route(route(ws.GET("/audit")).Filter(authenticate).To(apiQueryAudit).
+		Doc("Query the audit log, newest entries first").
+		Param(ws.QueryParameter("limit", "Maximum number of entries, 100 by default").DataType("integer")).
+		Param(ws.QueryParameter("identity", "Only return entries of this identity")).
+		Param(ws.QueryParameter("since", "Only return entries at or after this RFC 3339 time").DataType("date-time")).
+		Writes([]AuditEntry{}).
+		Returns(400, "Invalid query parameter", errorModel))
+	ws.Route(route(ws.GET("/admin/drain")).Filter(authenticate).To(apiGetDrain).
+		Doc("Get the drain status").
+		Writes(DrainStatus{}))
+	ws.Route(route(ws.POST("/admin/drain")).Filter(auditFilter).Filter(authenticate).To(apiStartDrain).
+		Doc("Stop accepting new runs and starting new states").
+		Writes(DrainStatus{}))
+	ws.Route(route(ws.DELETE("/admin/drain")).Filter(auditFilter).Filter(authenticate).To(apiStopDrain).
+		Doc("Resume accepting new runs and starting new states").
+		Writes(DrainStatus{}))
+	ws.Route(route(ws.GET("/admin/backup")).Filter(auditFilter).Filter(authenticate).Produces(restful.MIME_OCTET, restful.MIME_JSON).To(apiBackup).
+		Doc("Download a consistent snapshot of the database").
+		Returns(501, "The storage backend doesn't support backups", errorModel))
+}
+
+// deprecatedFilter marks responses of the unversioned aliases as deprecated
+// and points to the /v1 route that replaces them.
+func deprecatedFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	resp.AddHeader("Deprecation", "true")
+	resp.AddHeader("Link", "<"+apiVersionPath+req.Request.URL.Path+`>; rel="successor-version"`)
+	chain.ProcessFilter(req, resp)
+}
+
+func isDeprecated(resp *restful.Response) bool {
+	return resp.Header().Get("Deprecation") != ""
+}
+
+// apiPath returns path under the API version that req was made to.
+func apiPath(req *restful.Request, path string) string {
+	if strings.HasPrefix(req.Request.URL.Path, apiVersionPath+"/") {
+		return apiVersionPath + path
 	}
+	return path
+}
 
-	auth := strings.SplitN(encoded, " ", 2)
-	if len(auth) != 2 || auth[0] != "Basic" {
-		unAuthorized()
-		return
+// markDeprecatedOperations marks the operations of the unversioned aliases as
+// deprecated in the Swagger documentation.
+func markDeprecatedOperations(v1 *restful.WebService) swagger.PostBuildDeclarationMapFunc {
+	return func(declarations map[string]swagger.ApiDeclaration) {
+		versioned := make(map[string]bool)
+		for _, route := range v1.Routes() {
+			versioned[strings.TrimPrefix(route.Path, apiVersionPath)] = true
+		}
+
+		for name, declaration := range declarations {
+			if name == apiVersionPath {
+				continue
+			}
+
+			for _, api := range declaration.Apis {
+				if !versioned[api.Path] {
+					continue
+				}
+				for idx := range api.Operations {
+					api.Operations[idx].Deprecated = "true"
+					api.Operations[idx].Notes = strings.TrimSpace("Deprecated, use " + apiVersionPath + api.Path + " instead. " + api.Operations[idx].Notes)
+				}
+			}
+		}
 	}
+}
 
-	decoded_auth, _ := base64.StdEncoding.DecodeString(auth[1])
-	credentials := strings.SplitN(string(decoded_auth), ":", 2)
+// ApiError is the body of all error responses. Code is a stable identifier of
+// the error for clients to act on, Message is meant for humans.
+type ApiError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
 
-	if len(credentials) != 2 || credentials[0] != globalConfig.Username || credentials[1] != globalConfig.Password {
-		unAuthorized()
-		return
+const (
+	errorInvalidRequest   = "invalid_request"
+	errorValidationFailed = "validation_failed"
+	errorUnauthorized     = "unauthorized"
+	errorForbidden        = "forbidden"
+	errorMachineNotFound  = "machine_not_found"
+	errorRunNotFound      = "run_not_found"
+	errorRunNotActive     = "run_not_active"
+	errorRunExecuting     = "run_executing"
+	errorTokenNotFound    = "token_not_found"
+	errorFileNotFound     = "file_not_found"
+	errorOutputRemoved    = "output_removed"
+	errorPayloadTooLarge  = "payload_too_large"
+	errorTooManyAttempts  = "too_many_attempts"
+	errorDraining         = "draining"
+	errorNotSupported     = "not_supported"
+	errorInternal         = "internal_error"
+)
+
+func errorResponse(status int, code string, message string, resp *restful.Response) {
+	writeError(status, ApiError{Code: code, Message: message}, resp)
+}
+
+// writeError writes apiError as JSON whatever the route produces, so that e.g.
+// an unauthenticated request for the text metrics gets a 401 and not a 406.
+// The deprecated aliases keep the error body of the unversioned API.
+func writeError(status int, apiError ApiError, resp *restful.Response) {
+	resp.WriteHeader(status)
+	if isDeprecated(resp) {
+		resp.WriteJson(restful.NewError(status, apiError.Message), restful.MIME_JSON)
+	} else {
+		resp.WriteJson(apiError, restful.MIME_JSON)
 	}
-	chain.ProcessFilter(req, resp)
 }
 
-func noAuthentication(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-	chain.ProcessFilter(req, resp)
+// runError writes the error of looking up or changing the run id, message
+// prefixes unexpected errors.
+func runError(message string, err error, id string, resp *restful.Response) {
+	details := map[string]interface{}{"id": id}
+	switch err.(type) {
+	case InvalidRunIdError:
+		writeError(400, ApiError{Code: errorInvalidRequest, Message: err.Error(), Details: details}, resp)
+	case RunNotFoundError:
+		writeError(404, ApiError{Code: errorRunNotFound, Message: err.Error(), Details: details}, resp)
+	case RunNotActiveError:
+		writeError(409, ApiError{Code: errorRunNotActive, Message: err.Error(), Details: details}, resp)
+	case RunExecutingError:
+		writeError(409, ApiError{Code: errorRunExecuting, Message: err.Error(), Details: details}, resp)
+	default:
+		writeError(500, ApiError{Code: errorInternal, Message: message + ": " + err.Error(), Details: details}, resp)
+	}
 }
 
-func errorResponse(code int, message string, resp *restful.Response) {
-	resp.WriteServiceError(code, restful.NewError(code, message))
+// apiDocsPath is where the Swagger documentation of the API is served. The
+// declarations of the resources are below it, e.g. /apidocs.json/runs.
+const apiDocsPath = "/apidocs.json"
+
+type MessageResponse struct {
+	Message string
+}
+
+type ApiLink struct {
+	Href        string
+	Description string
+}
+
+type ApiIndex struct {
+	Name          string
+	Version       string
+	Documentation string
+	Links         []ApiLink
+	Machines      []ApiLink
 }
 
 func apiUsage(req *restful.Request, resp *restful.Response) {
-	io.WriteString(resp, "Usage goes here\n")
+	index := ApiIndex{
+		Name:          "restatemachine",
+		Version:       globalVersionNumber,
+		Documentation: apiDocsPath,
+		Links: []ApiLink{
+			{Href: apiVersionPath + "/machines", Description: "State machines"},
+			{Href: apiVersionPath + "/runs", Description: "Active state machine runs, POST " + apiVersionPath + "/runs/{machine} starts a run"},
+			{Href: apiVersionPath + "/tokens", Description: "API tokens"},
+			{Href: apiVersionPath + "/audit", Description: "Audit log"},
+			{Href: dashboardPath, Description: "Web dashboard"},
+			{Href: apiDocsPath, Description: "Swagger documentation of the API"},
+			{Href: "/metrics", Description: "Metrics in the Prometheus text format"},
+			{Href: "/healthz", Description: "Liveness check"},
+			{Href: "/readyz", Description: "Readiness check"},
+		},
+		Machines: make([]ApiLink, 0),
+	}
+
+	identity := requestIdentity(req)
+	for _, machine := range globalStateMachines {
+		if identity.Can(actionList, machine.Name) {
+			index.Machines = append(index.Machines, ApiLink{Href: apiVersionPath + "/machines/" + machine.Name, Description: firstLine(machine.Usage)})
+		}
+	}
+
+	resp.WriteEntity(index)
+}
+
+func apiMetrics(req *restful.Request, resp *restful.Response) {
+	resp.AddHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := writeMetrics(resp); err != nil {
+		logWarn(LogFields{"error": err}, "error writing metrics")
+	}
 }
 
 func apiListMachines(req *restful.Request, resp *restful.Response) {
-	resp.WriteEntity(globalStateMachines)
+	identity := requestIdentity(req)
+	machines := make([]StateMachine, 0, len(globalStateMachines))
+	for _, machine := range globalStateMachines {
+		if identity.Can(actionList, machine.Name) {
+			machines = append(machines, machine)
+		}
+	}
+
+	resp.WriteEntity(machines)
 }
 
 func apiGetMachine(req *restful.Request, resp *restful.Response) {
 	name := req.PathParameter("name")
 
 	if machine := machineGet(name); machine != nil {
+		if !authorize(req, resp, actionList, name) {
+			return
+		}
 		resp.WriteEntity(machine)
 	} else {
-		errorResponse(404, "State machine not found", resp)
+		errorResponse(404, errorMachineNotFound, "State machine not found", resp)
 	}
 }
 
+// apiListCurrentRuns lists the active runs, or with the status parameter the
+// runs in the storage including finished ones.
 func apiListCurrentRuns(req *restful.Request, resp *restful.Response) {
-	resp.WriteEntity(globalScheduler.GetRunningMachines())
+	filter := RunFilter{Machine: req.QueryParameter("machine"), Status: req.QueryParameter("status"), Limit: 100}
+	if filter.Status != "" && filter.Status != runStatusActive && filter.Status != runStatusFinished && filter.Status != "all" {
+		errorResponse(400, errorInvalidRequest, "status must be active, finished or all", resp)
+		return
+	} else if filter.Status == "all" {
+		filter.Status = ""
+	}
+
+	if limitParam := req.QueryParameter("limit"); limitParam != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limitParam)
+		if err != nil || filter.Limit <= 0 {
+			errorResponse(400, errorInvalidRequest, "limit must be a positive integer", resp)
+			return
+		}
+	}
+
+	var machines []*RunningMachine
+	if req.QueryParameter("status") == "" {
+		for _, machine := range *globalScheduler.GetRunningMachines() {
+			if filter.matches(machine, true) {
+				machines = append(machines, machine)
+			}
+		}
+	} else {
+		var err error
+		machines, err = globalScheduler.Storage.ListRuns(filter)
+		if err != nil {
+			errorResponse(500, errorInternal, "Error listing state machine runs: "+err.Error(), resp)
+			return
+		}
+	}
+
+	identity := requestIdentity(req)
+	runs := make([]RunResponse, 0)
+	for _, machine := range machines {
+		if identity.Can(actionList, machine.Name) {
+			runs = append(runs, newRunResponse(machine))
+		}
+	}
+
+	resp.WriteEntity(runs)
 }
 
 func apiGetRun(req *restful.Request, resp *restful.Response) {
 	id := req.PathParameter("id")
 	machine, err := globalScheduler.GetMachineRun(id)
 	if err != nil {
-		errorResponse(500, "Error retrieving information about state machine run: "+err.Error(), resp)
+		runError("Error retrieving information about state machine run", err, id, resp)
+	} else if authorize(req, resp, actionList, machine.Name) {
+		resp.WriteEntity(newRunResponse(machine))
+	}
+}
+
+// RunRequest is the JSON form of a POST /runs/{machine} body. An Input that is
+// a JSON string is passed to the start state as that string, any other JSON
+// value as its JSON text.
+type RunRequest struct {
+	Input       json.RawMessage   `json:"input,omitempty" description:"Input of the start state"`
+	Labels      map[string]string `json:"labels,omitempty" description:"Labels stored with the run"`
+	StartAt     time.Time         `json:"startAt,omitempty" description:"Time to execute the start state at, right away by default"`
+	CallbackUrl string            `json:"callbackUrl,omitempty" description:"URL that the finished run is POSTed to"`
+}
+
+// RunResponse is a run as returned by the API. Input is embedded as JSON when
+// it is a JSON object or array and returned as a string otherwise.
+type RunResponse struct {
+	RunningMachine
+	Input json.RawMessage `description:"Output of the last executed state"`
+}
+
+var labelNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func newRunResponse(run *RunningMachine) RunResponse {
+	redacted := redactRun(run)
+	response := RunResponse{RunningMachine: *redacted}
+
+	trimmed := strings.TrimSpace(redacted.Input)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		response.Input = json.RawMessage(trimmed)
 	} else {
-		resp.WriteEntity(machine)
+		response.Input, _ = json.Marshal(redacted.Input)
 	}
+
+	return response
 }
 
+// readRunRequest parses a JSON run request and returns its input and options,
+// or the status and error to respond with.
+func readRunRequest(req *restful.Request) (string, RunOptions, int, *ApiError) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Request.Body, int64(globalConfig.MaxInputBytes)+1))
+	if err != nil {
+		return "", RunOptions{}, 500, &ApiError{Code: errorInternal, Message: "Error reading request body"}
+	}
+
+	if len(body) > globalConfig.MaxInputBytes {
+		return "", RunOptions{}, 413, &ApiError{Code: errorPayloadTooLarge,
+			Message: "Error reading request body: " + PayloadTooLargeError{Limit: int64(globalConfig.MaxInputBytes)}.Error(),
+			Details: map[string]interface{}{"limit": globalConfig.MaxInputBytes}}
+	}
+
+	// Unknown fields are rejected so that a misspelt field doesn't start a
+	// run without it
+	var request RunRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&request)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = fmt.Errorf("unexpected data after the run request")
+	}
+	if err != nil {
+		return "", RunOptions{}, 400, &ApiError{Code: errorInvalidRequest, Message: "Error parsing run request: " + err.Error()}
+	}
+
+	input := string(request.Input)
+	if len(request.Input) == 0 || input == "null" {
+		input = ""
+	} else if request.Input[0] == '"' {
+		json.Unmarshal(request.Input, &input)
+	}
+
+	for name := range request.Labels {
+		if !labelNamePattern.MatchString(name) {
+			return "", RunOptions{}, 422, &ApiError{Code: errorValidationFailed,
+				Message: fmt.Sprintf("Invalid label name %q, label names must match %s", name, labelNamePattern),
+				Details: map[string]interface{}{"field": "labels", "label": name}}
+		}
+	}
+
+	if request.CallbackUrl != "" {
+		callbackUrl, err := url.Parse(request.CallbackUrl)
+		if err != nil || (callbackUrl.Scheme != "http" && callbackUrl.Scheme != "https") || callbackUrl.Host == "" {
+			return "", RunOptions{}, 422, &ApiError{Code: errorValidationFailed,
+				Message: fmt.Sprintf("Invalid callbackUrl %q, expected an http or https URL", request.CallbackUrl),
+				Details: map[string]interface{}{"field": "callbackUrl"}}
+		}
+	}
+
+	return input, RunOptions{Labels: request.Labels, StartAt: request.StartAt, CallbackUrl: request.CallbackUrl}, 0, nil
+}
+
+// apiRunMachine starts a run. The body is either the raw input or, with
+// Content-Type application/json, a RunRequest.
 func apiRunMachine(req *restful.Request, resp *restful.Response) {
 	name := req.PathParameter("machine")
+	if !authorize(req, resp, actionStart, name) {
+		return
+	}
+
+	var body io.Reader = req.Request.Body
+	var options RunOptions
+	if strings.HasPrefix(req.HeaderParameter("Content-Type"), restful.MIME_JSON) {
+		input, requestOptions, status, apiError := readRunRequest(req)
+		if apiError != nil {
+			writeError(status, *apiError, resp)
+			return
+		}
+		body = strings.NewReader(input)
+		options = requestOptions
+	}
+
+	payload := newPayloadWriter(int64(globalConfig.MaxInputBytes))
+	defer payload.Discard()
+	if _, err := io.Copy(payload, body); err != nil {
+		if _, ok := err.(PayloadTooLargeError); ok {
+			writeError(413, ApiError{Code: errorPayloadTooLarge, Message: "Error reading request body: " + err.Error(),
+				Details: map[string]interface{}{"limit": globalConfig.MaxInputBytes}}, resp)
+		} else {
+			errorResponse(500, errorInternal, "Error reading request body", resp)
+		}
+		return
+	}
 
-	buffer, err := ioutil.ReadAll(req.Request.Body)
+	input, inputBlob, err := payload.Finish()
 	if err != nil {
-		errorResponse(500, "Error reading request body", resp)
+		errorResponse(500, errorInternal, "Error storing input: "+err.Error(), resp)
 		return
 	}
 
-	errCode, errMessage, executeResponse := machineExecute(name, string(buffer))
-	if errMessage != "" {
-		errorResponse(errCode, errMessage, resp)
-	} else {
+	status, errMessage, executeResponse := machineExecute(name, input, inputBlob, requestIdentity(req).Name, options)
+	switch status {
+	case -1:
+		resp.AddHeader("Location", apiPath(req, fmt.Sprintf("/runs/%d", executeResponse.Id)))
+		resp.WriteHeader(202)
 		resp.WriteEntity(executeResponse)
+	case 404:
+		errorResponse(status, errorMachineNotFound, errMessage, resp)
+	case 503:
+		errorResponse(status, errorDraining, errMessage, resp)
+	default:
+		errorResponse(status, errorInternal, errMessage, resp)
 	}
 }
 
-func apiDeleteRun(req *restful.Request, resp *restful.Response) {
-	type DeleteResponse struct {
-		Message string
+func apiPauseRun(req *restful.Request, resp *restful.Response) {
+	apiChangeRun(req, resp, globalScheduler.PauseMachineRun)
+}
+
+func apiResumeRun(req *restful.Request, resp *restful.Response) {
+	apiChangeRun(req, resp, globalScheduler.ResumeMachineRun)
+}
+
+func apiRetryRun(req *restful.Request, resp *restful.Response) {
+	apiChangeRun(req, resp, globalScheduler.RetryMachineRun)
+}
+
+// apiChangeRun applies one of the scheduler's overrides to the run in the path
+// and returns the changed run.
+func apiChangeRun(req *restful.Request, resp *restful.Response, change func(id string, user string) (*RunningMachine, error)) {
+	id := req.PathParameter("id")
+	machine, err := globalScheduler.GetMachineRun(id)
+	if err != nil {
+		runError("Error retrieving information about state machine run", err, id, resp)
+		return
+	}
+
+	if !authorize(req, resp, actionOverride, machine.Name) {
+		return
 	}
 
+	machine, err = change(id, requestIdentity(req).Name)
+	if err != nil {
+		runError("Error changing state machine run", err, id, resp)
+	} else {
+		resp.WriteEntity(newRunResponse(machine))
+	}
+}
+
+func apiDeleteRun(req *restful.Request, resp *restful.Response) {
 	id := req.PathParameter("id")
-	err := globalScheduler.CancelMachineRun(id)
+	machine, err := globalScheduler.GetMachineRun(id)
+	if err != nil {
+		runError("Error retrieving information about state machine run", err, id, resp)
+		return
+	}
+
+	if !authorize(req, resp, actionCancel, machine.Name) {
+		return
+	}
+
+	err = globalScheduler.CancelMachineRun(id, requestIdentity(req).Name)
 	if err != nil {
-		errorResponse(500, "Error cancelling state machine run", resp)
+		runError("Error cancelling state machine run", err, id, resp)
 	} else {
-		responseStruct := DeleteResponse{Message: "State machine run cancelled successfully"}
-		resp.WriteEntity(responseStruct)
+		resp.WriteEntity(MessageResponse{Message: "State machine run cancelled successfully"})
 	}
 }
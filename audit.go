@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AuditEntry struct {
+	Id         uint64
+	Time       time.Time
+	Identity   string
+	AuthMethod string
+	Remote     string
+	Action     string
+	Target     string
+	Status     int
+	Outcome    string
+}
+
+type AuditLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+var globalAuditLog AuditLog
+
+func initAuditLog() error {
+	if globalConfig.AuditLogFile == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(globalConfig.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log file %s: %s", globalConfig.AuditLogFile, err)
+	}
+
+	globalAuditLog.file = file
+	return nil
+}
+
+func (a *AuditLog) Record(entry *AuditEntry) error {
+	err := globalScheduler.Storage.AppendAuditEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file != nil {
+		entryJson, _ := json.Marshal(entry)
+		if _, err := a.file.Write(append(entryJson, '\n')); err != nil {
+			return fmt.Errorf("error writing audit log file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Query returns up to limit entries, newest first, optionally filtered by
+// identity and a start time.
+func (a *AuditLog) Query(limit int, identity string, since time.Time) ([]AuditEntry, error) {
+	return globalScheduler.Storage.QueryAuditEntries(limit, identity, since)
+}
+
+// auditFilter records mutating API calls. It runs before authentication so that
+// rejected attempts are recorded as well.
+func auditFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	chain.ProcessFilter(req, resp)
+
+	entry := &AuditEntry{
+		Time:    time.Now(),
+		Remote:  remoteHost(req),
+		Action:  req.Request.Method + " " + req.SelectedRoutePath(),
+		Target:  req.Request.URL.Path,
+		Status:  resp.StatusCode(),
+		Outcome: "success",
+	}
+
+	if identity, ok := req.Attribute("identity").(*Identity); ok {
+		entry.Identity = identity.Name
+		entry.AuthMethod = identity.Method
+	}
+
+	if entry.Status >= 400 {
+		entry.Outcome = "failure"
+	}
+
+	if err := globalAuditLog.Record(entry); err != nil {
+		logError(LogFields{"error": err, "action": entry.Action, "target": entry.Target}, "error recording audit log entry")
+	}
+}
+
+func apiQueryAudit(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	limit := 100
+	if limitParam := req.QueryParameter("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			errorResponse(400, errorInvalidRequest, "limit must be a positive integer", resp)
+			return
+		}
+	}
+
+	var since time.Time
+	if sinceParam := req.QueryParameter("since"); sinceParam != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, sinceParam)
+		if err != nil {
+			errorResponse(400, errorInvalidRequest, "since must be an RFC 3339 timestamp", resp)
+			return
+		}
+	}
+
+	entries, err := globalAuditLog.Query(limit, req.QueryParameter("identity"), since)
+	if err != nil {
+		errorResponse(500, errorInternal, "Error querying audit log: "+err.Error(), resp)
+		return
+	}
+
+	resp.WriteEntity(entries)
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/emicklei/go-restful"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions that can be granted on a state machine.
+const (
+	actionList     = "list"
+	actionStart    = "start"
+	actionCancel   = "cancel"
+	actionOverride = "override"
+)
+
+// actionAdmin is granted globally rather than per machine.
+const actionAdmin = "admin"
+
+var roleActions = map[string][]string{
+	"viewer":   {actionList},
+	"operator": {actionList, actionStart, actionCancel},
+	"admin":    {actionList, actionStart, actionCancel, actionOverride, actionAdmin},
+}
+
+type UserPermission struct {
+	Machine string
+	Actions []string
+}
+
+type User struct {
+	Name       string
+	Password   string
+	Role       string
+	Machines   []string
+	Permission []UserPermission
+}
+
+type UsersFile struct {
+	User []User
+}
+
+type Identity struct {
+	Name   string
+	Role   string
+	Method string
+	User   *User
+	Scopes []string
+}
+
+// anonymousIdentity is used for all requests when no authentication is configured.
+var anonymousIdentity = &Identity{Name: "anonymous", Role: "admin", Method: "none"}
+
+// unauthenticatedIdentity is returned for requests that weren't authenticated,
+// e.g. by a route missing the authenticate filter, it isn't permitted anything.
+var unauthenticatedIdentity = &Identity{Name: "unauthenticated", Method: "none"}
+
+type Authenticator struct {
+	Users map[string]*User
+
+	lock      sync.Mutex
+	failures  map[string]*authFailures
+	lastSweep time.Time
+}
+
+type authFailures struct {
+	Count       int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Failed attempts are limited per remote host. The limit per user only stops
+// guessing spread over many hosts, so it is authUserLockoutFactor times higher
+// to make it hard for others to lock a user out.
+const authUserLockoutFactor = 10
+
+// expired reports whether failures no longer count: the lockout has ended, or
+// without a lockout the last failure is older than the lockout window.
+func (f *authFailures) expired(currentTime time.Time, window time.Duration) bool {
+	if !f.LockedUntil.IsZero() {
+		return !f.LockedUntil.After(currentTime)
+	}
+	return !f.LastFailure.Add(window).After(currentTime)
+}
+
+var globalAuthenticator *Authenticator
+
+// dummyPasswordHash is verified against when a user doesn't exist, so that unknown
+// and known usernames take the same time to reject.
+var dummyPasswordHash = shaCrypt("$6$", "restatemachine", "dummysaltdummysa", shaCryptDefaultRounds, false)
+
+func loadUsersFile(path string) (map[string]*User, error) {
+	var usersFile UsersFile
+	metaData, err := toml.DecodeFile(path, &usersFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading users file %s: %s", path, err)
+	}
+
+	var errors ConfigErrors
+	for _, key := range metaData.Undecoded() {
+		errors = append(errors, fmt.Sprintf("unknown key %s in users file %s", key, path))
+	}
+
+	users := make(map[string]*User)
+	for idx := range usersFile.User {
+		user := &usersFile.User[idx]
+		if user.Name == "" || strings.Contains(user.Name, ":") {
+			errors = append(errors, fmt.Sprintf("user #%d in %s has an empty name or a name containing ':'", idx+1, path))
+			continue
+		}
+
+		if _, exists := users[user.Name]; exists {
+			errors = append(errors, fmt.Sprintf("user %s is defined more than once in %s", user.Name, path))
+		}
+
+		if _, ok := roleActions[user.Role]; !ok {
+			errors = append(errors, fmt.Sprintf("user %s has unknown role %q, expected viewer, operator or admin", user.Name, user.Role))
+		}
+
+		if err := checkPasswordHashFormat(user.Password); err != nil {
+			errors = append(errors, fmt.Sprintf("user %s: %s", user.Name, err))
+		}
+
+		for _, permission := range user.Permission {
+			for _, action := range permission.Actions {
+				if action != actionList && action != actionStart && action != actionCancel && action != actionOverride {
+					errors = append(errors, fmt.Sprintf("user %s has unknown action %q for machine %s", user.Name, action, permission.Machine))
+				}
+			}
+		}
+
+		users[user.Name] = user
+	}
+
+	if len(errors) > 0 {
+		return nil, errors
+	}
+
+	return users, nil
+}
+
+func initAuthentication() error {
+	if globalConfig.UsersFile == "" && globalConfig.Username == "" && len(globalConfig.ClientCertificate) == 0 {
+		globalAuthenticator = nil
+		return nil
+	}
+
+	authenticator := &Authenticator{Users: make(map[string]*User), failures: make(map[string]*authFailures)}
+
+	if globalConfig.UsersFile != "" {
+		users, err := loadUsersFile(globalConfig.UsersFile)
+		if err != nil {
+			return err
+		}
+		authenticator.Users = users
+	}
+
+	globalAuthenticator = authenticator
+	return nil
+}
+
+func (a *Authenticator) lockedOut(keys ...string) (bool, time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	currentTime := time.Now()
+	for _, key := range keys {
+		if failures, ok := a.failures[key]; ok && failures.LockedUntil.After(currentTime) {
+			return true, failures.LockedUntil.Sub(currentTime)
+		}
+	}
+
+	return false, 0
+}
+
+func (a *Authenticator) recordFailure(keys ...string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	currentTime := time.Now()
+	window := time.Duration(globalConfig.AuthLockoutSeconds) * time.Second
+
+	// Forget expired failures so that the map only holds recent attempts
+	if currentTime.Sub(a.lastSweep) >= window {
+		for key, failures := range a.failures {
+			if failures.expired(currentTime, window) {
+				delete(a.failures, key)
+			}
+		}
+		a.lastSweep = currentTime
+	}
+
+	for _, key := range keys {
+		failures, ok := a.failures[key]
+		if !ok || failures.expired(currentTime, window) {
+			failures = &authFailures{}
+			a.failures[key] = failures
+		}
+
+		attempts := globalConfig.AuthLockoutAttempts
+		if strings.HasPrefix(key, "user:") {
+			attempts *= authUserLockoutFactor
+		}
+
+		failures.Count++
+		failures.LastFailure = currentTime
+		if failures.Count >= attempts {
+			failures.LockedUntil = currentTime.Add(window)
+			logWarn(LogFields{"key": key, "seconds": globalConfig.AuthLockoutSeconds}, "too many failed authentication attempts, locking out")
+		}
+	}
+}
+
+func (a *Authenticator) recordSuccess(keys ...string) {
+	a.lock.Lock()
+	for _, key := range keys {
+		delete(a.failures, key)
+	}
+	a.lock.Unlock()
+}
+
+// checkPassword verifies credentials against the users file and the legacy
+// Username/Password config settings.
+func (a *Authenticator) checkPassword(username string, password string) *Identity {
+	if globalConfig.Username != "" {
+		expectedUser := sha256.Sum256([]byte(globalConfig.Username))
+		expectedPassword := sha256.Sum256([]byte(globalConfig.Password))
+		givenUser := sha256.Sum256([]byte(username))
+		givenPassword := sha256.Sum256([]byte(password))
+		userMatch := subtle.ConstantTimeCompare(expectedUser[:], givenUser[:])
+		passwordMatch := subtle.ConstantTimeCompare(expectedPassword[:], givenPassword[:])
+		if userMatch&passwordMatch == 1 {
+			return &Identity{Name: username, Role: "admin", Method: "basic"}
+		}
+	}
+
+	user, ok := a.Users[username]
+	if !ok {
+		passwordMatches(dummyPasswordHash, password)
+		return nil
+	}
+
+	if !passwordMatches(user.Password, password) {
+		return nil
+	}
+
+	return &Identity{Name: user.Name, Role: user.Role, Method: "basic", User: user}
+}
+
+// knownUser reports whether username exists, failures are only tracked per
+// user for those so that guessed names don't fill the failures map.
+func (a *Authenticator) knownUser(username string) bool {
+	if globalConfig.Username != "" && username == globalConfig.Username {
+		return true
+	}
+	_, ok := a.Users[username]
+	return ok
+}
+
+// remoteHost returns the address of the client of req. Behind the proxies in
+// TrustedProxies it is the last address in X-Forwarded-For that wasn't added
+// by a trusted proxy, so that clients are told apart by the lockout.
+func remoteHost(req *restful.Request) string {
+	host, _, err := net.SplitHostPort(req.Request.RemoteAddr)
+	if err != nil {
+		host = req.Request.RemoteAddr
+	}
+
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(req.Request.Header["X-Forwarded-For"], ","), ",")
+	for idx := len(forwarded) - 1; idx >= 0; idx-- {
+		address := strings.TrimSpace(forwarded[idx])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		host = address
+		if !isTrustedProxy(host) {
+			break
+		}
+	}
+
+	return host
+}
+
+// parseTrustedProxy parses an entry of TrustedProxies, an address or a CIDR
+// network.
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if ip := net.ParseIP(proxy); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither an address nor a CIDR network", proxy)
+	}
+	return network, nil
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range globalConfig.TrustedProxies {
+		if network, err := parseTrustedProxy(proxy); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func unauthorizedResponse(resp *restful.Response) {
+	resp.AddHeader("WWW-Authenticate", "Basic realm=Protected Area")
+	errorResponse(401, errorUnauthorized, "Not authorized", resp)
+}
+
+func (a *Authenticator) authenticateBasic(req *restful.Request, resp *restful.Response, credentials string) *Identity {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		unauthorizedResponse(resp)
+		return nil
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		unauthorizedResponse(resp)
+		return nil
+	}
+
+	keys := []string{"host:" + remoteHost(req)}
+	if a.knownUser(parts[0]) {
+		keys = append(keys, "user:"+parts[0])
+	}
+	if locked, remaining := a.lockedOut(keys...); locked {
+		resp.AddHeader("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
+		errorResponse(429, errorTooManyAttempts, "Too many failed authentication attempts, try again later", resp)
+		return nil
+	}
+
+	identity := a.checkPassword(parts[0], parts[1])
+	if identity == nil {
+		a.recordFailure(keys...)
+		logWarn(LogFields{"user": parts[0], "remote": remoteHost(req)}, "failed authentication attempt")
+		unauthorizedResponse(resp)
+		return nil
+	}
+
+	a.recordSuccess(keys...)
+	return identity
+}
+
+func authenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if globalAuthenticator == nil {
+		req.SetAttribute("identity", anonymousIdentity)
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	if identity := authenticateCertificate(req); identity != nil {
+		req.SetAttribute("identity", identity)
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	auth := strings.SplitN(req.Request.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 {
+		unauthorizedResponse(resp)
+		return
+	}
+
+	var identity *Identity
+	switch auth[0] {
+	case "Basic":
+		identity = globalAuthenticator.authenticateBasic(req, resp, auth[1])
+	case "Bearer":
+		identity = globalAuthenticator.authenticateBearer(req, resp, auth[1])
+	default:
+		unauthorizedResponse(resp)
+		return
+	}
+
+	if identity == nil {
+		return
+	}
+
+	req.SetAttribute("identity", identity)
+	chain.ProcessFilter(req, resp)
+}
+
+// Can reports whether the identity may perform action on the named machine. For
+// actionAdmin the machine is ignored.
+func (i *Identity) Can(action string, machine string) bool {
+	if i.Method == "token" {
+		return tokenAllows(i.Scopes, action, machine)
+	}
+
+	if i.User == nil {
+		return containsString(roleActions[i.Role], action)
+	}
+
+	if action == actionAdmin {
+		return containsString(roleActions[i.User.Role], actionAdmin)
+	}
+
+	var wildcard *UserPermission
+	for idx, permission := range i.User.Permission {
+		if permission.Machine == machine {
+			return containsString(permission.Actions, action)
+		} else if permission.Machine == "*" {
+			wildcard = &i.User.Permission[idx]
+		}
+	}
+
+	if wildcard != nil {
+		return containsString(wildcard.Actions, action)
+	}
+
+	if len(i.User.Machines) > 0 && !containsString(i.User.Machines, machine) {
+		return false
+	}
+
+	return containsString(roleActions[i.User.Role], action)
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func requestIdentity(req *restful.Request) *Identity {
+	if identity, ok := req.Attribute("identity").(*Identity); ok {
+		return identity
+	}
+	return unauthenticatedIdentity
+}
+
+// authorize checks that the caller may perform action on machine and writes a 403
+// response if not.
+func authorize(req *restful.Request, resp *restful.Response, action string, machine string) bool {
+	identity := requestIdentity(req)
+	if identity.Can(action, machine) {
+		return true
+	}
+
+	logWarn(LogFields{"user": identity.Name, "action": action, "machine": machine}, "permission denied")
+	writeError(403, ApiError{Code: errorForbidden, Message: fmt.Sprintf("User %s is not permitted to %s on %s", identity.Name, action, machine),
+		Details: map[string]interface{}{"action": action, "machine": machine}}, resp)
+	return false
+}
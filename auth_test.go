@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testAuthenticator returns an authenticator with the user "alice", whose
+// password is "secret", that locks out after 3 failed attempts.
+func testAuthenticator(t *testing.T) *Authenticator {
+	config := testConfig(t)
+	config.AuthLockoutAttempts = 3
+
+	hashed, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Authenticator{
+		Users:    map[string]*User{"alice": {Name: "alice", Password: hashed, Role: "viewer"}},
+		failures: make(map[string]*authFailures),
+	}
+}
+
+// basicLogin authenticates username and password from remote, it returns the
+// response status or 200 if authentication succeeded.
+func basicLogin(a *Authenticator, remote string, username string, password string) int {
+	httpRequest := httptest.NewRequest("GET", "/runs", nil)
+	httpRequest.RemoteAddr = remote + ":40000"
+	recorder := httptest.NewRecorder()
+
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	if identity := a.authenticateBasic(restful.NewRequest(httpRequest), restful.NewResponse(recorder), credentials); identity != nil {
+		return http.StatusOK
+	}
+	return recorder.Code
+}
+
+func TestAuthHostLockout(t *testing.T) {
+	a := testAuthenticator(t)
+
+	for i := 0; i < 3; i++ {
+		if status := basicLogin(a, "10.0.0.1", "alice", "wrong"); status != 401 {
+			t.Fatalf("failed attempt %d returned %d", i+1, status)
+		}
+	}
+
+	if status := basicLogin(a, "10.0.0.1", "alice", "secret"); status != 429 {
+		t.Errorf("correct password from a locked out host returned %d", status)
+	}
+	if status := basicLogin(a, "10.0.0.2", "alice", "secret"); status != 200 {
+		t.Errorf("correct password from another host returned %d, the user shouldn't be locked out", status)
+	}
+}
+
+func TestAuthUserLockout(t *testing.T) {
+	a := testAuthenticator(t)
+
+	attempts := 3 * authUserLockoutFactor
+	for i := 0; i < attempts; i++ {
+		if status := basicLogin(a, fmt.Sprintf("10.0.1.%d", i), "alice", "wrong"); status != 401 {
+			t.Fatalf("failed attempt %d returned %d", i+1, status)
+		}
+	}
+
+	if status := basicLogin(a, "10.0.2.1", "alice", "secret"); status != 429 {
+		t.Errorf("user wasn't locked out after %d failures from different hosts, got %d", attempts, status)
+	}
+}
+
+func TestAuthUnknownUsers(t *testing.T) {
+	a := testAuthenticator(t)
+
+	for i := 0; i < 50; i++ {
+		basicLogin(a, "10.0.0.1", fmt.Sprintf("guess%d", i), "wrong")
+	}
+
+	if len(a.failures) != 1 || a.failures["host:10.0.0.1"] == nil {
+		t.Errorf("failures are tracked for %d keys, expected only the host", len(a.failures))
+	}
+}
+
+func TestAuthFailuresExpire(t *testing.T) {
+	a := testAuthenticator(t)
+
+	window := time.Duration(globalConfig.AuthLockoutSeconds) * time.Second
+	longAgo := time.Now().Add(-2 * window)
+	a.failures["host:10.0.0.1"] = &authFailures{Count: 1, LastFailure: longAgo}
+	a.failures["host:10.0.0.2"] = &authFailures{Count: 3, LastFailure: longAgo, LockedUntil: longAgo.Add(window)}
+	a.failures["host:10.0.0.3"] = &authFailures{Count: 3, LastFailure: time.Now(), LockedUntil: time.Now().Add(window)}
+
+	if status := basicLogin(a, "10.0.0.4", "alice", "wrong"); status != 401 {
+		t.Fatalf("failed attempt returned %d", status)
+	}
+
+	for _, key := range []string{"host:10.0.0.1", "host:10.0.0.2"} {
+		if _, ok := a.failures[key]; ok {
+			t.Errorf("expired failures of %s weren't removed", key)
+		}
+	}
+	for _, key := range []string{"host:10.0.0.3", "host:10.0.0.4", "user:alice"} {
+		if _, ok := a.failures[key]; !ok {
+			t.Errorf("failures of %s were removed", key)
+		}
+	}
+
+	// An expired count starts over rather than adding to the old failures
+	a.failures["host:10.0.0.5"] = &authFailures{Count: 2, LastFailure: longAgo}
+	if status := basicLogin(a, "10.0.0.5", "alice", "wrong"); status != 401 || a.failures["host:10.0.0.5"].Count != 1 {
+		t.Errorf("failure after an expired window returned %d with count %d", status, a.failures["host:10.0.0.5"].Count)
+	}
+}
+
+func TestRequestIdentityUnauthenticated(t *testing.T) {
+	req := restful.NewRequest(httptest.NewRequest("GET", "/runs", nil))
+	identity := requestIdentity(req)
+	for _, action := range []string{actionList, actionStart, actionCancel, actionOverride, actionAdmin} {
+		if identity.Can(action, "machine") {
+			t.Errorf("request without identity may %s", action)
+		}
+	}
+}
+
+func TestRemoteHostTrustedProxies(t *testing.T) {
+	config := testConfig(t)
+	config.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16"}
+
+	tests := []struct {
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		{"10.0.0.2", []string{"203.0.113.1"}, "10.0.0.2"},
+		{"10.0.0.1", nil, "10.0.0.1"},
+		{"10.0.0.1", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"10.0.0.1", []string{"198.51.100.1, 203.0.113.1, 192.168.1.1"}, "203.0.113.1"},
+		{"10.0.0.1", []string{"198.51.100.1", "203.0.113.1"}, "203.0.113.1"},
+		{"10.0.0.1", []string{"192.168.1.1"}, "192.168.1.1"},
+		{"10.0.0.1", []string{"203.0.113.1, garbage, 192.168.1.1"}, "192.168.1.1"},
+	}
+
+	for _, test := range tests {
+		httpRequest := httptest.NewRequest("GET", "/runs", nil)
+		httpRequest.RemoteAddr = test.remote + ":40000"
+		httpRequest.Header["X-Forwarded-For"] = test.forwarded
+		if host := remoteHost(restful.NewRequest(httpRequest)); host != test.expected {
+			t.Errorf("request from %s forwarded for %v has remote host %s, expected %s", test.remote, test.forwarded, host, test.expected)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/emicklei/go-restful"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405Z"
+
+// apiBackup streams a consistent snapshot of the database while the scheduler
+// continues to write.
+func apiBackup(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	storage, ok := backupStorage(globalScheduler.Storage)
+	if !ok {
+		errorResponse(501, errorNotSupported, errBackupNotSupported.Error(), resp)
+		return
+	}
+
+	filename := "state-" + time.Now().UTC().Format(backupTimeFormat) + ".db"
+	resp.AddHeader("Content-Type", restful.MIME_OCTET)
+	resp.AddHeader("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	err := storage.Backup(resp)
+	if err != nil {
+		logError(LogFields{"error": err}, "error streaming database backup")
+	}
+}
+
+// writeBackup writes a snapshot of the database into dir, going through a
+// temporary file so that an interrupted backup never looks complete.
+func writeBackup(storage BackupStorage, dir string) (string, error) {
+	path := filepath.Join(dir, "state-"+time.Now().UTC().Format(backupTimeFormat)+".db")
+	tmpPath := filepath.Join(dir, "."+filepath.Base(path)+".tmp")
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("error creating backup: %s", err)
+	}
+
+	err = storage.Backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("error writing backup: %s", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("error renaming backup into place: %s", err)
+	}
+
+	return path, nil
+}
+
+// rotateBackups removes all but the newest keep backups in dir.
+func rotateBackups(dir string, keep int) error {
+	backups, err := filepath.Glob(filepath.Join(dir, "state-*.db"))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("error removing old backup: %s", err)
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+func runScheduledBackup(storage BackupStorage) {
+	path, err := writeBackup(storage, globalConfig.BackupPath)
+	if err != nil {
+		metricBackupFailures.Inc()
+		logError(LogFields{"directory": globalConfig.BackupPath, "error": err}, "scheduled database backup failed")
+		return
+	}
+
+	metricBackupLastSuccess.Set(float64(time.Now().Unix()))
+	logInfo(LogFields{"path": path}, "scheduled database backup written")
+
+	if err := rotateBackups(globalConfig.BackupPath, globalConfig.BackupKeep); err != nil {
+		logWarn(LogFields{"directory": globalConfig.BackupPath, "error": err}, "error rotating database backups")
+	}
+}
+
+// initBackups starts the scheduled backups if BackupPath is configured.
+func initBackups(storage Storage) {
+	backup, ok := backupStorage(storage)
+	if globalConfig.BackupPath == "" || !ok {
+		return
+	}
+
+	logInfo(LogFields{"directory": globalConfig.BackupPath, "interval": globalConfig.BackupIntervalSeconds,
+		"keep": globalConfig.BackupKeep}, "scheduled database backups enabled")
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(globalConfig.BackupIntervalSeconds) * time.Second)
+		for range ticker.C {
+			runScheduledBackup(backup)
+		}
+	}()
+}
+
+// dbRestore replaces the database with a backup. The daemon must be stopped,
+// which is enforced by holding the database lock. The current database is
+// kept next to it as <path>.before-restore-<time> so a restore can be undone.
+func dbRestore(db *bolt.DB, flagSet *flag.FlagSet) error {
+	if dbFlags.In == "" {
+		return fmt.Errorf("restore needs the backup file given with -in")
+	}
+
+	backup, err := openDatabaseOffline(dbFlags.In, true)
+	if err != nil {
+		return err
+	}
+
+	err = backup.View(func(tx *bolt.Tx) error {
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = fmt.Errorf("backup %s is corrupt: %s", dbFlags.In, err)
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+
+		for _, name := range []string{"RunningMachines", "MachineRuns"} {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("backup %s is not a restatemachine database, bucket %s is missing", dbFlags.In, name)
+			}
+		}
+
+		return nil
+	})
+	backup.Close()
+
+	if err != nil {
+		return err
+	}
+
+	savedPath := db.Path() + ".before-restore-" + time.Now().UTC().Format(backupTimeFormat)
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(savedPath, 0600)
+	})
+	if err != nil {
+		return fmt.Errorf("error saving current database: %s", err)
+	}
+
+	tmpPath := db.Path() + ".restore.tmp"
+	if err := copyFile(dbFlags.In, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, db.Path()); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error moving backup into place: %s", err)
+	}
+
+	fmt.Printf("restored %s from %s, the previous database was saved as %s\n", db.Path(), dbFlags.In, savedPath)
+	fmt.Printf("run \"restatemachine db verify\" and start the daemon again\n")
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %s", dst, err)
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying %s to %s: %s", src, dst, err)
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("error syncing %s: %s", dst, err)
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Payloads larger than BlobThresholdBytes, or that aren't valid UTF-8 and
+// would be mangled in JSON, are stored as blobs under BlobPath named by the
+// SHA-256 of their content. A run references its payload blob by hash in
+// InputBlob instead of carrying it in Input. With EncryptionKeyFile set new
+// blobs are encrypted with globalBlobKeys and named by the keyed hash from
+// KeyRing.BlobNameHash instead, equal payloads share a blob either way.
+
+const blobTmpPrefix = ".tmp-"
+
+const blobCleanupInterval = time.Hour
+
+var globalBlobKeys *KeyRing
+
+// blobLock keeps cleanupBlobs from removing a blob that commit found already
+// stored and is about to refresh.
+var blobLock sync.Mutex
+
+type PayloadTooLargeError struct {
+	Limit int64
+}
+
+func (e PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("payload exceeds the maximum size of %d bytes", e.Limit)
+}
+
+func blobPath(hash string) string {
+	return filepath.Join(globalConfig.BlobPath, hash[:2], hash)
+}
+
+// PayloadWriter collects a payload, keeping it in memory up to
+// BlobThresholdBytes and spilling it to a temporary file beyond that. Writes
+// that would take the payload over limit fail with PayloadTooLargeError. The
+// temporary file is encrypted as it is written if blobs are encrypted.
+type PayloadWriter struct {
+	limit  int64
+	size   int64
+	buffer bytes.Buffer
+	file   *os.File
+	sealer io.WriteCloser
+	out    io.Writer
+	hash   hash.Hash
+}
+
+func newPayloadWriter(limit int64) *PayloadWriter {
+	if globalBlobKeys != nil {
+		return &PayloadWriter{limit: limit, hash: globalBlobKeys.BlobNameHash()}
+	}
+	return &PayloadWriter{limit: limit, hash: sha256.New()}
+}
+
+func (w *PayloadWriter) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > w.limit {
+		return 0, PayloadTooLargeError{Limit: w.limit}
+	}
+
+	w.size += int64(len(p))
+	w.hash.Write(p)
+
+	if w.file == nil && w.buffer.Len()+len(p) <= globalConfig.BlobThresholdBytes {
+		return w.buffer.Write(p)
+	}
+
+	if err := w.spill(); err != nil {
+		return 0, err
+	}
+
+	return w.out.Write(p)
+}
+
+func (w *PayloadWriter) spill() error {
+	if w.file != nil {
+		return nil
+	}
+
+	file, err := ioutil.TempFile(globalConfig.BlobPath, blobTmpPrefix)
+	if err != nil {
+		return fmt.Errorf("error creating payload blob: %s", err)
+	}
+
+	w.file = file
+	w.out = file
+	if globalBlobKeys != nil {
+		if w.sealer, err = globalBlobKeys.NewBlobWriter(file); err != nil {
+			return fmt.Errorf("error encrypting payload blob: %s", err)
+		}
+		w.out = w.sealer
+	}
+
+	_, err = w.out.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+	return err
+}
+
+// Finish returns the payload as a string if it can be stored inline, or
+// stores it as a blob and returns its hash.
+func (w *PayloadWriter) Finish() (input string, blob string, err error) {
+	if w.file == nil && utf8.Valid(w.buffer.Bytes()) {
+		return w.buffer.String(), "", nil
+	}
+
+	if err := w.spill(); err != nil {
+		w.Discard()
+		return "", "", err
+	}
+
+	blob = hex.EncodeToString(w.hash.Sum(nil))
+	if err := w.commit(blob); err != nil {
+		w.Discard()
+		return "", "", fmt.Errorf("error storing payload blob: %s", err)
+	}
+
+	return "", blob, nil
+}
+
+func (w *PayloadWriter) commit(blob string) error {
+	tmpPath := w.file.Name()
+	var err error
+	if w.sealer != nil {
+		err = w.sealer.Close()
+		w.sealer = nil
+	}
+	if syncErr := w.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	path := blobPath(blob)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	// The same content is already stored, refresh it so that cleanup keeps it
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(tmpPath)
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Discard removes the temporary file of a payload that won't be stored.
+func (w *PayloadWriter) Discard() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		w.file = nil
+		w.sealer = nil
+	}
+}
+
+type blobFile struct {
+	io.Reader
+	io.Closer
+}
+
+// openBlob returns the payload stored in a blob and its size, decrypting it
+// if it is encrypted. Errors opening the blob are returned as they are.
+func openBlob(hash string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(blobPath(hash))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	if prefix, _ := reader.Peek(len(encryptedPrefix)); string(prefix) != encryptedPrefix {
+		return blobFile{reader, file}, info.Size(), nil
+	}
+
+	if globalBlobKeys == nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("blob is encrypted and EncryptionKeyFile isn't set")
+	}
+
+	payload, size, err := globalBlobKeys.NewBlobReader(reader, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return blobFile{payload, file}, size, nil
+}
+
+// openPayload returns the payload of run, the input of its next state.
+func openPayload(run *RunningMachine) (io.ReadCloser, error) {
+	if run.InputBlob == "" {
+		return ioutil.NopCloser(strings.NewReader(run.Input)), nil
+	}
+
+	payload, _, err := openBlob(run.InputBlob)
+	if err != nil {
+		return nil, fmt.Errorf("error opening payload blob %s: %s", run.InputBlob, err)
+	}
+
+	return payload, nil
+}
+
+// cleanupBlobs removes blobs that no active run references and that weren't
+// written for BlobRetentionDays. Temporary files left by a crash are removed
+// after the same time.
+func cleanupBlobs() {
+	active := make(map[string]bool)
+	for _, run := range *globalScheduler.GetRunningMachines() {
+		if run.InputBlob != "" {
+			active[run.InputBlob] = true
+		}
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -globalConfig.BlobRetentionDays)
+	err := filepath.Walk(globalConfig.BlobPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		if active[info.Name()] || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		removeExpiredBlob(path, cutoff)
+		return nil
+	})
+
+	if err != nil {
+		logWarn(LogFields{"path": globalConfig.BlobPath, "error": err}, "error listing payload blobs")
+	}
+}
+
+// removeExpiredBlob removes the blob at path unless it was written after
+// cutoff, which is checked again in case commit refreshed it meanwhile.
+func removeExpiredBlob(path string, cutoff time.Time) {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	if info, err := os.Stat(path); err != nil || info.ModTime().After(cutoff) {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		logWarn(LogFields{"path": path, "error": err}, "error removing payload blob")
+	} else {
+		logDebug(LogFields{"path": path}, "removed payload blob")
+	}
+}
+
+// rotateBlobKeys makes the blobs below path use the active key of keys, the
+// data keys of encrypted blobs are wrapped again and plaintext blobs are
+// encrypted. It returns the number of blobs it changed.
+func rotateBlobKeys(path string, keys *KeyRing) (int, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	rotated := 0
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), blobTmpPrefix) {
+			return err
+		}
+
+		changed, err := rotateBlobKey(path, info, keys)
+		if err != nil {
+			return fmt.Errorf("blob %s: %s", info.Name(), err)
+		}
+		if changed {
+			rotated++
+		}
+		return nil
+	})
+
+	return rotated, err
+}
+
+func rotateBlobKey(path string, info os.FileInfo, keys *KeyRing) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var write func(out io.Writer) error
+	if prefix, _ := reader.Peek(len(encryptedPrefix)); string(prefix) == encryptedPrefix {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return false, fmt.Errorf("malformed encrypted blob: %s", err)
+		}
+
+		rewrapped, changed, err := keys.Rewrap(strings.TrimSuffix(header, "\n"))
+		if err != nil || !changed {
+			return false, err
+		}
+
+		// Only the header changes, the chunks keep their data key
+		write = func(out io.Writer) error {
+			if _, err := io.WriteString(out, rewrapped+"\n"); err != nil {
+				return err
+			}
+			_, err := io.Copy(out, reader)
+			return err
+		}
+	} else {
+		write = func(out io.Writer) error {
+			sealer, err := keys.NewBlobWriter(out)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(sealer, reader); err != nil {
+				return err
+			}
+			return sealer.Close()
+		}
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), blobTmpPrefix)
+	if err != nil {
+		return false, err
+	}
+
+	err = write(tmpFile)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	// Keep the modification time that cleanupBlobs goes by
+	if err == nil {
+		err = os.Chtimes(tmpFile.Name(), info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return false, err
+	}
+
+	return true, nil
+}
+
+func initBlobs() error {
+	if err := os.MkdirAll(globalConfig.BlobPath, 0700); err != nil {
+		return err
+	}
+
+	globalBlobKeys = nil
+	if globalConfig.EncryptionKeyFile != "" {
+		keyRing, err := loadKeyRing(globalConfig.EncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+		globalBlobKeys = keyRing
+	}
+
+	go func() {
+		cleanupBlobs()
+		ticker := time.NewTicker(blobCleanupInterval)
+		for range ticker.C {
+			cleanupBlobs()
+		}
+	}()
+
+	return nil
+}
+
+// apiGetRunOutput returns the current payload of a run, which is the output of
+// its last executed state, as raw bytes. Secrets are redacted from blobs as
+// they are from inline payloads.
+func apiGetRunOutput(req *restful.Request, resp *restful.Response) {
+	id := req.PathParameter("id")
+	machine, err := globalScheduler.GetMachineRun(id)
+	if err != nil {
+		runError("Error retrieving information about state machine run", err, id, resp)
+		return
+	}
+
+	if !authorize(req, resp, actionList, machine.Name) {
+		return
+	}
+
+	if machine.InputBlob == "" {
+		output := []byte(redactSecrets(machine.Input))
+		resp.AddHeader("Content-Type", http.DetectContentType(output))
+		resp.Write(output)
+		return
+	}
+
+	payload, size, err := openBlob(machine.InputBlob)
+	if os.IsNotExist(err) {
+		errorResponse(410, errorOutputRemoved, "The output of the state machine run has been removed after BlobRetentionDays", resp)
+		return
+	} else if err != nil {
+		errorResponse(500, errorInternal, "Error opening output: "+err.Error(), resp)
+		return
+	}
+	defer payload.Close()
+
+	reader := bufio.NewReader(payload)
+	sniff, _ := reader.Peek(512)
+	resp.AddHeader("Content-Type", http.DetectContentType(sniff))
+
+	output, redacted := redactReader(reader)
+	if !redacted {
+		resp.AddHeader("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	if _, err := io.Copy(resp, output); err != nil {
+		logWarn(LogFields{"run": id, "error": err}, "error sending output")
+	}
+}
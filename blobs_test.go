@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKeyRing returns a key ring with random keys with the given ids, the
+// first one is the active key.
+func testKeyRing(t *testing.T, ids ...string) *KeyRing {
+	keyRing := &KeyRing{}
+	for _, id := range ids {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		keyRing.Keys = append(keyRing.Keys, EncryptionKey{Id: id, Key: key})
+	}
+	return keyRing
+}
+
+// testBlobKeys sets globalBlobKeys for the test.
+func testBlobKeys(t *testing.T, keyRing *KeyRing) {
+	previous := globalBlobKeys
+	globalBlobKeys = keyRing
+	t.Cleanup(func() { globalBlobKeys = previous })
+}
+
+// storeTestBlob stores payload as a blob, writing it in pieces of 1000 bytes.
+func storeTestBlob(t *testing.T, payload []byte) string {
+	writer := newPayloadWriter(int64(len(payload)) + 1)
+	for offset := 0; offset < len(payload); offset += 1000 {
+		end := offset + 1000
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if _, err := writer.Write(payload[offset:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, blob, err := writer.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob == "" {
+		t.Fatalf("payload of %d bytes wasn't stored as blob", len(payload))
+	}
+	return blob
+}
+
+func readTestBlob(t *testing.T, blob string) []byte {
+	payload, size, err := openBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer payload.Close()
+
+	content, err := ioutil.ReadAll(payload)
+	if err != nil {
+		t.Fatalf("error reading blob: %s", err)
+	}
+	if int64(len(content)) != size {
+		t.Errorf("blob of %d bytes has size %d", len(content), size)
+	}
+	return content
+}
+
+func blobKeyId(t *testing.T, blob string) string {
+	file, err := os.Open(blobPath(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	header, _ := bufio.NewReader(file).ReadString('\n')
+	if !isEncrypted(header) {
+		return ""
+	}
+
+	e, err := parseEnvelope(strings.TrimSuffix(header, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.KeyId
+}
+
+func TestEncryptedBlobs(t *testing.T) {
+	config := testConfig(t)
+	config.BlobThresholdBytes = 16
+	testBlobKeys(t, testKeyRing(t, "current"))
+
+	for _, size := range []int{17, blobChunkSize - 1, blobChunkSize, blobChunkSize + 1, 3*blobChunkSize + 5} {
+		payload := bytes.Repeat([]byte(fmt.Sprintf("payload of %d bytes ", size)), size)[:size]
+		blob := storeTestBlob(t, payload)
+
+		stored, err := ioutil.ReadFile(blobPath(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blobKeyId(t, blob) != "current" || bytes.Contains(stored, payload[:16]) {
+			t.Errorf("blob of %d bytes isn't encrypted", size)
+		}
+
+		if content := readTestBlob(t, blob); !bytes.Equal(content, payload) {
+			t.Errorf("blob of %d bytes decrypted to %d different bytes", size, len(content))
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(config.BlobPath, "*", blobTmpPrefix+"*"))
+	if tmpFiles, _ := filepath.Glob(filepath.Join(config.BlobPath, blobTmpPrefix+"*")); len(files)+len(tmpFiles) > 0 {
+		t.Errorf("temporary files were left behind: %v %v", files, tmpFiles)
+	}
+}
+
+func TestEncryptedBlobNames(t *testing.T) {
+	config := testConfig(t)
+	config.BlobThresholdBytes = 16
+	payload := []byte("a payload that is stored as blob")
+
+	testBlobKeys(t, nil)
+	plaintext := storeTestBlob(t, payload)
+	if sum := sha256.Sum256(payload); plaintext != hex.EncodeToString(sum[:]) {
+		t.Errorf("plaintext blob is named %s, expected the SHA-256 of its payload", plaintext)
+	}
+
+	keyRing := testKeyRing(t, "current")
+	testBlobKeys(t, keyRing)
+	encrypted := storeTestBlob(t, payload)
+	if encrypted == plaintext || storeTestBlob(t, payload) != encrypted {
+		t.Errorf("encrypted blobs of the same payload are named %s and %s", encrypted, storeTestBlob(t, payload))
+	}
+
+	testBlobKeys(t, testKeyRing(t, "other"))
+	if other := storeTestBlob(t, payload); other == encrypted {
+		t.Errorf("blobs encrypted with different keys have the same name %s", other)
+	}
+}
+
+func TestEncryptedBlobTampering(t *testing.T) {
+	config := testConfig(t)
+	config.BlobThresholdBytes = 16
+	testBlobKeys(t, testKeyRing(t, "current"))
+
+	payload := bytes.Repeat([]byte("x"), 2*blobChunkSize+100)
+	blob := storeTestBlob(t, payload)
+	stored, err := ioutil.ReadFile(blobPath(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the last chunk the blob ends with a chunk that isn't the last
+	header := bytes.IndexByte(stored, '\n') + 1
+	truncated := stored[:header+2*(blobChunkSize+blobChunkOverhead)]
+	flipped := append([]byte(nil), stored...)
+	flipped[len(flipped)-1] ^= 1
+
+	for name, content := range map[string][]byte{"truncated": truncated, "modified": flipped} {
+		if err := ioutil.WriteFile(blobPath(blob), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		payload, _, err := openBlob(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(payload); err == nil {
+			t.Errorf("%s blob was read without error", name)
+		}
+		payload.Close()
+	}
+
+	testBlobKeys(t, nil)
+	if _, _, err := openBlob(blob); err == nil {
+		t.Error("encrypted blob was opened without EncryptionKeyFile")
+	}
+}
+
+func TestRotateBlobKeys(t *testing.T) {
+	config := testConfig(t)
+	config.BlobThresholdBytes = 16
+
+	testBlobKeys(t, nil)
+	plaintext := storeTestBlob(t, []byte("stored before encryption was enabled"))
+
+	oldKeys := testKeyRing(t, "old")
+	testBlobKeys(t, oldKeys)
+	encrypted := storeTestBlob(t, bytes.Repeat([]byte("stored with the old key "), 10000))
+
+	modTime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	for _, blob := range []string{plaintext, encrypted} {
+		if err := os.Chtimes(blobPath(blob), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newKeys := testKeyRing(t, "new")
+	newKeys.Keys = append(newKeys.Keys, oldKeys.Keys...)
+	rotated, err := rotateBlobKeys(config.BlobPath, newKeys)
+	if err != nil || rotated != 2 {
+		t.Fatalf("rotated %d blobs with error %v, expected 2", rotated, err)
+	}
+
+	// The old key isn't needed anymore
+	testBlobKeys(t, &KeyRing{Keys: newKeys.Keys[:1]})
+	for _, blob := range []string{plaintext, encrypted} {
+		if keyId := blobKeyId(t, blob); keyId != "new" {
+			t.Errorf("blob uses key %q after rotation", keyId)
+		}
+		if info, err := os.Stat(blobPath(blob)); err != nil || !info.ModTime().Equal(modTime) {
+			t.Errorf("rotation changed the modification time of the blob")
+		}
+	}
+
+	if content := readTestBlob(t, plaintext); string(content) != "stored before encryption was enabled" {
+		t.Errorf("plaintext blob contains %q after rotation", content)
+	}
+	if content := readTestBlob(t, encrypted); !bytes.Equal(content, bytes.Repeat([]byte("stored with the old key "), 10000)) {
+		t.Errorf("encrypted blob changed by rotation")
+	}
+
+	if rotated, err := rotateBlobKeys(config.BlobPath, newKeys); err != nil || rotated != 0 {
+		t.Errorf("second rotation changed %d blobs with error %v", rotated, err)
+	}
+}
+
+func TestCleanupBlobs(t *testing.T) {
+	config := testConfig(t)
+	config.BlobThresholdBytes = 16
+	testBlobKeys(t, nil)
+
+	old := time.Now().AddDate(0, 0, -config.BlobRetentionDays-1)
+	var blobs []string
+	for _, payload := range []string{"expired blob that is removed", "expired blob that is stored again", "blob that was stored recently"} {
+		blob := storeTestBlob(t, []byte(payload))
+		if payload != "blob that was stored recently" {
+			if err := os.Chtimes(blobPath(blob), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		blobs = append(blobs, blob)
+	}
+
+	// Storing a payload again refreshes its blob so that it isn't removed
+	storeTestBlob(t, []byte("expired blob that is stored again"))
+	if globalScheduler.SchedulerLock == nil {
+		globalScheduler.SchedulerLock = &sync.Mutex{}
+	}
+	cleanupBlobs()
+
+	for idx, expected := range []bool{false, true, true} {
+		if _, err := os.Stat(blobPath(blobs[idx])); (err == nil) != expected {
+			t.Errorf("blob %d exists: %t, expected %t", idx, err == nil, expected)
+		}
+	}
+}
+
+// testSecrets sets globalSecrets to a store holding secrets for the test.
+func testSecrets(t *testing.T, secrets map[string]string) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &SecretStore{Path: filepath.Join(t.TempDir(), "secrets.json"), key: key}
+	if err := store.write(secrets); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := globalSecrets
+	globalSecrets = store
+	t.Cleanup(func() { globalSecrets = previous })
+}
+
+func TestRunOutputRedaction(t *testing.T) {
+	config := testConfig(t)
+	config.BlobThresholdBytes = 16
+	testBlobKeys(t, testKeyRing(t, "current"))
+	server := testApiServer(t)
+
+	previous := globalScheduler.Storage
+	globalScheduler.Storage = newMemoryStorage()
+	t.Cleanup(func() { globalScheduler.Storage = previous })
+
+	// The secret is split over the reads of the redacting reader
+	secret := "hunter2-secret"
+	blobOutput := strings.Repeat("a", 32*1024-5) + secret + strings.Repeat(" and "+secret, 1000)
+	runs := map[string]*RunningMachine{
+		"inline": {Name: "output-test", Input: "token " + secret},
+		"blob":   {Name: "output-test", InputBlob: storeTestBlob(t, []byte(blobOutput))},
+	}
+
+	get := func(run *RunningMachine) (string, string) {
+		resp, err := http.Get(fmt.Sprintf("%s/runs/%d/output", server.URL, run.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 200 {
+			t.Fatalf("GET output returned %s: %s", resp.Status, content)
+		}
+		return string(content), resp.Header.Get("Content-Length")
+	}
+
+	for _, run := range runs {
+		if _, err := globalScheduler.UpdatePersistedMachine(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if output, length := get(runs["blob"]); output != blobOutput || length != fmt.Sprint(len(blobOutput)) {
+		t.Errorf("blob output without secrets has %d bytes and Content-Length %s, expected %d", len(output), length, len(blobOutput))
+	}
+
+	testSecrets(t, map[string]string{"TOKEN": secret})
+	if output, _ := get(runs["inline"]); output != "token "+secretsRedacted {
+		t.Errorf("inline output is %q", output)
+	}
+	output, _ := get(runs["blob"])
+	if expected := strings.Replace(blobOutput, secret, secretsRedacted, -1); output != expected {
+		t.Errorf("blob output isn't redacted, %d bytes contain the secret %d times", len(output), strings.Count(output, secret))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A run started with a callbackUrl gets the finished run POSTed to that URL
+// as JSON, in the same form as GET /runs/{id} returns it.
+
+const callbackAttempts = 3
+
+var callbackClient = &http.Client{Timeout: 10 * time.Second}
+
+func notifyCallback(run *RunningMachine) {
+	if run.CallbackUrl == "" {
+		return
+	}
+
+	body, err := json.Marshal(newRunResponse(run))
+	if err != nil {
+		metricWebhookFailures.Inc(run.Name)
+		logFields := runLogFields(run)
+		logFields["error"] = err
+		logWarn(logFields, "error encoding run for callback")
+		return
+	}
+
+	logFields := runLogFields(run)
+	logFields["url"] = run.CallbackUrl
+	go func() {
+		var err error
+		for attempt := 1; attempt <= callbackAttempts; attempt++ {
+			if err = postCallback(run.CallbackUrl, body); err == nil {
+				logDebug(logFields, "delivered run callback")
+				return
+			}
+
+			if attempt < callbackAttempts {
+				time.Sleep(time.Duration(attempt*attempt) * time.Second)
+			}
+		}
+
+		metricWebhookFailures.Inc(run.Name)
+		logFields["error"] = err
+		logWarn(logFields, "error delivering run callback")
+	}()
+}
+
+func postCallback(url string, body []byte) error {
+	resp, err := callbackClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ClientConfig holds the settings the client subcommands use to reach a daemon.
+// They are read from ~/.restatemachine.conf (or RESTATEMACHINE_CLIENT_CONFIG),
+// then overridden by the environment and finally by flags.
+type ClientConfig struct {
+	Url                   string
+	Username              string
+	Password              string
+	Token                 string
+	CACertificateFile     string
+	ClientCertificateFile string
+	ClientKeyFile         string
+}
+
+type Client struct {
+	Config     ClientConfig
+	Output     string
+	HttpClient *http.Client
+}
+
+type clientCommand struct {
+	Usage string
+	Args  int
+	Run   func(client *Client, args []string) error
+}
+
+var clientCommands = map[string]clientCommand{
+	"machines": {"machines", 0, clientMachines},
+	"run":      {"run <machine> < input", 1, clientRun},
+	"runs":     {"runs", 0, clientRuns},
+	"status":   {"status <id>", 1, clientStatus},
+	"cancel":   {"cancel <id>", 1, clientCancel},
+	"history":  {"history <id>", 1, clientHistory},
+	"watch":    {"watch <id>", 1, clientWatch},
+}
+
+func commandClient(name string) func(args []string) int {
+	return func(args []string) int {
+		return runClientCommand(name, args)
+	}
+}
+
+func loadClientConfig() (ClientConfig, error) {
+	var config ClientConfig
+
+	path := os.Getenv("RESTATEMACHINE_CLIENT_CONFIG")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".restatemachine.conf")
+		}
+	}
+
+	if path != "" {
+		metaData, err := toml.DecodeFile(path, &config)
+		if err != nil && !os.IsNotExist(err) {
+			return config, fmt.Errorf("error reading client config file %s: %s", path, err)
+		} else if err == nil && len(metaData.Undecoded()) > 0 {
+			return config, fmt.Errorf("unknown key %s in client config file %s", metaData.Undecoded()[0], path)
+		}
+	}
+
+	envOverrides := map[string]*string{
+		"RESTATEMACHINE_URL":             &config.Url,
+		"RESTATEMACHINE_CLIENT_USERNAME": &config.Username,
+		"RESTATEMACHINE_CLIENT_PASSWORD": &config.Password,
+		"RESTATEMACHINE_CLIENT_TOKEN":    &config.Token,
+	}
+	for name, field := range envOverrides {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+
+	if config.Url == "" {
+		config.Url = "http://localhost:80"
+	}
+
+	return config, nil
+}
+
+func newHttpClient(config ClientConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.CACertificateFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertificateFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACertificateFile)
+		}
+	}
+
+	if config.ClientCertificateFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.ClientCertificateFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return &http.Client{
+		Timeout:   60 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+func runClientCommand(name string, args []string) int {
+	command := clientCommands[name]
+
+	config, err := loadClientConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	client := &Client{}
+	flagSet := flag.NewFlagSet("restatemachine "+name, flag.ContinueOnError)
+	flagSet.StringVar(&config.Url, "url", config.Url, "daemon URL (env RESTATEMACHINE_URL)")
+	flagSet.StringVar(&config.Token, "token", config.Token, "API token (env RESTATEMACHINE_CLIENT_TOKEN)")
+	flagSet.StringVar(&config.Username, "user", config.Username, "username (env RESTATEMACHINE_CLIENT_USERNAME, password from RESTATEMACHINE_CLIENT_PASSWORD)")
+	flagSet.StringVar(&config.CACertificateFile, "cacert", config.CACertificateFile, "CA certificate to verify the daemon with")
+	flagSet.StringVar(&client.Output, "o", "table", "output format, table or json")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: restatemachine %s [flags]\n\nflags:\n", command.Usage)
+		flagSet.PrintDefaults()
+	}
+
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+
+	if flagSet.NArg() != command.Args || (client.Output != "table" && client.Output != "json") {
+		flagSet.Usage()
+		return 2
+	}
+
+	client.Config = config
+	client.HttpClient, err = newHttpClient(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	if err := command.Run(client, flagSet.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// Do performs a request to the /v1 API and decodes the JSON response into
+// result, unless result is nil.
+func (c *Client) Do(method string, path string, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimRight(c.Config.Url, "/")+apiVersionPath+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if c.Config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Config.Token)
+	} else if c.Config.Username != "" {
+		req.SetBasicAuth(c.Config.Username, c.Config.Password)
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %s", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		var serviceError struct{ Message string }
+		if json.Unmarshal(responseBody, &serviceError) == nil && serviceError.Message != "" {
+			return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, serviceError.Message)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(responseBody, result); err != nil {
+		return fmt.Errorf("error decoding response: %s", err)
+	}
+
+	return nil
+}
+
+func (c *Client) Print(value interface{}, table func(w io.Writer)) error {
+	if c.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func formatClientTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func firstLine(text string) string {
+	return strings.SplitN(strings.TrimSpace(text), "\n", 2)[0]
+}
+
+func clientMachines(c *Client, args []string) error {
+	var machines []StateMachine
+	if err := c.Do("GET", "/machines", "", nil, &machines); err != nil {
+		return err
+	}
+
+	return c.Print(machines, func(w io.Writer) {
+		fmt.Fprintf(w, "NAME\tSTATES\tUSAGE\n")
+		for _, machine := range machines {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", machine.Name, strings.Join(machine.States, ","), firstLine(machine.Usage))
+		}
+	})
+}
+
+func clientRun(c *Client, args []string) error {
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("error reading input from stdin: %s", err)
+	}
+
+	var response ExecuteResponse
+	if err := c.Do("POST", "/runs/"+args[0], "application/octet-stream", bytes.NewReader(input), &response); err != nil {
+		return err
+	}
+
+	return c.Print(response, func(w io.Writer) {
+		fmt.Fprintf(w, "%d\n", response.Id)
+	})
+}
+
+func clientRuns(c *Client, args []string) error {
+	var runs []RunResponse
+	if err := c.Do("GET", "/runs", "", nil, &runs); err != nil {
+		return err
+	}
+
+	return c.Print(runs, func(w io.Writer) {
+		fmt.Fprintf(w, "ID\tMACHINE\tNEXT STATE\tNEXT RUN\tSTARTED BY\tSTATUS\n")
+		for _, run := range runs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", run.Id, run.Name, run.NextState, formatClientTime(run.NextStateRun),
+				run.StartedBy, firstLine(run.StatusMessage))
+		}
+	})
+}
+
+func (c *Client) getRun(id string) (*RunResponse, error) {
+	var run RunResponse
+	if err := c.Do("GET", "/runs/"+id, "", nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func printRunStatus(w io.Writer, run *RunResponse) {
+	fmt.Fprintf(w, "Id:\t%d\n", run.Id)
+	fmt.Fprintf(w, "Machine:\t%s\n", run.Name)
+	fmt.Fprintf(w, "Last state:\t%s\n", run.LastState)
+	fmt.Fprintf(w, "Next state:\t%s\n", run.NextState)
+	fmt.Fprintf(w, "Next run:\t%s\n", formatClientTime(run.NextStateRun))
+	fmt.Fprintf(w, "Executing:\t%t\n", run.RunningStateCode)
+	fmt.Fprintf(w, "Started by:\t%s\n", run.StartedBy)
+	if run.CancelledBy != "" {
+		fmt.Fprintf(w, "Cancelled by:\t%s\n", run.CancelledBy)
+	}
+	labels := make([]string, 0, len(run.Labels))
+	for name := range run.Labels {
+		labels = append(labels, name)
+	}
+	sort.Strings(labels)
+	for _, name := range labels {
+		fmt.Fprintf(w, "Label %s:\t%s\n", name, run.Labels[name])
+	}
+	fmt.Fprintf(w, "Status:\t%s\n", run.StatusMessage)
+}
+
+func clientStatus(c *Client, args []string) error {
+	run, err := c.getRun(args[0])
+	if err != nil {
+		return err
+	}
+
+	return c.Print(run, func(w io.Writer) {
+		printRunStatus(w, run)
+	})
+}
+
+func clientCancel(c *Client, args []string) error {
+	var response struct{ Message string }
+	if err := c.Do("DELETE", "/runs/"+args[0], "", nil, &response); err != nil {
+		return err
+	}
+
+	return c.Print(response, func(w io.Writer) {
+		fmt.Fprintf(w, "%s\n", response.Message)
+	})
+}
+
+func printHistoryEntry(w io.Writer, entry HistoryEntry) {
+	result := "ok"
+	if !entry.Success {
+		result = "failed"
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%.2fs\t%s\t%s\n", formatClientTime(entry.Time), entry.State, entry.NextState, entry.Duration,
+		result, firstLine(entry.StatusMessage))
+}
+
+func clientHistory(c *Client, args []string) error {
+	var history []HistoryEntry
+	if err := c.Do("GET", "/runs/"+args[0]+"/history", "", nil, &history); err != nil {
+		return err
+	}
+
+	return c.Print(history, func(w io.Writer) {
+		fmt.Fprintf(w, "TIME\tSTATE\tNEXT STATE\tDURATION\tRESULT\tSTATUS\n")
+		for _, entry := range history {
+			printHistoryEntry(w, entry)
+		}
+	})
+}
+
+// clientWatch polls a run and prints each new history entry until the run stops.
+func clientWatch(c *Client, args []string) error {
+	seen := 0
+	for {
+		var history []HistoryEntry
+		if err := c.Do("GET", "/runs/"+args[0]+"/history", "", nil, &history); err != nil {
+			return err
+		}
+
+		run, err := c.getRun(args[0])
+		if err != nil {
+			return err
+		}
+
+		// The history is shorter than at the last poll if the run was
+		// restored or imported meanwhile
+		if seen > len(history) {
+			seen = len(history)
+		}
+
+		for _, entry := range history[seen:] {
+			if c.Output == "json" {
+				json.NewEncoder(os.Stdout).Encode(entry)
+			} else {
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				printHistoryEntry(w, entry)
+				w.Flush()
+			}
+		}
+		seen = len(history)
+
+		if run.NextState == "stop" {
+			return nil
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type Config struct {
+	Username            string
+	Password            string
+	ListenOn            string
+	TLSCertificateFile  string
+	TLSKeyFile          string
+	StateMachinePath    string
+	DatabasePath        string
+	StuckRunSeconds     int
+	LogLevel            string
+	LogFormat           string
+	LogDestination      string
+	UsersFile           string
+	AuthLockoutAttempts int
+	AuthLockoutSeconds  int
+	TrustedProxies      []string
+	AuditLogFile        string
+	StorageBackend      string
+	StorageDriver       string
+	StorageDSN          string
+	EncryptionKeyFile   string
+
+	ShutdownGraceSeconds int
+
+	WorkspacePath          string
+	WorkspaceRetentionDays int
+
+	SecretsFile    string
+	SecretsKeyFile string
+
+	BlobPath           string
+	BlobThresholdBytes int
+	BlobRetentionDays  int
+	MaxInputBytes      int
+	MaxOutputBytes     int
+
+	BackupPath            string
+	BackupIntervalSeconds int
+	BackupKeep            int
+
+	TLSClientCAFile              string
+	TLSClientCertificateRequired bool
+	ClientCertificate            []ClientCertificateMapping
+
+	Machine []MachineConfig
+}
+
+const defaultConfigPath = "/etc/restatemachine/restatemachine.conf"
+const configEnvPrefix = "RESTATEMACHINE_"
+
+var globalConfig Config
+
+// ConfigFlags holds the command line flags that override the configuration.
+type ConfigFlags struct {
+	ConfigFile       string
+	ListenOn         string
+	DatabasePath     string
+	StateMachinePath string
+	Version          bool
+}
+
+func newConfigFlagSet(name string, flags *ConfigFlags) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	flagSet.StringVar(&flags.ConfigFile, "config", "", "path to the config file (env "+configEnvPrefix+"CONFIG, default "+defaultConfigPath+")")
+	flagSet.StringVar(&flags.ListenOn, "listen", "", "address to listen on, overrides ListenOn")
+	flagSet.StringVar(&flags.DatabasePath, "database", "", "path to the database file, overrides DatabasePath")
+	flagSet.StringVar(&flags.StateMachinePath, "machines", "", "path to the state machine directory, overrides StateMachinePath")
+	flagSet.BoolVar(&flags.Version, "version", false, "print the version and exit")
+	return flagSet
+}
+
+// configEnvName maps a Config field name to its environment variable, e.g.
+// TLSCertificateFile to RESTATEMACHINE_TLS_CERTIFICATE_FILE.
+func configEnvName(field string) string {
+	runes := []rune(field)
+	var name []rune
+	for idx, r := range runes {
+		if idx > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[idx-1]) || (idx+1 < len(runes) && unicode.IsLower(runes[idx+1]))) {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+
+	return configEnvPrefix + string(name)
+}
+
+func configFilePath(flags *ConfigFlags) string {
+	if flags.ConfigFile != "" {
+		return flags.ConfigFile
+	}
+
+	if env := os.Getenv(configEnvPrefix + "CONFIG"); env != "" {
+		return env
+	}
+
+	return defaultConfigPath
+}
+
+func applyConfigEnv(config *Config) error {
+	value := reflect.ValueOf(config).Elem()
+	configType := value.Type()
+
+	for idx := 0; idx < configType.NumField(); idx++ {
+		field := configType.Field(idx)
+		envName := configEnvName(field.Name)
+		envValue, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			value.Field(idx).SetString(envValue)
+		case reflect.Int:
+			intValue, err := strconv.Atoi(envValue)
+			if err != nil {
+				return fmt.Errorf("invalid integer in %s: %s", envName, err)
+			}
+			value.Field(idx).SetInt(int64(intValue))
+		case reflect.Bool:
+			boolValue, err := strconv.ParseBool(envValue)
+			if err != nil {
+				return fmt.Errorf("invalid boolean in %s: %s", envName, err)
+			}
+			value.Field(idx).SetBool(boolValue)
+		}
+	}
+
+	return nil
+}
+
+func applyConfigFlags(config *Config, flags *ConfigFlags) {
+	if flags.ListenOn != "" {
+		config.ListenOn = flags.ListenOn
+	}
+
+	if flags.DatabasePath != "" {
+		config.DatabasePath = flags.DatabasePath
+	}
+
+	if flags.StateMachinePath != "" {
+		config.StateMachinePath = flags.StateMachinePath
+	}
+}
+
+func applyConfigDefaults(config *Config) {
+	if config.ListenOn == "" {
+		config.ListenOn = ":80"
+	}
+
+	if config.StateMachinePath == "" {
+		config.StateMachinePath = "/etc/restatemachine/statemachines"
+	}
+
+	if config.StorageBackend == "" {
+		config.StorageBackend = "bolt"
+	}
+
+	if config.DatabasePath == "" {
+		config.DatabasePath = "/etc/restatemachine/state.db"
+	}
+
+	if config.StuckRunSeconds <= 0 {
+		config.StuckRunSeconds = 3600
+	}
+
+	if config.AuthLockoutAttempts <= 0 {
+		config.AuthLockoutAttempts = 5
+	}
+
+	if config.AuthLockoutSeconds <= 0 {
+		config.AuthLockoutSeconds = 300
+	}
+
+	if config.ShutdownGraceSeconds <= 0 {
+		config.ShutdownGraceSeconds = 30
+	}
+
+	if config.WorkspacePath == "" {
+		config.WorkspacePath = "/var/lib/restatemachine/workspaces"
+	}
+
+	if config.BlobPath == "" {
+		config.BlobPath = "/var/lib/restatemachine/blobs"
+	}
+
+	if config.BlobThresholdBytes <= 0 {
+		config.BlobThresholdBytes = 65536
+	}
+
+	if config.BlobRetentionDays <= 0 {
+		config.BlobRetentionDays = 7
+	}
+
+	if config.MaxInputBytes <= 0 {
+		config.MaxInputBytes = 64 * 1024 * 1024
+	}
+
+	if config.MaxOutputBytes <= 0 {
+		config.MaxOutputBytes = 64 * 1024 * 1024
+	}
+
+	if config.BackupIntervalSeconds <= 0 {
+		config.BackupIntervalSeconds = 86400
+	}
+
+	if config.BackupKeep <= 0 {
+		config.BackupKeep = 7
+	}
+}
+
+// ConfigErrors collects all problems found in a configuration so that they
+// can be reported at once.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// loadConfig builds the configuration with the precedence flags, environment,
+// config file and finally defaults. A missing config file at the default path
+// is not an error, but a config file that can't be parsed or contains unknown
+// keys is.
+func loadConfig(flags *ConfigFlags) (Config, error) {
+	var config Config
+
+	path := configFilePath(flags)
+	metaData, err := toml.DecodeFile(path, &config)
+	if err != nil {
+		if !os.IsNotExist(err) || path != defaultConfigPath {
+			return config, fmt.Errorf("error reading config file %s: %s", path, err)
+		}
+
+		// without config file, we use defaults
+		config = Config{}
+	} else if undecoded := metaData.Undecoded(); len(undecoded) > 0 {
+		var errors ConfigErrors
+		for _, key := range undecoded {
+			errors = append(errors, fmt.Sprintf("unknown key %s in config file %s", key, path))
+		}
+		return config, errors
+	}
+
+	if err := applyConfigEnv(&config); err != nil {
+		return config, err
+	}
+
+	applyConfigFlags(&config, flags)
+	applyConfigDefaults(&config)
+
+	if err := validateConfig(&config); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+func validateConfig(config *Config) error {
+	var errors ConfigErrors
+
+	if info, err := os.Stat(config.StateMachinePath); err != nil {
+		errors = append(errors, fmt.Sprintf("StateMachinePath: %s", err))
+	} else if !info.IsDir() {
+		errors = append(errors, fmt.Sprintf("StateMachinePath: %s is not a directory", config.StateMachinePath))
+	}
+
+	errors = append(errors, validateStorageConfig(config)...)
+
+	if info, err := os.Stat(config.DatabasePath); err == nil && info.IsDir() {
+		errors = append(errors, fmt.Sprintf("DatabasePath: %s is a directory", config.DatabasePath))
+	} else if info, err := os.Stat(filepath.Dir(config.DatabasePath)); err != nil {
+		errors = append(errors, fmt.Sprintf("DatabasePath: parent directory: %s", err))
+	} else if !info.IsDir() {
+		errors = append(errors, fmt.Sprintf("DatabasePath: %s is not a directory", filepath.Dir(config.DatabasePath)))
+	}
+
+	if info, err := os.Stat(config.WorkspacePath); err == nil && !info.IsDir() {
+		errors = append(errors, fmt.Sprintf("WorkspacePath: %s is not a directory", config.WorkspacePath))
+	}
+
+	if info, err := os.Stat(config.BlobPath); err == nil && !info.IsDir() {
+		errors = append(errors, fmt.Sprintf("BlobPath: %s is not a directory", config.BlobPath))
+	}
+
+	if config.WorkspaceRetentionDays < 0 {
+		errors = append(errors, "WorkspaceRetentionDays must not be negative")
+	}
+
+	if config.BackupPath != "" {
+		if info, err := os.Stat(config.BackupPath); err != nil {
+			errors = append(errors, fmt.Sprintf("BackupPath: %s", err))
+		} else if !info.IsDir() {
+			errors = append(errors, fmt.Sprintf("BackupPath: %s is not a directory", config.BackupPath))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(config.ListenOn); err != nil {
+		errors = append(errors, fmt.Sprintf("ListenOn: %s", err))
+	}
+
+	if (config.TLSCertificateFile == "") != (config.TLSKeyFile == "") {
+		errors = append(errors, "TLSCertificateFile and TLSKeyFile must be set together")
+	} else if config.TLSCertificateFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.TLSCertificateFile, config.TLSKeyFile); err != nil {
+			errors = append(errors, fmt.Sprintf("TLSCertificateFile/TLSKeyFile: %s", err))
+		}
+	}
+
+	errors = append(errors, validateTLSConfig(config)...)
+	errors = append(errors, validateMachineConfig(config)...)
+	errors = append(errors, validateSecretsConfig(config)...)
+
+	if (config.Username == "") != (config.Password == "") {
+		errors = append(errors, "Username and Password must be set together, setting only one would disable authentication")
+	} else if strings.Contains(config.Username, ":") {
+		errors = append(errors, "Username must not contain ':'")
+	}
+
+	for _, proxy := range config.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			errors = append(errors, fmt.Sprintf("TrustedProxies: %s", err))
+		}
+	}
+
+	if config.UsersFile != "" {
+		if _, err := loadUsersFile(config.UsersFile); err != nil {
+			errors = append(errors, fmt.Sprintf("UsersFile: %s", err))
+		}
+	}
+
+	if config.LogLevel != "" {
+		if _, err := parseLogLevel(config.LogLevel); err != nil {
+			errors = append(errors, fmt.Sprintf("LogLevel: %s", err))
+		}
+	}
+
+	if config.LogFormat != "" && config.LogFormat != "logfmt" && config.LogFormat != "json" {
+		errors = append(errors, fmt.Sprintf("LogFormat: unknown log format %s, expected logfmt or json", config.LogFormat))
+	}
+
+	if len(errors) > 0 {
+		return errors
+	}
+
+	return nil
+}
+
+// commandConfig implements "restatemachine config check", which validates the
+// configuration the daemon would run with and prints the effective settings.
+func commandConfig(args []string) int {
+	if len(args) < 1 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "usage: restatemachine config check [flags]\n")
+		return 2
+	}
+
+	var flags ConfigFlags
+	flagSet := newConfigFlagSet("restatemachine config check", &flags)
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	config, err := loadConfig(&flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	if config.Password != "" {
+		config.Password = "********"
+	}
+
+	fmt.Printf("# configuration from %s is valid, effective settings:\n", configFilePath(&flags))
+	if err := toml.NewEncoder(os.Stdout).Encode(config); err != nil {
+		fmt.Fprintf(os.Stderr, "error encoding configuration: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func configUsage(flagSet *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "usage: restatemachine [flags]\n       restatemachine config check [flags]\n       restatemachine passwd\n")
+	fmt.Fprintf(os.Stderr, "       restatemachine secrets genkey|list|set|delete [flags]\n")
+	fmt.Fprintf(os.Stderr, "       restatemachine db runs|dump|export|import|verify|compact|restore [flags]\n")
+	fmt.Fprintf(os.Stderr, "       restatemachine machines|runs [-url url] [-o table|json]\n")
+	fmt.Fprintf(os.Stderr, "       restatemachine run <machine> < input\n")
+	fmt.Fprintf(os.Stderr, "       restatemachine status|cancel|history|watch <id>\n\nflags:\n")
+	flagSet.PrintDefaults()
+
+	var envNames []string
+	configType := reflect.TypeOf(Config{})
+	for idx := 0; idx < configType.NumField(); idx++ {
+		envNames = append(envNames, configEnvName(configType.Field(idx).Name))
+	}
+
+	fmt.Fprintf(os.Stderr, "\nevery config file setting can be overridden with an environment variable:\n  %s\n",
+		strings.Join(envNames, "\n  "))
+	fmt.Fprintf(os.Stderr, "\nprecedence is flags, then environment, then config file, then defaults\n")
+}
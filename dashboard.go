@@ -0,0 +1,44 @@
+package main
+
+import (
+	"embed"
+	"github.com/emicklei/go-restful"
+	"io/fs"
+	"mime"
+	"path"
+)
+
+// The dashboard is a static page in web/ that uses the /v1 API. It is embedded
+// so that the packages ship a single binary.
+
+//go:embed web
+var dashboardFiles embed.FS
+
+const dashboardPath = "/ui"
+
+func addDashboardRoutes(ws *restful.WebService) {
+	ws.Route(ws.GET(dashboardPath).Filter(authenticate).Produces("*/*").To(apiDashboard).
+		Doc("Web dashboard"))
+	ws.Route(ws.GET(dashboardPath + "/{path:*}").Filter(authenticate).Produces("*/*").To(apiDashboard).
+		Doc("Static files of the web dashboard").
+		Param(ws.PathParameter("path", "Path of the file")))
+}
+
+func apiDashboard(req *restful.Request, resp *restful.Response) {
+	name := path.Clean("/" + req.PathParameter("path"))
+	if name == "/" {
+		name = "/index.html"
+	}
+
+	content, err := fs.ReadFile(dashboardFiles, "web"+name)
+	if err != nil {
+		errorResponse(404, errorFileNotFound, "File not found", resp)
+		return
+	}
+
+	resp.AddHeader("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	resp.AddHeader("Cache-Control", "no-cache")
+	resp.AddHeader("Content-Security-Policy", "default-src 'self'")
+	resp.AddHeader("X-Frame-Options", "DENY")
+	resp.Write(content)
+}
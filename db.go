@@ -0,0 +1,630 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DatabaseRecord is one line of a database export. A record without a key
+// only marks that its bucket exists, keys that are not printable text are
+// stored hex encoded in KeyHex and values that are not JSON are stored base64
+// encoded in RawValue.
+type DatabaseRecord struct {
+	Bucket   []string
+	Key      string          `json:",omitempty"`
+	KeyHex   string          `json:",omitempty"`
+	Value    json.RawMessage `json:",omitempty"`
+	RawValue []byte          `json:",omitempty"`
+}
+
+// dbCommand describes a db subcommand. File is the flag it takes a file
+// with, "in", "out" or empty if it doesn't take one.
+type dbCommand struct {
+	Usage string
+	Args  int
+	Write bool
+	File  string
+	Run   func(db *bolt.DB, flagSet *flag.FlagSet) error
+}
+
+var dbCommands = map[string]dbCommand{
+	"runs":    {"runs [-running] [-o table|json]", 0, false, "", dbRuns},
+	"dump":    {"dump [flags] <id>", 1, false, "", dbDump},
+	"export":  {"export [-out file]", 0, false, "out", dbExport},
+	"import":  {"import [-in file]", 0, true, "in", dbImport},
+	"verify":  {"verify", 0, false, "", dbVerify},
+	"compact": {"compact -out file", 0, false, "out", dbCompact},
+	"restore": {"restore -in backup", 0, true, "in", dbRestore},
+
+	"rotate-keys": {"rotate-keys [-keys file] [-blobs path]", 0, true, "", dbRotateKeys},
+}
+
+var dbFlags struct {
+	Running bool
+	Output  string
+	In      string
+	Out     string
+	Blobs   string
+	Keys    *KeyRing
+}
+
+func dbUsage() {
+	var usages []string
+	for _, command := range dbCommands {
+		usages = append(usages, command.Usage)
+	}
+	sort.Strings(usages)
+	fmt.Fprintf(os.Stderr, "usage: restatemachine db <command> [-database path] [-config path] [flags]\n\ncommands:\n  %s\n", strings.Join(usages, "\n  "))
+	fmt.Fprintf(os.Stderr, "\nthe daemon must be stopped while using the db commands\n")
+}
+
+// commandDb implements the offline database tools below "restatemachine db".
+func commandDb(args []string) int {
+	if len(args) < 1 {
+		dbUsage()
+		return 2
+	}
+
+	command, ok := dbCommands[args[0]]
+	if !ok {
+		dbUsage()
+		return 2
+	}
+
+	var flags ConfigFlags
+	flagSet := flag.NewFlagSet("restatemachine db "+args[0], flag.ContinueOnError)
+	flagSet.StringVar(&flags.ConfigFile, "config", "", "path to the config file to read DatabasePath from")
+	flagSet.StringVar(&flags.DatabasePath, "database", "", "path to the database file, overrides DatabasePath")
+	flagSet.BoolVar(&dbFlags.Running, "running", false, "only list runs that are still active")
+	flagSet.StringVar(&dbFlags.Output, "o", "table", "output format, table or json")
+	switch command.File {
+	case "out":
+		flagSet.StringVar(&dbFlags.Out, "out", "", "file to write to")
+	case "in":
+		flagSet.StringVar(&dbFlags.In, "in", "", "file to read from")
+	}
+	if args[0] == "rotate-keys" {
+		flagSet.StringVar(&dbFlags.Blobs, "blobs", "", "payload blob directory, overrides BlobPath")
+	}
+	keysPath := flagSet.String("keys", "", "encryption key file to decrypt runs with, overrides EncryptionKeyFile")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: restatemachine db %s [flags]\n\nflags:\n", command.Usage)
+		flagSet.PrintDefaults()
+	}
+
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if flagSet.NArg() != command.Args {
+		flagSet.Usage()
+		return 2
+	}
+
+	path := flags.DatabasePath
+	if path == "" {
+		config, err := loadConfig(&flags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		// The db commands work on the bolt file, runs stored in SQL are
+		// maintained with the tools of the database
+		if config.StorageBackend != "bolt" {
+			fmt.Fprintf(os.Stderr, "the db commands only support the bolt storage backend, StorageBackend is %s\n", config.StorageBackend)
+			return 1
+		}
+		path = config.DatabasePath
+		if *keysPath == "" {
+			*keysPath = config.EncryptionKeyFile
+		}
+		if dbFlags.Blobs == "" {
+			dbFlags.Blobs = config.BlobPath
+		}
+	}
+
+	if *keysPath != "" {
+		keyRing, err := loadKeyRing(*keysPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		dbFlags.Keys = keyRing
+	}
+
+	db, err := openDatabaseOffline(path, !command.Write)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if err := command.Run(db, flagSet); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func openDatabaseOffline(path string, readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("error opening database: %s", err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s is locked, stop the daemon before using the db commands", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("error opening database %s: %s", path, err)
+	}
+
+	return db, nil
+}
+
+func dbRuns(db *bolt.DB, flagSet *flag.FlagSet) error {
+	runs := make([]RunningMachine, 0)
+	running := make(map[uint64]bool)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		runningBucket := tx.Bucket([]byte("RunningMachines"))
+		runsBucket := tx.Bucket([]byte("MachineRuns"))
+		if runningBucket == nil || runsBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		return runsBucket.ForEach(func(k, v []byte) error {
+			var machine RunningMachine
+			if err := json.Unmarshal(v, &machine); err != nil {
+				return fmt.Errorf("error deserializing machine run %s: %s", k, err)
+			}
+
+			if dbFlags.Keys != nil {
+				storage := &EncryptedStorage{Keys: dbFlags.Keys}
+				if err := storage.decryptRun(&machine); err != nil {
+					return err
+				}
+			}
+
+			running[machine.Id] = runningBucket.Get(k) != nil
+			if !dbFlags.Running || running[machine.Id] {
+				runs = append(runs, machine)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Id < runs[j].Id })
+
+	if dbFlags.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(runs)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tMACHINE\tRUNNING\tNEXT STATE\tNEXT RUN\tSTARTED BY\tSTATUS\n")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%s\t%s\t%s\n", run.Id, run.Name, running[run.Id], run.NextState,
+			formatClientTime(run.NextStateRun), run.StartedBy, firstLine(run.StatusMessage))
+	}
+	return w.Flush()
+}
+
+func dbDump(db *bolt.DB, flagSet *flag.FlagSet) error {
+	var storage Storage = &BoltStorage{DB: db}
+	if dbFlags.Keys != nil {
+		storage = &EncryptedStorage{Storage: storage, Keys: dbFlags.Keys}
+	}
+	scheduler := &Scheduler{Storage: storage}
+	id := flagSet.Arg(0)
+
+	run, err := scheduler.GetMachineRun(id)
+	if err != nil {
+		return err
+	}
+
+	history, err := scheduler.GetMachineRunHistory(id)
+	if err != nil {
+		return err
+	}
+
+	var running bool
+	db.View(func(tx *bolt.Tx) error {
+		if runningBucket := tx.Bucket([]byte("RunningMachines")); runningBucket != nil {
+			running = runningBucket.Get([]byte(id)) != nil
+		}
+		return nil
+	})
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Run     *RunningMachine
+		Running bool
+		History []HistoryEntry
+	}{run, running, history})
+}
+
+// walkBucket calls fn for the bucket itself and then for every key, descending
+// into nested buckets.
+func walkBucket(b *bolt.Bucket, path []string, fn func(path []string, k, v []byte) error) error {
+	if err := fn(path, nil, nil); err != nil {
+		return err
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			if nested := b.Bucket(k); nested != nil {
+				return walkBucket(nested, append(append([]string{}, path...), string(k)), fn)
+			}
+		}
+		return fn(path, k, v)
+	})
+}
+
+func walkDatabase(tx *bolt.Tx, fn func(path []string, k, v []byte) error) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return walkBucket(b, []string{string(name)}, fn)
+	})
+}
+
+func isPrintableKey(k []byte) bool {
+	if !utf8.Valid(k) {
+		return false
+	}
+
+	for _, r := range string(k) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newDatabaseRecord(path []string, k, v []byte) DatabaseRecord {
+	record := DatabaseRecord{Bucket: path}
+	if k == nil {
+		return record
+	}
+
+	if isPrintableKey(k) {
+		record.Key = string(k)
+	} else {
+		record.KeyHex = hex.EncodeToString(k)
+	}
+
+	if len(v) > 0 && json.Valid(v) {
+		record.Value = json.RawMessage(v)
+	} else if len(v) > 0 {
+		record.RawValue = v
+	}
+
+	return record
+}
+
+// sequenceTracker remembers the highest id used in buckets that hand out ids
+// with NextSequence, so that a restored database doesn't reuse them.
+type sequenceTracker map[string]uint64
+
+func (s sequenceTracker) Track(path []string, k []byte) {
+	var id uint64
+	switch {
+	case len(path) == 1 && path[0] == "MachineRuns":
+		id, _ = strconv.ParseUint(string(k), 10, 64)
+	case (len(path) == 1 && path[0] == "AuditLog") || (len(path) == 2 && path[0] == "RunHistory"):
+		if len(k) == 8 {
+			id = binary.BigEndian.Uint64(k)
+		}
+	}
+
+	key := strings.Join(path, "\x00")
+	if id > s[key] {
+		s[key] = id
+	}
+}
+
+func (s sequenceTracker) Apply(tx *bolt.Tx) error {
+	for key, maxId := range s {
+		b, err := createBucketPath(tx, strings.Split(key, "\x00"))
+		if err != nil {
+			return err
+		}
+
+		for {
+			id, err := b.NextSequence()
+			if err != nil {
+				return fmt.Errorf("error advancing sequence of bucket %s: %s", strings.Replace(key, "\x00", "/", -1), err)
+			}
+			if id >= maxId {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func createBucketPath(tx *bolt.Tx, path []string) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(path[0]))
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(name))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating bucket %s: %s", strings.Join(path, "/"), err)
+	}
+
+	return b, nil
+}
+
+func restoreRecord(tx *bolt.Tx, record DatabaseRecord, sequences sequenceTracker) error {
+	if len(record.Bucket) == 0 {
+		return fmt.Errorf("record without bucket")
+	}
+
+	b, err := createBucketPath(tx, record.Bucket)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(record.Key)
+	if record.KeyHex != "" {
+		if key, err = hex.DecodeString(record.KeyHex); err != nil {
+			return fmt.Errorf("invalid KeyHex %s: %s", record.KeyHex, err)
+		}
+	}
+
+	if len(key) == 0 {
+		return nil
+	}
+
+	value := []byte(record.Value)
+	if record.RawValue != nil {
+		value = record.RawValue
+	}
+
+	sequences.Track(record.Bucket, key)
+	if err := b.Put(key, value); err != nil {
+		return fmt.Errorf("error writing key %s in bucket %s: %s", key, strings.Join(record.Bucket, "/"), err)
+	}
+
+	return nil
+}
+
+func dbExport(db *bolt.DB, flagSet *flag.FlagSet) error {
+	var out io.Writer = os.Stdout
+	if dbFlags.Out != "" {
+		file, err := os.OpenFile(dbFlags.Out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("error creating export file: %s", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	encoder := json.NewEncoder(out)
+	return db.View(func(tx *bolt.Tx) error {
+		return walkDatabase(tx, func(path []string, k, v []byte) error {
+			return encoder.Encode(newDatabaseRecord(path, k, v))
+		})
+	})
+}
+
+func dbImport(db *bolt.DB, flagSet *flag.FlagSet) error {
+	var in io.Reader = os.Stdin
+	if dbFlags.In != "" {
+		file, err := os.Open(dbFlags.In)
+		if err != nil {
+			return fmt.Errorf("error opening import file: %s", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	count := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		sequences := make(sequenceTracker)
+		decoder := json.NewDecoder(in)
+		for line := 1; ; line++ {
+			var record DatabaseRecord
+			if err := decoder.Decode(&record); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("error reading record %d: %s", line, err)
+			}
+
+			if err := restoreRecord(tx, record, sequences); err != nil {
+				return fmt.Errorf("error importing record %d: %s", line, err)
+			}
+			count++
+		}
+
+		return sequences.Apply(tx)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d records into %s\n", count, db.Path())
+	return nil
+}
+
+func dbVerify(db *bolt.DB, flagSet *flag.FlagSet) error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problem("bolt: %s", err)
+		}
+
+		if version, err := schemaVersion(tx); err != nil {
+			problem("%s", err)
+		} else if version != currentSchemaVersion() {
+			problem("schema version is %d, this version of restatemachine migrates it to %d on startup", version, currentSchemaVersion())
+		}
+
+		if quarantineBucket := tx.Bucket([]byte("QuarantinedRecords")); quarantineBucket != nil {
+			quarantineBucket.ForEach(func(k, v []byte) error {
+				problem("record %s is quarantined", k)
+				return nil
+			})
+		}
+
+		for _, name := range []string{"Metadata", "RunningMachines", "MachineRuns", "ApiTokens", "AuditLog", "RunHistory"} {
+			if tx.Bucket([]byte(name)) == nil {
+				problem("bucket %s is missing", name)
+			}
+		}
+
+		runningBucket := tx.Bucket([]byte("RunningMachines"))
+		runsBucket := tx.Bucket([]byte("MachineRuns"))
+		if runningBucket == nil || runsBucket == nil {
+			return nil
+		}
+
+		runningBucket.ForEach(func(k, v []byte) error {
+			if runsBucket.Get(k) == nil {
+				problem("RunningMachines entry %s has no MachineRuns record", k)
+			}
+			return nil
+		})
+
+		runsBucket.ForEach(func(k, v []byte) error {
+			var machine RunningMachine
+			if err := json.Unmarshal(v, &machine); err != nil {
+				problem("MachineRuns record %s can't be decoded: %s", k, err)
+				return nil
+			}
+
+			running := runningBucket.Get(k) != nil
+			switch {
+			case strconv.FormatUint(machine.Id, 10) != string(k):
+				problem("MachineRuns record %s has Id %d", k, machine.Id)
+			case running && machine.NextState == "stop":
+				problem("run %s is in RunningMachines but has reached the stop state", k)
+			case !running && machine.NextState != "stop":
+				problem("run %s is not in RunningMachines but hasn't reached the stop state (next state %s)", k, machine.NextState)
+			}
+			return nil
+		})
+
+		if historyBucket := tx.Bucket([]byte("RunHistory")); historyBucket != nil {
+			historyBucket.ForEach(func(k, v []byte) error {
+				if runsBucket.Get(k) == nil {
+					problem("RunHistory for run %s has no MachineRuns record", k)
+				}
+
+				if runBucket := historyBucket.Bucket(k); runBucket != nil {
+					runBucket.ForEach(func(seq, entryJson []byte) error {
+						var entry HistoryEntry
+						if err := json.Unmarshal(entryJson, &entry); err != nil {
+							problem("RunHistory entry %x of run %s can't be decoded: %s", seq, k, err)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+
+		if tokensBucket := tx.Bucket([]byte("ApiTokens")); tokensBucket != nil {
+			tokensBucket.ForEach(func(k, v []byte) error {
+				var token ApiToken
+				if err := json.Unmarshal(v, &token); err != nil {
+					problem("ApiTokens record %s can't be decoded: %s", k, err)
+				}
+				return nil
+			})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %d problems found", db.Path(), len(problems))
+	}
+
+	fmt.Printf("%s: no problems found\n", db.Path())
+	return nil
+}
+
+func dbCompact(db *bolt.DB, flagSet *flag.FlagSet) error {
+	if dbFlags.Out == "" {
+		return fmt.Errorf("compact needs the destination file given with -out")
+	}
+
+	if _, err := os.Stat(dbFlags.Out); err == nil {
+		return fmt.Errorf("destination %s already exists", dbFlags.Out)
+	}
+
+	dst, err := bolt.Open(dbFlags.Out, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return fmt.Errorf("error creating database %s: %s", dbFlags.Out, err)
+	}
+	defer dst.Close()
+
+	err = db.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			sequences := make(sequenceTracker)
+			err := walkDatabase(srcTx, func(path []string, k, v []byte) error {
+				return restoreRecord(dstTx, DatabaseRecord{Bucket: path, KeyHex: hex.EncodeToString(k), RawValue: v}, sequences)
+			})
+			if err != nil {
+				return err
+			}
+			return sequences.Apply(dstTx)
+		})
+	})
+
+	if err != nil {
+		os.Remove(dbFlags.Out)
+		return err
+	}
+
+	var srcSize, dstSize int64
+	if info, err := os.Stat(db.Path()); err == nil {
+		srcSize = info.Size()
+	}
+	if info, err := os.Stat(dbFlags.Out); err == nil {
+		dstSize = info.Size()
+	}
+
+	fmt.Printf("compacted %s (%d bytes) into %s (%d bytes)\n", db.Path(), srcSize, dbFlags.Out, dstSize)
+	return nil
+}
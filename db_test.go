@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDbFlags resets the flags of the db commands for the test.
+func testDbFlags(t *testing.T) {
+	previous := dbFlags
+	dbFlags.Running, dbFlags.Output, dbFlags.In, dbFlags.Out, dbFlags.Blobs, dbFlags.Keys = false, "table", "", "", "", nil
+	t.Cleanup(func() { dbFlags = previous })
+}
+
+// createTestDatabase creates a database with runs, history, a token and
+// audit entries and returns its path.
+func createTestDatabase(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "state.db")
+	storage, err := openBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	for _, name := range []string{"first", "second", "third"} {
+		run := &RunningMachine{Name: name, Input: "input of " + name, NextState: "start"}
+		if err := storage.CreateRun(run); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AppendHistory(run.Id, HistoryEntry{Time: time.Now(), State: "start", NextState: "next", Success: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run, _ := storage.GetRun(2)
+	run.NextState = "stop"
+	if err := storage.FinishRun(run, &HistoryEntry{Time: time.Now(), State: "next", NextState: "stop", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.PutApiToken("hash", &ApiToken{Id: "token", Name: "ci"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range []string{"alice", "bob"} {
+		if err := storage.AppendAuditEntry(&AuditEntry{Time: time.Now(), Identity: identity, Action: "start"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// readTestDatabase returns the records of the database at path by bucket
+// path and hex encoded key.
+func readTestDatabase(t *testing.T, path string) map[string]string {
+	db, err := openDatabaseOffline(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	records := make(map[string]string)
+	err = db.View(func(tx *bolt.Tx) error {
+		return walkDatabase(tx, func(path []string, k, v []byte) error {
+			if k != nil {
+				records[strings.Join(path, "/")+"/"+hex.EncodeToString(k)] = string(v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+// checkTestDatabaseCopy checks that the database at path has the contents of
+// the one at original and continues its ids rather than reusing them.
+func checkTestDatabaseCopy(t *testing.T, original string, path string) {
+	if records, originalRecords := readTestDatabase(t, path), readTestDatabase(t, original); !reflect.DeepEqual(records, originalRecords) {
+		t.Errorf("copy has %d records, expected %d equal to the original", len(records), len(originalRecords))
+	}
+
+	storage, err := openBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	run := &RunningMachine{Name: "fourth", NextState: "start"}
+	if err := storage.CreateRun(run); err != nil || run.Id != 4 {
+		t.Errorf("new run in the copy got id %d, error %v", run.Id, err)
+	}
+	entry := &AuditEntry{Time: time.Now(), Identity: "carol", Action: "start"}
+	if err := storage.AppendAuditEntry(entry); err != nil || entry.Id != 3 {
+		t.Errorf("new audit entry in the copy got id %d, error %v", entry.Id, err)
+	}
+	if err := storage.AppendHistory(1, HistoryEntry{Time: time.Now(), State: "next", NextState: "stop", StatusMessage: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if history, err := storage.GetHistory(1); err != nil || len(history) != 2 || history[1].StatusMessage != "new" {
+		t.Errorf("history in the copy is %+v, error %v", history, err)
+	}
+	if err := storage.Check(); err != nil {
+		t.Errorf("copy fails the check: %s", err)
+	}
+}
+
+func TestDbExportImport(t *testing.T) {
+	testConfig(t)
+	testDbFlags(t)
+	original := createTestDatabase(t)
+
+	dbFlags.Out = filepath.Join(t.TempDir(), "export.jsonl")
+	db, err := openDatabaseOffline(original, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbExport(db, nil)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbFlags.In = dbFlags.Out
+	imported := filepath.Join(t.TempDir(), "imported.db")
+	db, err = openDatabaseOffline(imported, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbImport(db, nil)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDatabaseCopy(t, original, imported)
+}
+
+func TestDbCompact(t *testing.T) {
+	testConfig(t)
+	testDbFlags(t)
+	original := createTestDatabase(t)
+
+	db, err := openDatabaseOffline(original, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dbFlags.Out = filepath.Join(t.TempDir(), "compacted.db")
+	if err := dbCompact(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbCompact(db, nil); err == nil {
+		t.Error("compact overwrote an existing destination")
+	}
+
+	checkTestDatabaseCopy(t, original, dbFlags.Out)
+}
+
+func TestDbRestore(t *testing.T) {
+	testConfig(t)
+	testDbFlags(t)
+	path := createTestDatabase(t)
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	if err := copyFile(path, backup); err != nil {
+		t.Fatal(err)
+	}
+	backupRecords := readTestDatabase(t, backup)
+
+	storage, err := openBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.CreateRun(&RunningMachine{Name: "after-backup", NextState: "start"})
+	storage.Close()
+	changedRecords := readTestDatabase(t, path)
+
+	notDatabase := filepath.Join(t.TempDir(), "other.db")
+	other, err := bolt.Open(notDatabase, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	db, err := openDatabaseOffline(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFlags.In = notDatabase
+	if err := dbRestore(db, nil); err == nil {
+		t.Error("a bolt file without the restatemachine buckets was restored")
+	}
+	dbFlags.In = backup
+	err = dbRestore(db, nil)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if records := readTestDatabase(t, path); !reflect.DeepEqual(records, backupRecords) {
+		t.Errorf("restored database has %d records, expected the %d of the backup", len(records), len(backupRecords))
+	}
+
+	saved, _ := filepath.Glob(path + ".before-restore-*")
+	if len(saved) != 1 {
+		t.Fatalf("previous databases saved by restore are %v", saved)
+	}
+	if records := readTestDatabase(t, saved[0]); !reflect.DeepEqual(records, changedRecords) {
+		t.Errorf("saved database has %d records, expected the %d from before the restore", len(records), len(changedRecords))
+	}
+}
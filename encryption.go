@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// encryptedPrefix marks a stored value as an envelope written by
+// KeyRing.Encrypt, values without it are plaintext from before encryption was
+// enabled.
+const encryptedPrefix = "$rsm-enc$v1$"
+
+var encryptionKeyIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type EncryptionKey struct {
+	Id  string
+	Key []byte
+}
+
+// KeyRing holds the master keys from EncryptionKeyFile. Every value is
+// encrypted with its own random data key, which is stored wrapped with the
+// active master key, the first one in the file. The other keys are only used
+// to unwrap data keys from before a key rotation.
+type KeyRing struct {
+	Keys []EncryptionKey
+}
+
+// loadKeyRing reads a key file with one "<id> <hex encoded 32 byte key>" per
+// line. Empty lines and lines starting with # are ignored.
+func loadKeyRing(path string) (*KeyRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keyRing := &KeyRing{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !encryptionKeyIdPattern.MatchString(fields[0]) {
+			return nil, fmt.Errorf("%s line %d: expected \"<id> <hex encoded key>\"", path, lineNumber)
+		}
+
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s line %d: key %s must be a hex encoded 32 byte key, generate one with \"restatemachine secrets genkey\"", path, lineNumber, fields[0])
+		}
+
+		if seen[fields[0]] {
+			return nil, fmt.Errorf("%s line %d: duplicate key id %s", path, lineNumber, fields[0])
+		}
+		seen[fields[0]] = true
+
+		keyRing.Keys = append(keyRing.Keys, EncryptionKey{Id: fields[0], Key: key})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keyRing.Keys) == 0 {
+		return nil, fmt.Errorf("%s contains no keys", path)
+	}
+
+	return keyRing, nil
+}
+
+func (k *KeyRing) active() EncryptionKey {
+	return k.Keys[0]
+}
+
+func (k *KeyRing) lookup(id string) (EncryptionKey, error) {
+	for _, key := range k.Keys {
+		if key.Id == id {
+			return key, nil
+		}
+	}
+
+	return EncryptionKey{}, fmt.Errorf("value is encrypted with key %s which is not in EncryptionKeyFile", id)
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// seal encrypts plaintext with AES-256-GCM and returns the nonce followed by
+// the ciphertext.
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// envelope is the parsed form of "<prefix><key id>$<wrapped data key>$<data>".
+type envelope struct {
+	KeyId      string
+	WrappedKey []byte
+	Data       []byte
+}
+
+func parseEnvelope(value string) (envelope, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), "$")
+	if len(parts) != 3 {
+		return envelope{}, fmt.Errorf("malformed encrypted value")
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return envelope{}, fmt.Errorf("malformed encrypted value: %s", err)
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return envelope{}, fmt.Errorf("malformed encrypted value: %s", err)
+	}
+
+	return envelope{KeyId: parts[0], WrappedKey: wrappedKey, Data: data}, nil
+}
+
+func (e envelope) String() string {
+	return encryptedPrefix + e.KeyId + "$" + base64.RawStdEncoding.EncodeToString(e.WrappedKey) + "$" +
+		base64.RawStdEncoding.EncodeToString(e.Data)
+}
+
+// Encrypt seals value with a new data key wrapped with the active key. Empty
+// values are stored as they are.
+func (k *KeyRing) Encrypt(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	data, err := seal(dataKey, []byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	active := k.active()
+	wrappedKey, err := seal(active.Key, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return envelope{KeyId: active.Id, WrappedKey: wrappedKey, Data: data}.String(), nil
+}
+
+func (k *KeyRing) unwrap(e envelope) ([]byte, error) {
+	key, err := k.lookup(e.KeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := unseal(key.Key, e.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key with key %s: %s", e.KeyId, err)
+	}
+
+	return dataKey, nil
+}
+
+// Decrypt opens a value written by Encrypt, plaintext values are returned as
+// they are.
+func (k *KeyRing) Decrypt(value string) (string, error) {
+	if !isEncrypted(value) {
+		return value, nil
+	}
+
+	e, err := parseEnvelope(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := k.unwrap(e)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := unseal(dataKey, e.Data)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting value: %s", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Rewrap makes value use the active key. Envelopes of older keys only get
+// their data key wrapped again, plaintext values are encrypted. It reports
+// whether value changed.
+func (k *KeyRing) Rewrap(value string) (string, bool, error) {
+	if !isEncrypted(value) {
+		encrypted, err := k.Encrypt(value)
+		return encrypted, encrypted != value, err
+	}
+
+	e, err := parseEnvelope(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	active := k.active()
+	if e.KeyId == active.Id {
+		return value, false, nil
+	}
+
+	dataKey, err := k.unwrap(e)
+	if err != nil {
+		return "", false, err
+	}
+
+	e.WrappedKey, err = seal(active.Key, dataKey)
+	if err != nil {
+		return "", false, err
+	}
+	e.KeyId = active.Id
+
+	return e.String(), true, nil
+}
+
+// Blobs are encrypted as a stream: a line with an envelope holding the
+// wrapped data key and no data, followed by the payload sealed in chunks of
+// blobChunkSize bytes. The nonce of a chunk is its index and whether it is
+// the last one, so that reordered or truncated chunks fail to open.
+const blobChunkSize = 64 * 1024
+
+// blobChunkOverhead is the size of the AES-GCM tag added to each chunk.
+const blobChunkOverhead = 16
+
+func blobChunkNonce(gcm cipher.AEAD, index uint64, last bool) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptedBlobSize returns the size of the payload of an encrypted blob
+// from the size of the chunks following its header.
+func encryptedBlobSize(chunksSize int64) int64 {
+	sealedChunkSize := int64(blobChunkSize + blobChunkOverhead)
+	size := chunksSize / sealedChunkSize * blobChunkSize
+	if remaining := chunksSize % sealedChunkSize; remaining > blobChunkOverhead {
+		size += remaining - blobChunkOverhead
+	}
+	return size
+}
+
+// BlobNameHash returns the hash that names blobs. It is an HMAC with a key
+// derived from the active key, so that the name of a blob doesn't reveal
+// whether it holds a payload known to whoever can list BlobPath.
+func (k *KeyRing) BlobNameHash() hash.Hash {
+	derive := hmac.New(sha256.New, k.active().Key)
+	io.WriteString(derive, "restatemachine blob names")
+	return hmac.New(sha256.New, derive.Sum(nil))
+}
+
+type blobWriter struct {
+	out    io.Writer
+	gcm    cipher.AEAD
+	buffer []byte
+	index  uint64
+}
+
+// NewBlobWriter writes the header of a blob encrypted with a new data key to
+// out and returns a writer that encrypts the payload into it. Close must be
+// called to write the last chunk, it doesn't close out.
+func (k *KeyRing) NewBlobWriter(out io.Writer) (io.WriteCloser, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	active := k.active()
+	wrappedKey, err := seal(active.Key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(out, envelope{KeyId: active.Id, WrappedKey: wrappedKey}.String()+"\n"); err != nil {
+		return nil, err
+	}
+
+	return &blobWriter{out: out, gcm: gcm}, nil
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+
+	// The last chunk is only written by Close, so a full buffer is kept
+	for len(w.buffer) > blobChunkSize {
+		if err := w.writeChunk(w.buffer[:blobChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buffer = append(w.buffer[:0], w.buffer[blobChunkSize:]...)
+	}
+
+	return len(p), nil
+}
+
+func (w *blobWriter) writeChunk(chunk []byte, last bool) error {
+	_, err := w.out.Write(w.gcm.Seal(nil, blobChunkNonce(w.gcm, w.index, last), chunk, nil))
+	w.index++
+	return err
+}
+
+func (w *blobWriter) Close() error {
+	err := w.writeChunk(w.buffer, true)
+	w.buffer = nil
+	return err
+}
+
+type blobReader struct {
+	in     *bufio.Reader
+	gcm    cipher.AEAD
+	sealed []byte
+	plain  []byte
+	index  uint64
+	last   bool
+}
+
+// NewBlobReader reads the header of an encrypted blob of blobSize bytes from
+// in and returns a reader of its payload and the size of the payload.
+func (k *KeyRing) NewBlobReader(in *bufio.Reader, blobSize int64) (io.Reader, int64, error) {
+	header, err := in.ReadString('\n')
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed encrypted blob: %s", err)
+	}
+
+	e, err := parseEnvelope(strings.TrimSuffix(header, "\n"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dataKey, err := k.unwrap(e)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader := &blobReader{in: in, gcm: gcm, sealed: make([]byte, blobChunkSize+blobChunkOverhead)}
+	return reader, encryptedBlobSize(blobSize - int64(len(header))), nil
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *blobReader) readChunk() error {
+	n, err := io.ReadFull(r.in, r.sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.last = true
+	} else if err != nil {
+		return err
+	} else if _, err := r.in.Peek(1); err == io.EOF {
+		r.last = true
+	} else if err != nil {
+		return err
+	}
+
+	r.plain, err = r.gcm.Open(r.plain[:0], blobChunkNonce(r.gcm, r.index, r.last), r.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted blob is corrupt or truncated")
+	}
+	r.index++
+
+	return nil
+}
+
+// EncryptedStorage encrypts the input and status message of runs and the
+// status messages of their history before passing them to the wrapped
+// storage, and decrypts them again when they are read. Everything needed to
+// list and schedule runs stays readable.
+type EncryptedStorage struct {
+	Storage
+	Keys *KeyRing
+}
+
+func (s *EncryptedStorage) encryptRun(run *RunningMachine) (*RunningMachine, error) {
+	encrypted := *run
+	var err error
+	if encrypted.Input, err = s.Keys.Encrypt(run.Input); err != nil {
+		return nil, err
+	}
+	if encrypted.StatusMessage, err = s.Keys.Encrypt(run.StatusMessage); err != nil {
+		return nil, err
+	}
+
+	return &encrypted, nil
+}
+
+func (s *EncryptedStorage) decryptRun(run *RunningMachine) error {
+	var err error
+	if run.Input, err = s.Keys.Decrypt(run.Input); err != nil {
+		return fmt.Errorf("error decrypting run %d: %s", run.Id, err)
+	}
+	if run.StatusMessage, err = s.Keys.Decrypt(run.StatusMessage); err != nil {
+		return fmt.Errorf("error decrypting run %d: %s", run.Id, err)
+	}
+
+	return nil
+}
+
+func (s *EncryptedStorage) encryptHistoryEntry(entry HistoryEntry) (HistoryEntry, error) {
+	var err error
+	entry.StatusMessage, err = s.Keys.Encrypt(entry.StatusMessage)
+	return entry, err
+}
+
+func (s *EncryptedStorage) CreateRun(run *RunningMachine) error {
+	encrypted, err := s.encryptRun(run)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Storage.CreateRun(encrypted); err != nil {
+		return err
+	}
+
+	run.Id = encrypted.Id
+	return nil
+}
+
+func (s *EncryptedStorage) UpdateRun(run *RunningMachine) error {
+	encrypted, err := s.encryptRun(run)
+	if err != nil {
+		return err
+	}
+
+	return s.Storage.UpdateRun(encrypted)
+}
+
+func (s *EncryptedStorage) GetRun(id uint64) (*RunningMachine, error) {
+	run, err := s.Storage.GetRun(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, s.decryptRun(run)
+}
+
+func (s *EncryptedStorage) ActiveRuns() ([]*RunningMachine, error) {
+	runs, err := s.Storage.ActiveRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decryptRuns(runs), nil
+}
+
+func (s *EncryptedStorage) ListRuns(filter RunFilter) ([]*RunningMachine, error) {
+	runs, err := s.Storage.ListRuns(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decryptRuns(runs), nil
+}
+
+// decryptRuns decrypts runs in place. Runs that can't be decrypted, e.g. since
+// their key was removed from the key file, are left out and logged rather than
+// failing all of them.
+func (s *EncryptedStorage) decryptRuns(runs []*RunningMachine) []*RunningMachine {
+	decrypted := runs[:0]
+	for _, run := range runs {
+		if err := s.decryptRun(run); err != nil {
+			logFields := runLogFields(run)
+			logFields["error"] = err
+			logError(logFields, "error decrypting run, it is skipped")
+			continue
+		}
+		decrypted = append(decrypted, run)
+	}
+
+	return decrypted
+}
+
+func (s *EncryptedStorage) FinishRun(run *RunningMachine, entry *HistoryEntry) error {
+	encrypted, err := s.encryptRun(run)
+	if err != nil {
+		return err
+	}
+
+	if entry != nil {
+		encryptedEntry, err := s.encryptHistoryEntry(*entry)
+		if err != nil {
+			return err
+		}
+		entry = &encryptedEntry
+	}
+
+	return s.Storage.FinishRun(encrypted, entry)
+}
+
+func (s *EncryptedStorage) AppendHistory(id uint64, entry HistoryEntry) error {
+	encrypted, err := s.encryptHistoryEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	return s.Storage.AppendHistory(id, encrypted)
+}
+
+func (s *EncryptedStorage) GetHistory(id uint64) ([]HistoryEntry, error) {
+	history, err := s.Storage.GetHistory(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range history {
+		if history[idx].StatusMessage, err = s.Keys.Decrypt(history[idx].StatusMessage); err != nil {
+			return nil, fmt.Errorf("error decrypting history of run %d: %s", id, err)
+		}
+	}
+
+	return history, nil
+}
+
+// dbRotateKeys implements "restatemachine db rotate-keys". It wraps the data
+// keys of all encrypted values and blobs with the active key, so that older
+// keys can be removed from the key file afterwards, and encrypts values and
+// blobs that are still plaintext.
+func dbRotateKeys(db *bolt.DB, flagSet *flag.FlagSet) error {
+	if dbFlags.Keys == nil {
+		return fmt.Errorf("rotate-keys needs EncryptionKeyFile or the key file given with -keys")
+	}
+
+	var runs, entries int
+	err := db.Update(func(tx *bolt.Tx) error {
+		runsBucket := tx.Bucket([]byte("MachineRuns"))
+		historyBucket := tx.Bucket([]byte("RunHistory"))
+		if runsBucket == nil || historyBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		err := rewrapRecords(runsBucket, func(v []byte) (interface{}, bool, error) {
+			var run RunningMachine
+			if err := json.Unmarshal(v, &run); err != nil {
+				return nil, false, err
+			}
+			changed, err := dbFlags.Keys.rewrapFields(&run.Input, &run.StatusMessage)
+			if changed {
+				runs++
+			}
+			return run, changed, err
+		})
+		if err != nil {
+			return fmt.Errorf("error rotating keys of runs: %s", err)
+		}
+
+		return historyBucket.ForEach(func(k, v []byte) error {
+			runBucket := historyBucket.Bucket(k)
+			if runBucket == nil {
+				return nil
+			}
+
+			err := rewrapRecords(runBucket, func(v []byte) (interface{}, bool, error) {
+				var entry HistoryEntry
+				if err := json.Unmarshal(v, &entry); err != nil {
+					return nil, false, err
+				}
+				changed, err := dbFlags.Keys.rewrapFields(&entry.StatusMessage)
+				if changed {
+					entries++
+				}
+				return entry, changed, err
+			})
+			if err != nil {
+				return fmt.Errorf("error rotating keys of history of run %s: %s", k, err)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("rewrapped %d runs and %d history entries with key %s\n", runs, entries, dbFlags.Keys.active().Id)
+
+	if dbFlags.Blobs == "" {
+		fmt.Printf("blobs were not rotated, give their directory with -blobs\n")
+		return nil
+	}
+
+	blobs, err := rotateBlobKeys(dbFlags.Blobs, dbFlags.Keys)
+	if err != nil {
+		return fmt.Errorf("error rotating keys of blobs in %s: %s", dbFlags.Blobs, err)
+	}
+
+	fmt.Printf("rewrapped %d blobs in %s with key %s\n", blobs, dbFlags.Blobs, dbFlags.Keys.active().Id)
+	return nil
+}
+
+func (k *KeyRing) rewrapFields(fields ...*string) (bool, error) {
+	changed := false
+	for _, field := range fields {
+		value, fieldChanged, err := k.Rewrap(*field)
+		if err != nil {
+			return false, err
+		}
+		*field = value
+		changed = changed || fieldChanged
+	}
+
+	return changed, nil
+}
+
+// rewrapRecords stores the records of bucket that rewrap reports as changed.
+// Keys are collected first since bolt doesn't allow modifying a bucket while
+// iterating over it.
+func rewrapRecords(bucket *bolt.Bucket, rewrap func(v []byte) (interface{}, bool, error)) error {
+	updates := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		record, changed, err := rewrap(v)
+		if err != nil {
+			return fmt.Errorf("record %q: %s", k, err)
+		}
+
+		if changed {
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range updates {
+		if err := bucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
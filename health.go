@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+const schedulerHeartbeatTimeout = 10 * time.Second
+
+type HealthCheck struct {
+	Name    string
+	Healthy bool
+	Message string
+	Details interface{} `json:",omitempty"`
+}
+
+type HealthReport struct {
+	Status  string
+	Version string
+	Time    time.Time
+	Checks  []HealthCheck
+}
+
+func healthCheckDatabase() HealthCheck {
+	check := HealthCheck{Name: "database"}
+
+	storage := globalScheduler.Storage
+	if storage == nil {
+		check.Message = "database is not open"
+		return check
+	}
+
+	if err := storage.Check(); err != nil {
+		check.Message = fmt.Sprintf("error accessing %s: %s", storage, err)
+	} else {
+		check.Healthy = true
+		check.Message = fmt.Sprintf("%s is accessible", storage)
+	}
+
+	return check
+}
+
+func healthCheckScheduler() HealthCheck {
+	check := HealthCheck{Name: "scheduler"}
+
+	lastTick := atomic.LoadInt64(&globalScheduler.LastTick)
+	if lastTick == 0 {
+		check.Message = "scheduler has not ticked yet"
+		return check
+	}
+
+	sinceTick := time.Since(time.Unix(0, lastTick))
+	check.Details = map[string]interface{}{"LastTick": time.Unix(0, lastTick), "SecondsSinceLastTick": sinceTick.Seconds()}
+	if sinceTick > schedulerHeartbeatTimeout {
+		check.Message = fmt.Sprintf("scheduler has not ticked for %s", sinceTick)
+	} else {
+		check.Healthy = true
+		check.Message = "scheduler is running"
+	}
+
+	return check
+}
+
+func healthCheckMachines() HealthCheck {
+	check := HealthCheck{Name: "machines"}
+
+	if !globalMachinesLoaded {
+		check.Message = "state machines have not been loaded"
+		return check
+	}
+
+	var missing []string
+	for _, machine := range globalStateMachines {
+		// Built-in HTTP start states are declared in the manifest and have no file
+		if !machine.hasState("start") {
+			missing = append(missing, machine.Name)
+		} else if machine.httpStates["start"] == nil {
+			if _, err := os.Stat(path.Join(machine.Path, "start")); err != nil {
+				missing = append(missing, machine.Name)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		check.Message = fmt.Sprintf("%d state machine(s) have an inaccessible start state", len(missing))
+		check.Details = map[string]interface{}{"Inaccessible": missing}
+	} else {
+		check.Healthy = true
+		check.Message = fmt.Sprintf("%d state machine(s) loaded from %s", len(globalStateMachines), globalConfig.StateMachinePath)
+	}
+
+	return check
+}
+
+func healthCheckStuckRuns() HealthCheck {
+	check := HealthCheck{Name: "runs"}
+
+	threshold := time.Duration(globalConfig.StuckRunSeconds) * time.Second
+	stuck, acquired := globalScheduler.GetStuckRuns(threshold)
+	if !acquired {
+		check.Message = "timed out waiting for the scheduler lock"
+		return check
+	}
+
+	if len(stuck) > 0 {
+		check.Message = fmt.Sprintf("%d run(s) have been executing a state for more than %s", len(stuck), threshold)
+		check.Details = map[string]interface{}{"StuckRuns": stuck}
+	} else {
+		check.Healthy = true
+		check.Message = "no stuck runs"
+	}
+
+	return check
+}
+
+func healthReport(checks ...func() HealthCheck) (int, *HealthReport) {
+	report := &HealthReport{Status: "ok", Version: globalVersionNumber, Time: time.Now()}
+	code := 200
+
+	for _, checkFunction := range checks {
+		check := checkFunction()
+		if !check.Healthy {
+			report.Status = "failing"
+			code = 503
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	return code, report
+}
+
+func apiHealthz(req *restful.Request, resp *restful.Response) {
+	code, report := healthReport(healthCheckDatabase, healthCheckScheduler)
+	resp.WriteHeader(code)
+	resp.WriteEntity(report)
+}
+
+func apiReadyz(req *restful.Request, resp *restful.Response) {
+	code, report := healthReport(healthCheckDatabase, healthCheckScheduler, healthCheckMachines, healthCheckStuckRuns, healthCheckDrain)
+	resp.WriteHeader(code)
+	resp.WriteEntity(report)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHealthCheckMachines(t *testing.T) {
+	config := testConfig(t)
+
+	executable := filepath.Join(config.StateMachinePath, "executable")
+	if err := os.Mkdir(executable, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(executable, "start"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	previousMachines, previousLoaded := globalStateMachines, globalMachinesLoaded
+	t.Cleanup(func() { globalStateMachines, globalMachinesLoaded = previousMachines, previousLoaded })
+	globalMachinesLoaded = true
+	globalStateMachines = []StateMachine{
+		{Name: "executable", Path: executable, States: []string{"start"}},
+		{Name: "http", Path: filepath.Join(config.StateMachinePath, "http"), States: []string{"start"},
+			httpStates: map[string]*HttpState{"start": {Name: "start"}}},
+	}
+
+	if check := healthCheckMachines(); !check.Healthy {
+		t.Errorf("machines with executable and HTTP start states are unhealthy: %s", check.Message)
+	}
+
+	if err := os.Remove(filepath.Join(executable, "start")); err != nil {
+		t.Fatal(err)
+	}
+	check := healthCheckMachines()
+	expected := map[string]interface{}{"Inaccessible": []string{"executable"}}
+	if check.Healthy || !reflect.DeepEqual(check.Details, expected) {
+		t.Errorf("check without the start state is %+v", check)
+	}
+}
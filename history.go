@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/emicklei/go-restful"
+	"time"
+)
+
+// HistoryEntry records one state execution or lifecycle event of a run.
+type HistoryEntry struct {
+	Time          time.Time
+	State         string
+	NextState     string
+	NextStateRun  time.Time
+	StatusMessage string
+	Duration      float64
+	Success       bool
+}
+
+func (s *Scheduler) GetMachineRunHistory(id string) ([]HistoryEntry, error) {
+	runId, err := parseRunId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Storage.GetHistory(runId)
+}
+
+func apiGetRunHistory(req *restful.Request, resp *restful.Response) {
+	id := req.PathParameter("id")
+	machine, err := globalScheduler.GetMachineRun(id)
+	if err != nil {
+		runError("Error retrieving information about state machine run", err, id, resp)
+		return
+	}
+
+	if !authorize(req, resp, actionList, machine.Name) {
+		return
+	}
+
+	history, err := globalScheduler.GetMachineRunHistory(id)
+	if err != nil {
+		errorResponse(500, errorInternal, "Error retrieving state machine run history: "+err.Error(), resp)
+		return
+	}
+
+	for idx := range history {
+		history[idx].StatusMessage = redactSecrets(history[idx].StatusMessage)
+	}
+
+	resp.WriteEntity(history)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// A machine directory can contain a manifest, machine.toml, declaring built-in
+// states. The scheduler executes them itself instead of running state code,
+// and retries them when they fail just like state code.
+//
+// A state of type "http" sends a request built from templates and picks the
+// next state by the response status, the first matching Response is used:
+//
+//	[[State]]
+//	Name = "poll"
+//	Type = "http"
+//	Method = "GET"
+//	Url = "https://jobs.example.com/jobs/{{.Json.job | urlquery}}"
+//	TimeoutSeconds = 10
+//
+//	[State.Headers]
+//	Authorization = "Bearer {{.Secrets.JOBS_TOKEN}}"
+//
+//	[[State.Response]]
+//	Status = "200"
+//	NextState = "finish"
+//	Output = true
+//
+//	[[State.Response]]
+//	Status = "*"
+//	NextState = "poll"
+//	DelaySeconds = 30
+//	StatusMessage = "Job is still running"
+//
+// The templates are executed with HttpStateData. Without a Body template,
+// requests other than GET, HEAD and DELETE send the run input as body.
+
+const manifestFile = "machine.toml"
+
+const httpStateType = "http"
+
+const httpStateDefaultTimeout = 30
+
+type Manifest struct {
+	Usage string
+	State []ManifestState
+}
+
+type ManifestState struct {
+	Name           string
+	Type           string
+	Method         string
+	Url            string
+	Headers        map[string]string
+	Body           string
+	TimeoutSeconds int
+	Response       []HttpStateResponse
+}
+
+// HttpStateResponse maps response statuses to the next state. Status is a
+// status code, a class of codes like "5xx" or "*" for any status. With Output
+// the response body becomes the input of the next state, otherwise the input
+// is kept.
+type HttpStateResponse struct {
+	Status        string
+	NextState     string
+	DelaySeconds  int
+	StatusMessage string
+	Output        bool
+}
+
+// HttpState is an "http" state from a manifest with its templates parsed.
+type HttpState struct {
+	ManifestState
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+// HttpStateData is what the templates of HTTP states are executed with. Json
+// is the run input decoded as JSON, or nil if it isn't valid JSON. Input is
+// empty if the input is stored as a blob. Secrets are those referenced by the
+// [[Machine]] config of the state machine.
+type HttpStateData struct {
+	Id      uint64
+	Machine string
+	Input   string
+	Json    interface{}
+	Labels  map[string]string
+	Secrets map[string]string
+}
+
+var httpStateClient = &http.Client{}
+
+// loadManifest adds the states declared by the manifest of machine, if it has
+// one.
+func loadManifest(machine *StateMachine) error {
+	path := filepath.Join(machine.Path, manifestFile)
+
+	var manifest Manifest
+	metaData, err := toml.DecodeFile(path, &manifest)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if undecoded := metaData.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("unknown key %s", undecoded[0])
+	}
+
+	machine.Usage = manifest.Usage
+	machine.httpStates = make(map[string]*HttpState)
+	for _, state := range manifest.State {
+		if state.Name == "" || state.Name == "stop" || strings.Contains(state.Name, "/") {
+			return fmt.Errorf("invalid state name %q", state.Name)
+		}
+		for _, existing := range machine.States {
+			if existing == state.Name {
+				return fmt.Errorf("state %s is declared more than once or is also an executable", state.Name)
+			}
+		}
+		if state.Type != httpStateType {
+			return fmt.Errorf("state %s has unknown type %q", state.Name, state.Type)
+		}
+
+		httpState, err := newHttpState(state)
+		if err != nil {
+			return fmt.Errorf("state %s: %s", state.Name, err)
+		}
+		machine.httpStates[state.Name] = httpState
+		machine.States = append(machine.States, state.Name)
+	}
+
+	for _, state := range machine.httpStates {
+		for _, response := range state.Response {
+			if !machine.hasState(response.NextState) {
+				return fmt.Errorf("state %s: next state %s doesn't exist", state.Name, response.NextState)
+			}
+		}
+	}
+
+	return nil
+}
+
+func newHttpState(state ManifestState) (*HttpState, error) {
+	httpState := &HttpState{ManifestState: state, headers: make(map[string]*template.Template)}
+
+	if httpState.Method == "" {
+		httpState.Method = "GET"
+	}
+	httpState.Method = strings.ToUpper(httpState.Method)
+
+	if httpState.TimeoutSeconds < 0 {
+		return nil, fmt.Errorf("TimeoutSeconds can't be negative")
+	} else if httpState.TimeoutSeconds == 0 {
+		httpState.TimeoutSeconds = httpStateDefaultTimeout
+	}
+
+	if len(state.Response) == 0 {
+		return nil, fmt.Errorf("at least one Response is required")
+	}
+	for _, response := range state.Response {
+		if !validStatusPattern(response.Status) {
+			return nil, fmt.Errorf("invalid Response Status %q, expected a status code, a class like \"5xx\" or \"*\"", response.Status)
+		}
+		if response.NextState == "" {
+			return nil, fmt.Errorf("Response for status %s has no NextState", response.Status)
+		}
+	}
+
+	var err error
+	if state.Url == "" {
+		return nil, fmt.Errorf("Url is required")
+	} else if httpState.url, err = parseStateTemplate("Url", state.Url); err != nil {
+		return nil, err
+	}
+
+	for name, value := range state.Headers {
+		if httpState.headers[name], err = parseStateTemplate("header "+name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if state.Body != "" {
+		if httpState.body, err = parseStateTemplate("Body", state.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	return httpState, nil
+}
+
+func parseStateTemplate(name string, text string) (*template.Template, error) {
+	parsed, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %s", name, err)
+	}
+
+	return parsed, nil
+}
+
+func validStatusPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	} else if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+
+	if strings.ToLower(pattern[1:]) == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(pattern)
+	return err == nil
+}
+
+func statusMatches(pattern string, status int) bool {
+	code := strconv.Itoa(status)
+	return pattern == "*" || pattern == code || (strings.ToLower(pattern[1:]) == "xx" && pattern[0] == code[0])
+}
+
+// machineHttpState returns the HTTP state of the given name, or nil if the
+// state isn't one.
+func machineHttpState(machine string, state string) *HttpState {
+	if stateMachine := machineGet(machine); stateMachine != nil {
+		return stateMachine.httpStates[state]
+	}
+
+	return nil
+}
+
+func (s *HttpState) match(status int) *HttpStateResponse {
+	for idx := range s.Response {
+		if statusMatches(s.Response[idx].Status, status) {
+			return &s.Response[idx]
+		}
+	}
+
+	return nil
+}
+
+func executeStateTemplate(tmpl *template.Template, data *HttpStateData) (string, error) {
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// send builds the request of the state for run and sends it.
+func (s *HttpState) send(ctx context.Context, run *RunningMachine) (*http.Response, error) {
+	secrets, err := machineSecrets(run.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &HttpStateData{Id: run.Id, Machine: run.Name, Input: run.Input, Labels: run.Labels, Secrets: secrets}
+	if run.InputBlob == "" {
+		json.Unmarshal([]byte(run.Input), &data.Json)
+	}
+
+	url, err := executeStateTemplate(s.url, data)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(http.Header)
+	for name, tmpl := range s.headers {
+		value, err := executeStateTemplate(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		headers.Set(name, value)
+	}
+
+	var body io.Reader
+	var blob io.ReadCloser
+	var blobSize int64
+	if s.body != nil {
+		text, err := executeStateTemplate(s.body, data)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(text)
+	} else if s.Method != "GET" && s.Method != "HEAD" && s.Method != "DELETE" {
+		if run.InputBlob == "" {
+			body = strings.NewReader(run.Input)
+		} else if blob, blobSize, err = openBlob(run.InputBlob); err != nil {
+			return nil, fmt.Errorf("error opening payload blob %s: %s", run.InputBlob, err)
+		} else {
+			// The transport closes the blob once it is sent
+			body = blob
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, s.Method, url, body)
+	if err != nil {
+		if blob != nil {
+			blob.Close()
+		}
+		return nil, err
+	}
+	req.Header = headers
+	if blob != nil {
+		req.ContentLength = blobSize
+	}
+
+	return httpStateClient.Do(req)
+}
+
+// executeHttpState sends the request of state and applies the Response
+// matching its status to machine. The request is cancelled after the timeout
+// of the state or by KillStates.
+func (s *Scheduler) executeHttpState(machine *RunningMachine, state *HttpState, startTime time.Time, logFields LogFields) (success bool, duration float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(state.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	s.SchedulerLock.Lock()
+	s.requests[machine.Id] = cancel
+	s.SchedulerLock.Unlock()
+
+	output := newPayloadWriter(int64(globalConfig.MaxOutputBytes))
+	defer output.Discard()
+
+	var response *HttpStateResponse
+	var status, input, inputBlob string
+	resp, err := state.send(ctx, machine)
+	if err == nil {
+		defer resp.Body.Close()
+		status = resp.Status
+		logFields["http_status"] = resp.StatusCode
+
+		if response = state.match(resp.StatusCode); response == nil {
+			err = fmt.Errorf("no Response matches status %s", resp.Status)
+		} else if response.Output {
+			if _, err = io.Copy(output, resp.Body); err == nil {
+				input, inputBlob, err = output.Finish()
+			}
+		}
+	}
+
+	s.SchedulerLock.Lock()
+	delete(s.requests, machine.Id)
+	s.SchedulerLock.Unlock()
+	duration = observeStateDuration(machine, startTime, logFields)
+
+	if err != nil {
+		machine.StatusMessage = fmt.Sprintf("error executing HTTP state %s (will keep retrying): %s", machine.NextState, err)
+		metricStateFailures.Inc(machine.Name, machine.NextState)
+		logFields["error"] = redactSecrets(err.Error())
+		logWarn(logFields, "error executing HTTP state, will keep retrying")
+		return false, duration
+	}
+
+	if response.Output {
+		machine.Input = input
+		machine.InputBlob = inputBlob
+	}
+
+	message := response.StatusMessage
+	if message == "" {
+		message = fmt.Sprintf("%s request of state %s returned %s", state.Method, machine.NextState, status)
+	}
+	applyStateResult(machine, response.NextState, response.DelaySeconds, message)
+
+	logFields["next_state"] = machine.NextState
+	logFields["status"] = machine.StatusMessage
+	logInfo(logFields, "state executed")
+	return true, duration
+}
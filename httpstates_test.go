@@ -0,0 +1,295 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHttpState parses state, failing the test if it is invalid.
+func testHttpState(t *testing.T, state ManifestState) *HttpState {
+	if state.Name == "" {
+		state.Name = "request"
+	}
+	state.Type = httpStateType
+
+	httpState, err := newHttpState(state)
+	if err != nil {
+		t.Fatalf("invalid state: %s", err)
+	}
+
+	return httpState
+}
+
+// executeTestHttpState executes state for a run with input on a scheduler
+// with in-memory storage and returns the run afterwards.
+func executeTestHttpState(t *testing.T, state *HttpState, input string) (*RunningMachine, bool) {
+	scheduler := newTestScheduler(newMemoryStorage())
+	run := &RunningMachine{Name: "http-test", NextState: state.Name, Input: input, Labels: map[string]string{"env": "test"}}
+	if _, err := scheduler.UpdatePersistedMachine(run); err != nil {
+		t.Fatal(err)
+	}
+
+	success, _ := scheduler.executeHttpState(run, state, time.Now(), runLogFields(run))
+	return run, success
+}
+
+func TestHttpStateResponseStatus(t *testing.T) {
+	testConfig(t)
+
+	var status int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	state := testHttpState(t, ManifestState{
+		Url: server.URL,
+		Response: []HttpStateResponse{
+			{Status: "200", NextState: "done"},
+			{Status: "5xx", NextState: "request", DelaySeconds: 30, StatusMessage: "server error"},
+			{Status: "*", NextState: "other"},
+		},
+	})
+
+	tests := []struct {
+		status    int
+		nextState string
+		message   string
+		delayed   bool
+	}{
+		{200, "done", "GET request of state request returned 200 OK", false},
+		{503, "request", "server error", true},
+		{500, "request", "server error", true},
+		{404, "other", "GET request of state request returned 404 Not Found", false},
+	}
+
+	for _, test := range tests {
+		status = test.status
+		run, success := executeTestHttpState(t, state, "")
+		if !success {
+			t.Errorf("status %d: state failed: %s", test.status, run.StatusMessage)
+			continue
+		}
+
+		if run.LastState != "request" || run.NextState != test.nextState {
+			t.Errorf("status %d: went from %s to %s, expected request to %s", test.status, run.LastState, run.NextState, test.nextState)
+		}
+		if run.StatusMessage != test.message {
+			t.Errorf("status %d: status message %q, expected %q", test.status, run.StatusMessage, test.message)
+		}
+		if delayed := run.NextStateRun.After(time.Now().Add(20 * time.Second)); delayed != test.delayed {
+			t.Errorf("status %d: next state runs at %s", test.status, run.NextStateRun)
+		}
+	}
+}
+
+func TestHttpStateUnmatchedStatus(t *testing.T) {
+	testConfig(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	state := testHttpState(t, ManifestState{
+		Url:      server.URL,
+		Response: []HttpStateResponse{{Status: "2xx", NextState: "done"}},
+	})
+
+	run, success := executeTestHttpState(t, state, "input")
+	if success {
+		t.Fatal("state succeeded without a matching Response")
+	}
+	if run.NextState != "request" || run.Input != "input" {
+		t.Errorf("failed state changed the run to next state %s with input %q", run.NextState, run.Input)
+	}
+	if !strings.Contains(run.StatusMessage, "will keep retrying") || !strings.Contains(run.StatusMessage, "404") {
+		t.Errorf("unexpected status message %q", run.StatusMessage)
+	}
+}
+
+func TestHttpStateRequest(t *testing.T) {
+	testConfig(t)
+
+	var method, path, header, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		method, path, header, body = r.Method, r.URL.RequestURI(), r.Header.Get("X-Run"), string(content)
+	}))
+	defer server.Close()
+
+	response := []HttpStateResponse{{Status: "*", NextState: "done"}}
+	state := testHttpState(t, ManifestState{
+		Method:   "post",
+		Url:      server.URL + "/jobs/{{.Json.job | urlquery}}?env={{.Labels.env}}",
+		Headers:  map[string]string{"X-Run": "{{.Machine}}-{{.Id}}"},
+		Response: response,
+	})
+
+	run, success := executeTestHttpState(t, state, `{"job":"a b"}`)
+	if !success {
+		t.Fatalf("state failed: %s", run.StatusMessage)
+	}
+	if method != "POST" || path != "/jobs/a+b?env=test" || header != "http-test-1" || body != `{"job":"a b"}` {
+		t.Errorf("unexpected request %s %s with X-Run %q and body %q", method, path, header, body)
+	}
+
+	state = testHttpState(t, ManifestState{
+		Method:   "PUT",
+		Url:      server.URL,
+		Body:     `{"input":{{printf "%q" .Input}}}`,
+		Response: response,
+	})
+	if _, success := executeTestHttpState(t, state, "text"); !success || body != `{"input":"text"}` {
+		t.Errorf("unexpected body %q from the Body template", body)
+	}
+}
+
+func TestHttpStateOutput(t *testing.T) {
+	config := testConfig(t)
+	config.BlobThresholdBytes = 16
+
+	var output string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(output))
+	}))
+	defer server.Close()
+
+	keep := testHttpState(t, ManifestState{Url: server.URL, Response: []HttpStateResponse{{Status: "200", NextState: "done"}}})
+	replace := testHttpState(t, ManifestState{Url: server.URL, Response: []HttpStateResponse{{Status: "200", NextState: "done", Output: true}}})
+
+	output = "short"
+	if run, _ := executeTestHttpState(t, keep, "input"); run.Input != "input" || run.InputBlob != "" {
+		t.Errorf("the input was replaced without Output, it is %q", run.Input)
+	}
+
+	if run, _ := executeTestHttpState(t, replace, "input"); run.Input != "short" || run.InputBlob != "" {
+		t.Errorf("the input is %q and blob %q, expected the inline response", run.Input, run.InputBlob)
+	}
+
+	output = strings.Repeat("long output ", 10)
+	run, success := executeTestHttpState(t, replace, "input")
+	if !success || run.Input != "" || run.InputBlob == "" {
+		t.Fatalf("the input is %q and blob %q, expected the response as blob", run.Input, run.InputBlob)
+	}
+
+	payload, err := openPayload(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer payload.Close()
+	if content, _ := ioutil.ReadAll(payload); string(content) != output {
+		t.Errorf("the blob contains %q, expected %q", content, output)
+	}
+}
+
+func TestHttpStateTemplateErrors(t *testing.T) {
+	testConfig(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	response := []HttpStateResponse{{Status: "*", NextState: "done"}}
+	tests := []ManifestState{
+		{Url: server.URL + "/{{.Labels.missing}}", Response: response},
+		{Url: server.URL + "/{{.Json.missing}}", Response: response},
+		{Url: server.URL, Headers: map[string]string{"X-Token": "{{.Secrets.TOKEN}}"}, Response: response},
+	}
+
+	for _, test := range tests {
+		run, success := executeTestHttpState(t, testHttpState(t, test), `{"job":1}`)
+		if success || !strings.Contains(run.StatusMessage, "map has no entry for key") {
+			t.Errorf("missing key in %+v gave status message %q", test, run.StatusMessage)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("%d requests were sent with templates that failed", requests)
+	}
+
+	if _, err := newHttpState(ManifestState{Name: "request", Url: "{{.Id", Response: response}); err == nil {
+		t.Error("a Url template that doesn't parse was accepted")
+	}
+}
+
+func TestHttpStateTimeout(t *testing.T) {
+	testConfig(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	state := testHttpState(t, ManifestState{Url: server.URL, TimeoutSeconds: 1, Response: []HttpStateResponse{{Status: "*", NextState: "done"}}})
+
+	started := time.Now()
+	run, success := executeTestHttpState(t, state, "")
+	if success || !strings.Contains(run.StatusMessage, "deadline exceeded") {
+		t.Errorf("unexpected status message %q after the timeout", run.StatusMessage)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("the request took %s with a timeout of 1s", elapsed)
+	}
+}
+
+func TestHttpStateKill(t *testing.T) {
+	testConfig(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	state := testHttpState(t, ManifestState{Url: server.URL, Response: []HttpStateResponse{{Status: "*", NextState: "done"}}})
+	scheduler := newTestScheduler(newMemoryStorage())
+	run := &RunningMachine{Name: "http-test", NextState: state.Name}
+	scheduler.UpdatePersistedMachine(run)
+
+	done := make(chan bool)
+	go func() {
+		success, _ := scheduler.executeHttpState(run, state, time.Now(), runLogFields(run))
+		done <- success
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for scheduler.ExecutingStates() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the HTTP state isn't counted as executing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	scheduler.KillStates()
+	select {
+	case success := <-done:
+		if success || !strings.Contains(run.StatusMessage, "context canceled") {
+			t.Errorf("unexpected status message %q after KillStates", run.StatusMessage)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("KillStates didn't cancel the HTTP state")
+	}
+
+	if executing := scheduler.ExecutingStates(); executing != 0 {
+		t.Errorf("%d states are still executing", executing)
+	}
+}
+
+func TestHttpStateStatusPatterns(t *testing.T) {
+	for _, pattern := range []string{"200", "404", "5xx", "2XX", "*"} {
+		if !validStatusPattern(pattern) {
+			t.Errorf("valid status pattern %q was rejected", pattern)
+		}
+	}
+
+	for _, pattern := range []string{"", "20", "2000", "600", "x00", "5x", "**", "2x0"} {
+		if validStatusPattern(pattern) {
+			t.Errorf("invalid status pattern %q was accepted", pattern)
+		}
+	}
+}
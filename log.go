@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogFields map[string]interface{}
+
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+type Logger struct {
+	Level  int
+	Format string
+	Output io.Writer
+	Syslog *syslog.Writer
+	lock   sync.Mutex
+}
+
+var globalLogger = &Logger{Level: logLevelInfo, Format: "logfmt", Output: os.Stdout}
+
+var metricPersistenceErrors = newMetric("restatemachine_persistence_errors_total", "counter",
+	"Number of errors persisting run state to the database.", nil)
+
+func parseLogLevel(level string) (int, error) {
+	for idx, name := range logLevelNames {
+		if strings.EqualFold(level, name) {
+			return idx, nil
+		}
+	}
+
+	if strings.EqualFold(level, "warning") {
+		return logLevelWarn, nil
+	}
+
+	return 0, fmt.Errorf("unknown log level %s, expected one of %s", level, strings.Join(logLevelNames, ", "))
+}
+
+// initLogging replaces the default stdout logger with one configured from globalConfig.
+func initLogging() error {
+	logger := &Logger{Level: logLevelInfo, Format: "logfmt", Output: os.Stdout}
+
+	if globalConfig.LogLevel != "" {
+		level, err := parseLogLevel(globalConfig.LogLevel)
+		if err != nil {
+			return err
+		}
+		logger.Level = level
+	}
+
+	switch globalConfig.LogFormat {
+	case "", "logfmt":
+	case "json":
+		logger.Format = "json"
+	default:
+		return fmt.Errorf("unknown log format %s, expected logfmt or json", globalConfig.LogFormat)
+	}
+
+	switch globalConfig.LogDestination {
+	case "", "stdout":
+	case "stderr":
+		logger.Output = os.Stderr
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "restatemachine")
+		if err != nil {
+			return fmt.Errorf("error connecting to syslog: %s", err)
+		}
+		logger.Syslog = writer
+	default:
+		file, err := os.OpenFile(globalConfig.LogDestination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("error opening log file %s: %s", globalConfig.LogDestination, err)
+		}
+		logger.Output = file
+	}
+
+	globalLogger = logger
+	return nil
+}
+
+func logfmtValue(value interface{}) string {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case time.Time:
+		str = v.Format(time.RFC3339Nano)
+	case error:
+		str = v.Error()
+	default:
+		str = fmt.Sprint(v)
+	}
+
+	if str == "" || strings.ContainsAny(str, " =\"\\\t\r\n") {
+		return fmt.Sprintf("%q", str)
+	}
+
+	return str
+}
+
+func (l *Logger) format(level int, fields LogFields, message string) []byte {
+	var buffer bytes.Buffer
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if l.Format == "json" {
+		entry := make(map[string]interface{}, len(fields)+3)
+		for key, value := range fields {
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			entry[key] = value
+		}
+		entry["time"] = time.Now().Format(time.RFC3339Nano)
+		entry["level"] = logLevelNames[level]
+		entry["msg"] = message
+
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			encoded, _ = json.Marshal(map[string]string{"level": logLevelNames[level], "msg": message})
+		}
+		buffer.Write(encoded)
+	} else {
+		if l.Syslog == nil {
+			fmt.Fprintf(&buffer, "time=%s ", time.Now().Format(time.RFC3339Nano))
+		}
+		fmt.Fprintf(&buffer, "level=%s msg=%s", logLevelNames[level], logfmtValue(message))
+		for _, key := range keys {
+			fmt.Fprintf(&buffer, " %s=%s", key, logfmtValue(fields[key]))
+		}
+	}
+
+	buffer.WriteByte('\n')
+	return buffer.Bytes()
+}
+
+func (l *Logger) Log(level int, fields LogFields, format string, args ...interface{}) {
+	if level < l.Level {
+		return
+	}
+
+	line := l.format(level, fields, fmt.Sprintf(format, args...))
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.Syslog != nil {
+		message := string(line)
+		switch level {
+		case logLevelDebug:
+			l.Syslog.Debug(message)
+		case logLevelInfo:
+			l.Syslog.Info(message)
+		case logLevelWarn:
+			l.Syslog.Warning(message)
+		default:
+			l.Syslog.Err(message)
+		}
+		return
+	}
+
+	l.Output.Write(line)
+}
+
+func logDebug(fields LogFields, format string, args ...interface{}) {
+	globalLogger.Log(logLevelDebug, fields, format, args...)
+}
+
+func logInfo(fields LogFields, format string, args ...interface{}) {
+	globalLogger.Log(logLevelInfo, fields, format, args...)
+}
+
+func logWarn(fields LogFields, format string, args ...interface{}) {
+	globalLogger.Log(logLevelWarn, fields, format, args...)
+}
+
+func logError(fields LogFields, format string, args ...interface{}) {
+	globalLogger.Log(logLevelError, fields, format, args...)
+}
+
+// runLogFields returns the fields identifying a run and the state it is about to execute.
+func runLogFields(machine *RunningMachine) LogFields {
+	return LogFields{"run": machine.Id, "machine": machine.Name, "state": machine.NextState}
+}
+
+// logPersistenceError logs and counts an error from persisting run state.
+func logPersistenceError(fields LogFields, err error) {
+	metricPersistenceErrors.Inc()
+	fields["error"] = err
+	logError(fields, "error persisting state machine run")
+}
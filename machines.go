@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 )
 
@@ -13,14 +12,30 @@ type StateMachine struct {
 	Path   string
 	Usage  string
 	States []string
+
+	httpStates map[string]*HttpState `json:"-"` // built-in states declared by the manifest
+}
+
+func (m *StateMachine) hasState(name string) bool {
+	if name == "stop" {
+		return true
+	}
+	for _, state := range m.States {
+		if state == name {
+			return true
+		}
+	}
+
+	return false
 }
 
 var globalStateMachines []StateMachine
+var globalMachinesLoaded bool
 
 func initMachines() {
 	machines, err := ioutil.ReadDir(globalConfig.StateMachinePath)
 	if err != nil {
-		fmt.Printf("error listing StateMachinePath %s directory: %s\n", globalConfig.StateMachinePath, err)
+		logError(LogFields{"path": globalConfig.StateMachinePath, "error": err}, "error listing StateMachinePath directory")
 		os.Exit(1)
 	}
 
@@ -30,7 +45,8 @@ func initMachines() {
 
 		machineInfo, err := os.Stat(machinePath)
 		if err != nil {
-			fmt.Printf("error stat'ing %s: %s\n", machinePath, err)
+			logWarn(LogFields{"path": machinePath, "error": err}, "error stat'ing state machine directory")
+			continue
 		}
 
 		if machineInfo.IsDir() {
@@ -38,38 +54,43 @@ func initMachines() {
 
 			states, err := ioutil.ReadDir(machinePath)
 			if err != nil {
-				fmt.Printf("error listing %s directory: %s\n", machine.Name(), err)
+				logError(LogFields{"machine": machine.Name(), "path": machinePath, "error": err}, "error listing state machine directory")
 				os.Exit(1)
 			}
 
-			hasStart := false
 			for _, stateInfo := range states {
 				if stateInfo.Mode().Perm()&0111 > 0 {
 					machineStruct.States = append(machineStruct.States, stateInfo.Name())
-
-					if stateInfo.Name() == "start" {
-						hasStart = true
-					}
 				}
 			}
 
-			if !hasStart {
-				fmt.Printf("state machine directory for %s has no start state\n", machineStruct.Name)
+			if err := loadManifest(&machineStruct); err != nil {
+				logError(LogFields{"machine": machineStruct.Name, "path": path.Join(machinePath, manifestFile), "error": err}, "error loading state machine manifest")
 				os.Exit(1)
 			}
 
-			cmd := exec.Command(machinePath+"/start", "--help")
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				fmt.Printf("error executing '%s/start --help' to get usage for %s: %s\n", machinePath, machineStruct.Name, err)
+			if !machineStruct.hasState("start") {
+				logError(LogFields{"machine": machineStruct.Name, "path": machinePath}, "state machine directory has no start state")
 				os.Exit(1)
-			} else {
-				machineStruct.Usage = string(output)
+			}
+
+			// The usage of a built-in start state is taken from the manifest
+			if machineStruct.httpStates["start"] == nil {
+				output, err := stateUsage(machineStruct.Name, machinePath)
+				if err != nil {
+					logError(LogFields{"machine": machineStruct.Name, "path": machinePath, "error": err}, "error executing 'start --help' to get usage")
+					os.Exit(1)
+				} else {
+					machineStruct.Usage = string(output)
+				}
 			}
 
 			globalStateMachines = append(globalStateMachines, machineStruct)
+			logInfo(LogFields{"machine": machineStruct.Name, "path": machinePath, "states": len(machineStruct.States)}, "loaded state machine")
 		}
 	}
+
+	globalMachinesLoaded = true
 }
 
 func machineGet(name string) *StateMachine {
@@ -87,16 +108,30 @@ type ExecuteResponse struct {
 	Message string
 }
 
-func machineExecute(name string, input string) (int, string, *ExecuteResponse) {
+func machineExecute(name string, input string, inputBlob string, startedBy string, options RunOptions) (int, string, *ExecuteResponse) {
 	machine := machineGet(name)
 	if machine == nil {
 		return 404, "State machine not found", nil
 	}
 
-	id, err := globalScheduler.ScheduleMachine(name, machine.Path, input)
+	if globalScheduler.IsDraining() {
+		return 503, "restatemachine is draining and doesn't accept new runs", nil
+	}
+
+	id, err := globalScheduler.ScheduleMachine(name, machine.Path, input, inputBlob, startedBy, options)
 	if err != nil {
 		return 500, fmt.Sprintf("Error scheduling execution of %s: %s", name, err), nil
 	} else {
 		return -1, "", &ExecuteResponse{Id: id, Message: fmt.Sprintf("The state machine %s was scheduled for execution successfully.", name)}
 	}
 }
+
+// stateUsage runs "start --help" with the same restrictions as the states.
+func stateUsage(name string, machinePath string) ([]byte, error) {
+	cmd, err := stateCommand(name, machinePath+"/start", nil, "--help")
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd.CombinedOutput()
+}
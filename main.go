@@ -2,70 +2,112 @@ package main
 
 import (
 	"fmt"
-	"github.com/BurntSushi/toml"
-	"github.com/boltdb/bolt"
 	"net/http"
 	"os"
+	"strings"
 )
 
-type Config struct {
-	Username           string
-	Password           string
-	ListenOn           string
-	TLSCertificateFile string
-	TLSKeyFile         string
-	StateMachinePath   string
-	DatabasePath       string
-}
-
 var globalVersionNumber string
-var globalConfig Config
+
+var globalCommands = map[string]func(args []string) int{
+	"config":   commandConfig,
+	"passwd":   commandPasswd,
+	"db":       commandDb,
+	"secrets":  commandSecrets,
+	"machines": commandClient("machines"),
+	"run":      commandClient("run"),
+	"runs":     commandClient("runs"),
+	"status":   commandClient("status"),
+	"cancel":   commandClient("cancel"),
+	"history":  commandClient("history"),
+	"watch":    commandClient("watch"),
+
+	"exec-state": commandExecState,
+}
 
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "--version" {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, ok := globalCommands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %s, see restatemachine -help\n", os.Args[1])
+			os.Exit(2)
+		}
+		os.Exit(command(os.Args[2:]))
+	}
+
+	var flags ConfigFlags
+	flagSet := newConfigFlagSet("restatemachine", &flags)
+	flagSet.Usage = func() { configUsage(flagSet) }
+	if err := flagSet.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	if flags.Version {
 		fmt.Printf("restatemachine %s\n", globalVersionNumber)
 		os.Exit(0)
 	}
 
-	if _, err := toml.DecodeFile("/etc/restatemachine/restatemachine.conf", &globalConfig); err != nil {
-		// without or with invalid config file, we use defaults
-		globalConfig.Username = ""
-		globalConfig.ListenOn = ":80"
-		globalConfig.StateMachinePath = "/etc/restatemachine/statemachines"
-		globalConfig.DatabasePath = "/etc/restatemachine/state.db"
-		globalConfig.TLSCertificateFile = ""
+	config, configErr := loadConfig(&flags)
+	if configErr != nil {
+		logError(LogFields{"error": configErr}, "error loading configuration")
+		os.Exit(1)
+	}
+	globalConfig = config
+
+	if err := initLogging(); err != nil {
+		logError(LogFields{"error": err}, "error configuring logging")
+		os.Exit(1)
+	}
+
+	if err := initAuthentication(); err != nil {
+		logError(LogFields{"error": err}, "error configuring authentication")
+		os.Exit(1)
 	}
 
-	if globalConfig.StateMachinePath == "" {
-		globalConfig.StateMachinePath = "/etc/restatemachine/statemachines"
+	storage, storageErr := openStorage(globalConfig)
+	if storageErr != nil {
+		logError(LogFields{"backend": globalConfig.StorageBackend, "error": storageErr}, "error opening database")
+		os.Exit(1)
 	}
 
-	if globalConfig.DatabasePath == "" {
-		globalConfig.DatabasePath = "/etc/restatemachine/state.db"
+	if initErr := globalScheduler.Init(storage); initErr != nil {
+		logError(LogFields{"storage": storage, "error": initErr}, "error initializing database")
+		os.Exit(1)
+	}
+
+	if err := initSecrets(); err != nil {
+		logError(LogFields{"path": globalConfig.SecretsFile, "error": err}, "error loading secrets")
+		os.Exit(1)
 	}
 
-	db, dbErr := bolt.Open(globalConfig.DatabasePath, 0600, nil)
-	if dbErr != nil {
-		fmt.Printf("error opening database %s: %s\n", globalConfig.DatabasePath, dbErr)
+	if err := initBlobs(); err != nil {
+		logError(LogFields{"path": globalConfig.BlobPath, "error": err}, "error creating blob directory")
+		os.Exit(1)
 	}
 
-	defer db.Close()
+	if err := initWorkspaces(); err != nil {
+		logError(LogFields{"path": globalConfig.WorkspacePath, "error": err}, "error creating workspace directory")
+		os.Exit(1)
+	}
 
-	timerQuitChannel := globalScheduler.Init(db)
-	defer close(timerQuitChannel)
+	if err := initAuditLog(); err != nil {
+		logError(LogFields{"error": err}, "error opening audit log")
+		os.Exit(1)
+	}
 
+	initBackups(storage)
 	initMachines()
 	initApi()
 
-	var listenErr error
-	if globalConfig.TLSCertificateFile != "" && globalConfig.TLSKeyFile != "" {
-		listenErr = http.ListenAndServeTLS(globalConfig.ListenOn, globalConfig.TLSCertificateFile, globalConfig.TLSKeyFile, nil)
-	} else {
-		listenErr = http.ListenAndServe(globalConfig.ListenOn, nil)
-	}
+	logInfo(LogFields{"address": globalConfig.ListenOn, "version": globalVersionNumber}, "restatemachine started")
 
-	if listenErr != nil {
-		fmt.Printf("error listening on %s: %s\n", globalConfig.ListenOn, listenErr)
+	tlsConfig, tlsErr := initTLS()
+	if tlsErr != nil {
+		logError(LogFields{"error": tlsErr}, "error configuring TLS")
 		os.Exit(1)
 	}
+
+	timerQuitChannel := globalScheduler.Start()
+	server := &http.Server{Addr: globalConfig.ListenOn, TLSConfig: tlsConfig}
+	serve(server, tlsConfig != nil, storage, timerQuitChannel)
 }
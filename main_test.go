@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"github.com/emicklei/go-restful"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Helpers shared by the tests. The daemon keeps its state in globals, so
+// the tests that use them don't run in parallel.
+
+func TestMain(m *testing.M) {
+	// States with limits are run through "restatemachine exec-state" by
+	// re-executing the running binary, which is the test binary here
+	if len(os.Args) > 1 && os.Args[1] == "exec-state" {
+		os.Exit(commandExecState(os.Args[2:]))
+	}
+
+	os.Exit(m.Run())
+}
+
+// testConfig sets globalConfig to the defaults with all paths below a
+// temporary directory, and restores the previous config after the test.
+func testConfig(t *testing.T) *Config {
+	dir := t.TempDir()
+	for _, name := range []string{"statemachines", "workspaces", "blobs"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := Config{
+		StateMachinePath: filepath.Join(dir, "statemachines"),
+		DatabasePath:     filepath.Join(dir, "state.db"),
+		WorkspacePath:    filepath.Join(dir, "workspaces"),
+		BlobPath:         filepath.Join(dir, "blobs"),
+	}
+	applyConfigDefaults(&config)
+
+	previous := globalConfig
+	globalConfig = config
+	t.Cleanup(func() { globalConfig = previous })
+
+	return &globalConfig
+}
+
+// newTestScheduler returns a scheduler on storage without the timer that
+// dispatches states, the tests execute states themselves.
+func newTestScheduler(storage Storage) *Scheduler {
+	return &Scheduler{
+		SchedulerLock:   &sync.Mutex{},
+		RunningMachines: make([]*RunningMachine, 0),
+		Storage:         storage,
+		processes:       make(map[uint64]*os.Process),
+		requests:        make(map[uint64]context.CancelFunc),
+	}
+}
+
+var testApiOnce sync.Once
+
+// testApiServer serves the API without authentication. The routes are
+// registered with the default container once per test binary.
+func testApiServer(t *testing.T) *httptest.Server {
+	testApiOnce.Do(func() {
+		if globalScheduler.SchedulerLock == nil {
+			globalScheduler.SchedulerLock = &sync.Mutex{}
+		}
+		initApi()
+	})
+
+	server := httptest.NewServer(restful.DefaultContainer)
+	t.Cleanup(server.Close)
+	return server
+}
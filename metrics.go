@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Minimal implementation of the Prometheus text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type MetricSample struct {
+	LabelValues  []string
+	Value        float64
+	BucketCounts []uint64
+	Count        uint64
+	Sum          float64
+}
+
+type Metric struct {
+	Name       string
+	Help       string
+	Type       string
+	LabelNames []string
+	Buckets    []float64
+
+	lock    sync.Mutex
+	samples map[string]*MetricSample
+}
+
+var globalMetrics []*Metric
+
+var (
+	metricRunsStarted = newMetric("restatemachine_runs_started_total", "counter",
+		"Number of state machine runs started.", nil, "machine")
+	metricRunsFinished = newMetric("restatemachine_runs_finished_total", "counter",
+		"Number of state machine runs that reached the stop state.", nil, "machine")
+	metricRunsCancelled = newMetric("restatemachine_runs_cancelled_total", "counter",
+		"Number of state machine runs cancelled before reaching the stop state.", nil, "machine")
+	metricStateFailures = newMetric("restatemachine_state_failures_total", "counter",
+		"Number of failed state executions, the failed state is retried on the next tick.", nil, "machine", "state")
+	metricStateDuration = newMetric("restatemachine_state_duration_seconds", "histogram",
+		"Duration of state executions.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}, "machine", "state")
+	metricRunsActive = newMetric("restatemachine_runs_active", "gauge",
+		"Number of runs currently executing state code.", nil)
+	metricRunsWaiting = newMetric("restatemachine_runs_waiting", "gauge",
+		"Number of runs waiting for their next state to be executed.", nil)
+	metricSchedulerTickLag = newMetric("restatemachine_scheduler_tick_lag_seconds", "gauge",
+		"Delay between the scheduler timer firing and the tick being handled.", nil)
+	metricWorkerQueueDepth = newMetric("restatemachine_worker_queue_depth", "gauge",
+		"Number of runs whose next state is due but not yet dispatched.", nil)
+	metricWebhookFailures = newMetric("restatemachine_webhook_delivery_failures_total", "counter",
+		"Number of failed webhook deliveries.", nil, "machine")
+	metricBackupLastSuccess = newMetric("restatemachine_backup_last_success_timestamp_seconds", "gauge",
+		"Time of the last successful scheduled database backup.", nil)
+	metricBackupFailures = newMetric("restatemachine_backup_failures_total", "counter",
+		"Number of failed scheduled database backups.", nil)
+)
+
+func newMetric(name string, metricType string, help string, buckets []float64, labelNames ...string) *Metric {
+	metric := &Metric{
+		Name:       name,
+		Help:       help,
+		Type:       metricType,
+		LabelNames: labelNames,
+		Buckets:    buckets,
+		samples:    make(map[string]*MetricSample),
+	}
+
+	globalMetrics = append(globalMetrics, metric)
+	return metric
+}
+
+func (m *Metric) sample(labelValues []string) *MetricSample {
+	if len(labelValues) != len(m.LabelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.Name, len(m.LabelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	sample, ok := m.samples[key]
+	if !ok {
+		sample = &MetricSample{LabelValues: append([]string{}, labelValues...)}
+		if m.Type == "histogram" {
+			sample.BucketCounts = make([]uint64, len(m.Buckets))
+		}
+		m.samples[key] = sample
+	}
+
+	return sample
+}
+
+func (m *Metric) Add(delta float64, labelValues ...string) {
+	m.lock.Lock()
+	m.sample(labelValues).Value += delta
+	m.lock.Unlock()
+}
+
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *Metric) Set(value float64, labelValues ...string) {
+	m.lock.Lock()
+	m.sample(labelValues).Value = value
+	m.lock.Unlock()
+}
+
+func (m *Metric) Observe(value float64, labelValues ...string) {
+	m.lock.Lock()
+	sample := m.sample(labelValues)
+	for idx, upperBound := range m.Buckets {
+		if value <= upperBound {
+			sample.BucketCounts[idx]++
+		}
+	}
+	sample.Count++
+	sample.Sum += value
+	m.lock.Unlock()
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func formatMetricLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(names)+1)
+	for idx, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, replacer.Replace(values[idx])))
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metric) WriteTo(w io.Writer) (int64, error) {
+	var buffer bytes.Buffer
+
+	helpReplacer := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	fmt.Fprintf(&buffer, "# HELP %s %s\n", m.Name, helpReplacer.Replace(m.Help))
+	fmt.Fprintf(&buffer, "# TYPE %s %s\n", m.Name, m.Type)
+
+	m.lock.Lock()
+	keys := make([]string, 0, len(m.samples))
+	for key := range m.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 0 && len(m.LabelNames) == 0 && m.Type != "histogram" {
+		fmt.Fprintf(&buffer, "%s 0\n", m.Name)
+	}
+
+	for _, key := range keys {
+		sample := m.samples[key]
+		if m.Type != "histogram" {
+			fmt.Fprintf(&buffer, "%s%s %s\n", m.Name, formatMetricLabels(m.LabelNames, sample.LabelValues, "", ""), formatMetricValue(sample.Value))
+			continue
+		}
+
+		for idx, upperBound := range m.Buckets {
+			fmt.Fprintf(&buffer, "%s_bucket%s %d\n", m.Name,
+				formatMetricLabels(m.LabelNames, sample.LabelValues, "le", formatMetricValue(upperBound)), sample.BucketCounts[idx])
+		}
+		fmt.Fprintf(&buffer, "%s_bucket%s %d\n", m.Name, formatMetricLabels(m.LabelNames, sample.LabelValues, "le", "+Inf"), sample.Count)
+		fmt.Fprintf(&buffer, "%s_sum%s %s\n", m.Name, formatMetricLabels(m.LabelNames, sample.LabelValues, "", ""), formatMetricValue(sample.Sum))
+		fmt.Fprintf(&buffer, "%s_count%s %d\n", m.Name, formatMetricLabels(m.LabelNames, sample.LabelValues, "", ""), sample.Count)
+	}
+	m.lock.Unlock()
+
+	return buffer.WriteTo(w)
+}
+
+func writeMetrics(w io.Writer) error {
+	globalScheduler.CollectMetrics()
+
+	for _, metric := range globalMetrics {
+		if _, err := metric.WriteTo(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
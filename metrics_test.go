@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	metricCommentLine = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	metricSampleLine  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*",?)*\})? (\S+)$`)
+)
+
+// scrapeMetrics fetches /metrics and checks that every line is valid in the
+// text exposition format, it returns the samples by name and labels.
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET /metrics returned %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", contentType)
+	}
+
+	types := make(map[string]string)
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := metricCommentLine.FindStringSubmatch(line); match != nil {
+			if match[1] == "TYPE" {
+				if _, ok := types[match[2]]; ok {
+					t.Errorf("metric %s has more than one TYPE line", match[2])
+				}
+				types[match[2]] = match[3]
+			}
+			continue
+		}
+
+		match := metricSampleLine.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("invalid line %q", line)
+			continue
+		}
+
+		name := match[1]
+		if types[name] == "" {
+			base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+			if types[base] != "histogram" {
+				t.Errorf("sample %q precedes the TYPE of its metric", line)
+			}
+		}
+
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			t.Errorf("invalid value in %q", line)
+		}
+		samples[name+match[2]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, metric := range globalMetrics {
+		if types[metric.Name] != metric.Type {
+			t.Errorf("metric %s has TYPE %q, expected %q", metric.Name, types[metric.Name], metric.Type)
+		}
+	}
+
+	return samples
+}
+
+func TestMetricsExposition(t *testing.T) {
+	testConfig(t)
+	server := testApiServer(t)
+
+	// The metrics are global, so the samples are compared with those before
+	// the test in case it runs more than once
+	before := scrapeMetrics(t, server.URL)
+
+	metricRunsStarted.Inc("metrics-test")
+	metricRunsStarted.Inc("metrics-test")
+	metricRunsCancelled.Inc("metrics-test")
+	metricStateFailures.Inc("metrics-test", "start")
+	metricStateDuration.Observe(0.3, "metrics-test", "start")
+	metricStateDuration.Observe(7, "metrics-test", "start")
+
+	samples := scrapeMetrics(t, server.URL)
+
+	expected := map[string]float64{
+		`restatemachine_runs_started_total{machine="metrics-test"}`:                                    2,
+		`restatemachine_runs_cancelled_total{machine="metrics-test"}`:                                  1,
+		`restatemachine_state_failures_total{machine="metrics-test",state="start"}`:                    1,
+		`restatemachine_state_duration_seconds_bucket{machine="metrics-test",state="start",le="0.25"}`: 0,
+		`restatemachine_state_duration_seconds_bucket{machine="metrics-test",state="start",le="0.5"}`:  1,
+		`restatemachine_state_duration_seconds_bucket{machine="metrics-test",state="start",le="10"}`:   2,
+		`restatemachine_state_duration_seconds_bucket{machine="metrics-test",state="start",le="+Inf"}`: 2,
+		`restatemachine_state_duration_seconds_sum{machine="metrics-test",state="start"}`:              7.3,
+		`restatemachine_state_duration_seconds_count{machine="metrics-test",state="start"}`:            2,
+		`restatemachine_runs_waiting`: 0,
+	}
+	for sample, value := range expected {
+		if got, ok := samples[sample]; !ok {
+			t.Errorf("sample %s is missing", sample)
+		} else if math.Abs(got-before[sample]-value) > 1e-9 {
+			t.Errorf("sample %s increased by %g, expected %g", sample, got-before[sample], value)
+		}
+	}
+}
+
+func TestMetricLabelEscaping(t *testing.T) {
+	labels := formatMetricLabels([]string{"machine"}, []string{"a\"b\\c\nd"}, "", "")
+	if expected := `{machine="a\"b\\c\nd"}`; labels != expected {
+		t.Errorf("labels are %s, expected %s", labels, expected)
+	}
+}
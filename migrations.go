@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"strconv"
+	"time"
+)
+
+// Migration upgrades the database from schema version Version-1 to Version.
+// Migrations run in order at startup, each in its own transaction together
+// with the update of the stored schema version.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(tx *bolt.Tx) error
+}
+
+var migrations = []Migration{
+	{1, "create run buckets", func(tx *bolt.Tx) error {
+		return createBuckets(tx, "RunningMachines", "MachineRuns")
+	}},
+	{2, "create token, audit log and run history buckets", func(tx *bolt.Tx) error {
+		return createBuckets(tx, "ApiTokens", "AuditLog", "RunHistory")
+	}},
+	{3, "rewrite runs in the current record format", migrateRewriteRuns},
+}
+
+// QuarantinedRecord is a record that could not be decoded. It is moved out of
+// its bucket so that the rest of the database stays usable.
+type QuarantinedRecord struct {
+	Bucket string
+	Key    string
+	Value  []byte
+	Error  string
+	Time   time.Time
+}
+
+func currentSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func createBuckets(tx *bolt.Tx, names ...string) error {
+	for _, name := range names {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return fmt.Errorf("create bucket %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// schemaVersion returns the schema version stored in the Metadata bucket.
+// Databases created before versioning have no version and count as 0.
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	metadataBucket := tx.Bucket([]byte("Metadata"))
+	if metadataBucket == nil {
+		return 0, nil
+	}
+
+	versionValue := metadataBucket.Get([]byte("SchemaVersion"))
+	if versionValue == nil {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(string(versionValue))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %s", versionValue, err)
+	}
+
+	return version, nil
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	metadataBucket, err := tx.CreateBucketIfNotExists([]byte("Metadata"))
+	if err != nil {
+		return fmt.Errorf("create bucket Metadata: %s", err)
+	}
+
+	return metadataBucket.Put([]byte("SchemaVersion"), []byte(strconv.Itoa(version)))
+}
+
+// migrateDatabase brings the database up to the current schema version. A
+// database written by a newer version is refused rather than misread.
+func migrateDatabase(db *bolt.DB) error {
+	var version int
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if version > currentSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, currentSchemaVersion())
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		logInfo(LogFields{"version": migration.Version, "migration": migration.Description}, "migrating database")
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := migration.Migrate(tx); err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, migration.Version)
+		})
+
+		if err != nil {
+			return fmt.Errorf("migration to schema version %d (%s) failed: %s", migration.Version, migration.Description, err)
+		}
+	}
+
+	return nil
+}
+
+// quarantineRecord moves a record that can't be decoded into the
+// QuarantinedRecords bucket, keyed by its original bucket and key.
+func quarantineRecord(tx *bolt.Tx, bucketName string, key []byte, decodeErr error) error {
+	bucket := tx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return fmt.Errorf("error getting database bucket")
+	}
+
+	quarantineBucket, err := tx.CreateBucketIfNotExists([]byte("QuarantinedRecords"))
+	if err != nil {
+		return fmt.Errorf("create bucket QuarantinedRecords: %s", err)
+	}
+
+	record := QuarantinedRecord{
+		Bucket: bucketName,
+		Key:    string(key),
+		Value:  append([]byte{}, bucket.Get(key)...),
+		Error:  decodeErr.Error(),
+		Time:   time.Now(),
+	}
+
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error serializing quarantined record: %s", err)
+	}
+
+	if err := quarantineBucket.Put([]byte(bucketName+"/"+string(key)), recordJson); err != nil {
+		return err
+	}
+
+	logError(LogFields{"bucket": bucketName, "key": string(key), "error": decodeErr}, "quarantined undecodable database record")
+	return bucket.Delete(key)
+}
+
+// migrateRewriteRuns decodes every run and writes it back, so that records
+// from older versions carry all current fields. Records that can't be decoded
+// are quarantined together with their RunningMachines entry.
+func migrateRewriteRuns(tx *bolt.Tx) error {
+	runningBucket := tx.Bucket([]byte("RunningMachines"))
+	runsBucket := tx.Bucket([]byte("MachineRuns"))
+	if runningBucket == nil || runsBucket == nil {
+		return fmt.Errorf("error getting database bucket")
+	}
+
+	var keys [][]byte
+	runsBucket.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+
+	for _, k := range keys {
+		var machine RunningMachine
+		if err := json.Unmarshal(runsBucket.Get(k), &machine); err != nil {
+			if runningBucket.Get(k) != nil {
+				if err := runningBucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			if err := quarantineRecord(tx, "MachineRuns", k, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		machineJson, err := json.Marshal(machine)
+		if err != nil {
+			return fmt.Errorf("error serializing machine as json for persisting: %s", err)
+		}
+
+		if err := runsBucket.Put(k, machineJson); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
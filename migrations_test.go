@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// openTestBolt opens an empty bolt database without migrating it.
+func openTestBolt(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func storedSchemaVersion(t *testing.T, db *bolt.DB) int {
+	var version int
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrateDatabaseOrder(t *testing.T) {
+	testConfig(t)
+	db := openTestBolt(t)
+
+	var applied []int
+	migration := func(version int) Migration {
+		return Migration{version, fmt.Sprintf("migration %d", version), func(tx *bolt.Tx) error {
+			applied = append(applied, version)
+			if version == 4 {
+				return fmt.Errorf("failed")
+			}
+			return nil
+		}}
+	}
+
+	previous := migrations
+	t.Cleanup(func() { migrations = previous })
+	migrations = []Migration{migration(1), migration(2), migration(3)}
+
+	db.Update(func(tx *bolt.Tx) error { return setSchemaVersion(tx, 1) })
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, []int{2, 3}) || storedSchemaVersion(t, db) != 3 {
+		t.Errorf("migrations %v were applied up to version %d, expected 2 and 3", applied, storedSchemaVersion(t, db))
+	}
+
+	// A failed migration leaves the version of the last successful one
+	applied = nil
+	migrations = append(migrations, migration(4), migration(5))
+	if err := migrateDatabase(db); err == nil || !strings.Contains(err.Error(), "schema version 4") {
+		t.Errorf("failed migration returned %v", err)
+	}
+	if !reflect.DeepEqual(applied, []int{4}) || storedSchemaVersion(t, db) != 3 {
+		t.Errorf("migrations %v were applied up to version %d after a failure", applied, storedSchemaVersion(t, db))
+	}
+}
+
+func TestMigrateDatabaseNewerSchema(t *testing.T) {
+	testConfig(t)
+	db := openTestBolt(t)
+
+	newer := currentSchemaVersion() + 1
+	db.Update(func(tx *bolt.Tx) error { return setSchemaVersion(tx, newer) })
+
+	if err := migrateDatabase(db); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("database with a newer schema returned %v", err)
+	}
+	if version := storedSchemaVersion(t, db); version != newer {
+		t.Errorf("schema version changed to %d", version)
+	}
+}
+
+func TestMigrateDatabaseQuarantine(t *testing.T) {
+	testConfig(t)
+	db := openTestBolt(t)
+
+	run, _ := json.Marshal(RunningMachine{Id: 1, Name: "valid", NextState: "start"})
+	err := db.Update(func(tx *bolt.Tx) error {
+		running, _ := tx.CreateBucket([]byte("RunningMachines"))
+		runs, _ := tx.CreateBucket([]byte("MachineRuns"))
+		for key, value := range map[string]string{"1": string(run), "2": "{not json"} {
+			runs.Put([]byte(key), []byte(value))
+			running.Put([]byte(key), []byte{})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"RunningMachines", "MachineRuns"} {
+			if tx.Bucket([]byte(bucket)).Get([]byte("1")) == nil {
+				t.Errorf("valid run was removed from %s", bucket)
+			}
+			if tx.Bucket([]byte(bucket)).Get([]byte("2")) != nil {
+				t.Errorf("undecodable run is still in %s", bucket)
+			}
+		}
+
+		var record QuarantinedRecord
+		if err := json.Unmarshal(tx.Bucket([]byte("QuarantinedRecords")).Get([]byte("MachineRuns/2")), &record); err != nil {
+			return err
+		}
+		if record.Bucket != "MachineRuns" || record.Key != "2" || string(record.Value) != "{not json" || record.Error == "" {
+			t.Errorf("quarantined record is %+v", record)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &BoltStorage{DB: db}
+	if active, err := storage.ActiveRuns(); err != nil || !reflect.DeepEqual(runIds(active), []uint64{1}) {
+		t.Errorf("active runs after quarantine are %v, error %v", runIds(active), err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Password hashes in the formats produced by htpasswd (-m for $apr1$, -s for
+// {SHA}) and crypt(3) SHA-256/SHA-512 ($5$/$6$, as produced by htpasswd -2/-5,
+// mkpasswd -m sha-512 or openssl passwd -6) and bcrypt ($2a$/$2b$/$2y$, as
+// produced by htpasswd -B).
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const shaCryptDefaultRounds = 5000
+
+func cryptEncode(buffer *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		buffer.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+
+	alt := md5.Sum([]byte(password + salt + password))
+	for remaining := len(password); remaining > 0; remaining -= 16 {
+		if remaining > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:remaining])
+		}
+	}
+
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(password))
+		}
+		final = round.Sum(nil)
+	}
+
+	var encoded strings.Builder
+	encoded.WriteString(magic + salt + "$")
+	cryptEncode(&encoded, final[0], final[6], final[12], 4)
+	cryptEncode(&encoded, final[1], final[7], final[13], 4)
+	cryptEncode(&encoded, final[2], final[8], final[14], 4)
+	cryptEncode(&encoded, final[3], final[9], final[15], 4)
+	cryptEncode(&encoded, final[4], final[10], final[5], 4)
+	cryptEncode(&encoded, 0, 0, final[11], 2)
+
+	return encoded.String()
+}
+
+func repeatToLength(block []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		remaining := length - len(result)
+		if remaining > len(block) {
+			remaining = len(block)
+		}
+		result = append(result, block[:remaining]...)
+	}
+	return result
+}
+
+// shaCrypt implements the SHA-256 and SHA-512 based crypt(3) algorithms
+// specified at https://www.akkadia.org/drepper/SHA-crypt.txt. rounds= is part
+// of the result if explicitRounds is set or rounds isn't the default.
+func shaCrypt(prefix string, password string, salt string, rounds int, explicitRounds bool) string {
+	var newHash func() hash.Hash
+	if prefix == "$5$" {
+		newHash = sha256.New
+	} else {
+		newHash = sha512.New
+	}
+
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	pw := []byte(password)
+	saltBytes := []byte(salt)
+
+	ctxB := newHash()
+	ctxB.Write(pw)
+	ctxB.Write(saltBytes)
+	ctxB.Write(pw)
+	b := ctxB.Sum(nil)
+
+	ctxA := newHash()
+	ctxA.Write(pw)
+	ctxA.Write(saltBytes)
+	ctxA.Write(repeatToLength(b, len(pw)))
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctxA.Write(b)
+		} else {
+			ctxA.Write(pw)
+		}
+	}
+	a := ctxA.Sum(nil)
+
+	ctxDP := newHash()
+	for i := 0; i < len(pw); i++ {
+		ctxDP.Write(pw)
+	}
+	p := repeatToLength(ctxDP.Sum(nil), len(pw))
+
+	ctxDS := newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		ctxDS.Write(saltBytes)
+	}
+	s := repeatToLength(ctxDS.Sum(nil), len(saltBytes))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		ctxC := newHash()
+		if i&1 == 1 {
+			ctxC.Write(p)
+		} else {
+			ctxC.Write(c)
+		}
+		if i%3 != 0 {
+			ctxC.Write(s)
+		}
+		if i%7 != 0 {
+			ctxC.Write(p)
+		}
+		if i&1 == 1 {
+			ctxC.Write(c)
+		} else {
+			ctxC.Write(p)
+		}
+		c = ctxC.Sum(nil)
+	}
+
+	var encoded strings.Builder
+	encoded.WriteString(prefix)
+	if explicitRounds || rounds != shaCryptDefaultRounds {
+		encoded.WriteString(fmt.Sprintf("rounds=%d$", rounds))
+	}
+	encoded.WriteString(salt + "$")
+
+	if prefix == "$5$" {
+		for i := 0; i < 10; i++ {
+			cryptEncode(&encoded, c[(i*21)%30], c[(i*21+10)%30], c[(i*21+20)%30], 4)
+		}
+		cryptEncode(&encoded, 0, c[31], c[30], 3)
+	} else {
+		for i := 0; i < 21; i++ {
+			cryptEncode(&encoded, c[(i*22)%63], c[(i*22+21)%63], c[(i*22+42)%63], 4)
+		}
+		cryptEncode(&encoded, 0, 0, c[63], 2)
+	}
+
+	return encoded.String()
+}
+
+// parseShaCrypt returns the parameters of a $5$ or $6$ hash, explicitRounds
+// is set if the hash contains rounds=, even if it is the default.
+func parseShaCrypt(hashed string) (prefix string, salt string, rounds int, explicitRounds bool, err error) {
+	prefix = hashed[:3]
+	rest := hashed[3:]
+	rounds = shaCryptDefaultRounds
+
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.Index(rest, "$")
+		if end < 0 {
+			return "", "", 0, false, fmt.Errorf("malformed rounds in password hash")
+		}
+		rounds, err = strconv.Atoi(rest[len("rounds="):end])
+		if err != nil || rounds < 1000 || rounds > 999999999 {
+			return "", "", 0, false, fmt.Errorf("invalid rounds in password hash")
+		}
+		explicitRounds = true
+		rest = rest[end+1:]
+	}
+
+	end := strings.Index(rest, "$")
+	if end < 0 {
+		return "", "", 0, false, fmt.Errorf("malformed salt in password hash")
+	}
+
+	return prefix, rest[:end], rounds, explicitRounds, nil
+}
+
+func isBcryptHash(hashed string) bool {
+	return strings.HasPrefix(hashed, "$2a$") || strings.HasPrefix(hashed, "$2b$") || strings.HasPrefix(hashed, "$2y$")
+}
+
+// checkPasswordHashFormat returns an error if hashed isn't in a supported format.
+func checkPasswordHashFormat(hashed string) error {
+	switch {
+	case strings.HasPrefix(hashed, "$apr1$"):
+		if strings.Count(hashed, "$") != 3 {
+			return fmt.Errorf("malformed $apr1$ password hash")
+		}
+		return nil
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		_, _, _, _, err := parseShaCrypt(hashed)
+		return err
+	case strings.HasPrefix(hashed, "{SHA}"):
+		return nil
+	case isBcryptHash(hashed):
+		if _, err := bcrypt.Cost([]byte(hashed)); err != nil {
+			return fmt.Errorf("malformed bcrypt password hash: %s", err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown password hash format, expected $apr1$, $5$, $6$, $2a$, $2b$, $2y$ or {SHA}")
+}
+
+// passwordMatches verifies password against hashed in constant time with respect
+// to the password content.
+func passwordMatches(hashed string, password string) bool {
+	var computed string
+
+	switch {
+	case strings.HasPrefix(hashed, "$apr1$"):
+		salt := strings.SplitN(hashed[len("$apr1$"):], "$", 2)[0]
+		computed = apr1Crypt(password, salt)
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		prefix, salt, rounds, explicitRounds, err := parseShaCrypt(hashed)
+		if err != nil {
+			return false
+		}
+		computed = shaCrypt(prefix, password, salt, rounds, explicitRounds)
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case isBcryptHash(hashed):
+		// bcrypt compares in constant time itself
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
+
+func hashPassword(password string) (string, error) {
+	saltBytes := make([]byte, 16)
+	if _, err := rand.Read(saltBytes); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, len(saltBytes))
+	for idx, b := range saltBytes {
+		salt[idx] = cryptAlphabet[b&0x3f]
+	}
+
+	return shaCrypt("$6$", password, string(salt), shaCryptDefaultRounds, false), nil
+}
+
+// commandPasswd implements "restatemachine passwd", which reads a password from
+// stdin and prints a hash suitable for the users file.
+func commandPasswd(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "usage: restatemachine passwd < password\n")
+		return 2
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Fprintf(os.Stderr, "error reading password from stdin: %s\n", err)
+		return 1
+	}
+
+	hashed, err := hashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error hashing password: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(hashed)
+	return 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The $5$ and $6$ vectors are from the SHA-crypt specification, the others
+// were produced by openssl passwd and crypt(3).
+var passwordTestVectors = []struct {
+	hashed   string
+	password string
+}{
+	{"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret"},
+	{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+	{"$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5", "This is just a test"},
+	{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+	{"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0", "This is just a test"},
+	{"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", "Hello world!"},
+	{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"},
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+}
+
+func TestPasswordMatches(t *testing.T) {
+	for _, vector := range passwordTestVectors {
+		if err := checkPasswordHashFormat(vector.hashed); err != nil {
+			t.Errorf("%s was rejected: %s", vector.hashed, err)
+		}
+		if !passwordMatches(vector.hashed, vector.password) {
+			t.Errorf("%s doesn't match %q", vector.hashed, vector.password)
+		}
+		if passwordMatches(vector.hashed, vector.password+"x") {
+			t.Errorf("%s matches a wrong password", vector.hashed)
+		}
+	}
+}
+
+func TestPasswordHashFormat(t *testing.T) {
+	invalid := []string{
+		"",
+		"plaintext",
+		"$apr1$salt",
+		"$6$rounds=999$salt$hash",
+		"$6$rounds=x$salt$hash",
+		"$6$salt",
+		"$2b$05$short",
+		"$1$salt$hash",
+	}
+
+	for _, hashed := range invalid {
+		if err := checkPasswordHashFormat(hashed); err == nil {
+			t.Errorf("%q was accepted", hashed)
+		}
+		if passwordMatches(hashed, "") {
+			t.Errorf("%q matches the empty password", hashed)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hashed, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(hashed, "$6$") || strings.Contains(hashed, "rounds=") {
+		t.Errorf("unexpected hash %s", hashed)
+	}
+	if !passwordMatches(hashed, "secret") || passwordMatches(hashed, "other") {
+		t.Errorf("%s doesn't verify", hashed)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// rlimitNproc is RLIMIT_NPROC on Linux, which the syscall package doesn't
+// define.
+const rlimitNproc = 6
+
+// MachineConfig restricts the processes a state machine's states run as. It
+// is configured with a [[Machine]] table in the config file, machines without
+// one run with the daemon's credentials and environment.
+type MachineConfig struct {
+	Name                 string
+	User                 string
+	Group                string
+	WorkingDirectory     string
+	Umask                string
+	LimitCPUSeconds      int
+	LimitAddressSpaceMB  int
+	LimitOpenFiles       int
+	LimitProcesses       int
+	ClearEnvironment     bool
+	EnvironmentAllowlist []string
+	Secrets              []string
+}
+
+// StateLimits are the settings that can't be applied through SysProcAttr, so
+// they are passed to "restatemachine exec-state" which applies them and then
+// executes the state.
+type StateLimits struct {
+	Umask               string
+	LimitCPUSeconds     int
+	LimitAddressSpaceMB int
+	LimitOpenFiles      int
+	LimitProcesses      int
+}
+
+func machineConfig(name string) *MachineConfig {
+	for idx := range globalConfig.Machine {
+		if globalConfig.Machine[idx].Name == name {
+			return &globalConfig.Machine[idx]
+		}
+	}
+
+	return nil
+}
+
+func (c *MachineConfig) limits() StateLimits {
+	return StateLimits{
+		Umask:               c.Umask,
+		LimitCPUSeconds:     c.LimitCPUSeconds,
+		LimitAddressSpaceMB: c.LimitAddressSpaceMB,
+		LimitOpenFiles:      c.LimitOpenFiles,
+		LimitProcesses:      c.LimitProcesses,
+	}
+}
+
+func (l StateLimits) isSet() bool {
+	return l != StateLimits{}
+}
+
+func (l StateLimits) args() []string {
+	var args []string
+	if l.Umask != "" {
+		args = append(args, "-umask", l.Umask)
+	}
+	if l.LimitCPUSeconds > 0 {
+		args = append(args, "-cpu", strconv.Itoa(l.LimitCPUSeconds))
+	}
+	if l.LimitAddressSpaceMB > 0 {
+		args = append(args, "-as", strconv.Itoa(l.LimitAddressSpaceMB))
+	}
+	if l.LimitOpenFiles > 0 {
+		args = append(args, "-nofile", strconv.Itoa(l.LimitOpenFiles))
+	}
+	if l.LimitProcesses > 0 {
+		args = append(args, "-nproc", strconv.Itoa(l.LimitProcesses))
+	}
+
+	return args
+}
+
+// credential resolves User and Group to the credential the states run with,
+// or returns nil if neither is set. Setting only Group keeps the daemon's uid.
+func (c *MachineConfig) credential() (*syscall.Credential, error) {
+	if c.User == "" && c.Group == "" {
+		return nil, nil
+	}
+
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if c.User != "" {
+		u, err := lookupUser(c.User)
+		if err != nil {
+			return nil, err
+		}
+
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		credential.Uid = uint32(uid)
+		credential.Gid = uint32(gid)
+
+		groupIds, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("error listing groups of user %s: %s", c.User, err)
+		}
+		for _, groupId := range groupIds {
+			if id, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(id))
+			}
+		}
+	}
+
+	if c.Group != "" {
+		g, err := lookupGroup(c.Group)
+		if err != nil {
+			return nil, err
+		}
+
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		credential.Gid = uint32(gid)
+	}
+
+	return credential, nil
+}
+
+// lookupUser accepts a user name or a numeric uid.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupId(name)
+	}
+
+	return user.Lookup(name)
+}
+
+// lookupGroup accepts a group name or a numeric gid.
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupGroupId(name)
+	}
+
+	return user.LookupGroup(name)
+}
+
+// environment returns the environment for the states. An allowlist implies
+// ClearEnvironment.
+func (c *MachineConfig) environment() []string {
+	if !c.ClearEnvironment && len(c.EnvironmentAllowlist) == 0 {
+		return os.Environ()
+	}
+
+	env := make([]string, 0)
+	for _, name := range c.EnvironmentAllowlist {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	return env
+}
+
+// stateCommand builds the command that executes a state of machine with the
+// restrictions from its [[Machine]] config, env is added to the environment.
+// The state always runs in its own process group so that it can be killed
+// together with its children.
+func stateCommand(machine string, statePath string, env []string, args ...string) (*exec.Cmd, error) {
+	config := machineConfig(machine)
+	if config == nil {
+		cmd := exec.Command(statePath, args...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		return cmd, nil
+	}
+
+	credential, err := config.credential()
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	if limits := config.limits(); limits.isSet() {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("error finding the restatemachine executable: %s", err)
+		}
+
+		helperArgs := append([]string{"exec-state"}, limits.args()...)
+		helperArgs = append(append(helperArgs, "--", statePath), args...)
+		cmd = exec.Command(executable, helperArgs...)
+	} else {
+		cmd = exec.Command(statePath, args...)
+	}
+
+	cmd.Dir = config.WorkingDirectory
+	cmd.Env = append(config.environment(), env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: credential}
+	return cmd, nil
+}
+
+func parseUmask(umask string) (int, error) {
+	value, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("invalid umask %q, expected an octal value like 022", umask)
+	}
+
+	return int(value), nil
+}
+
+func validateMachineConfig(config *Config) []string {
+	var errors []string
+	seen := make(map[string]bool)
+
+	for idx, machine := range config.Machine {
+		if machine.Name == "" {
+			errors = append(errors, fmt.Sprintf("Machine #%d has no Name", idx+1))
+			continue
+		}
+
+		if seen[machine.Name] {
+			errors = append(errors, fmt.Sprintf("Machine %s is configured more than once", machine.Name))
+		}
+		seen[machine.Name] = true
+
+		if machine.User != "" {
+			if _, err := lookupUser(machine.User); err != nil {
+				errors = append(errors, fmt.Sprintf("Machine %s: User: %s", machine.Name, err))
+			}
+		}
+
+		if machine.Group != "" {
+			if _, err := lookupGroup(machine.Group); err != nil {
+				errors = append(errors, fmt.Sprintf("Machine %s: Group: %s", machine.Name, err))
+			}
+		}
+
+		if machine.WorkingDirectory != "" {
+			if info, err := os.Stat(machine.WorkingDirectory); err != nil {
+				errors = append(errors, fmt.Sprintf("Machine %s: WorkingDirectory: %s", machine.Name, err))
+			} else if !info.IsDir() {
+				errors = append(errors, fmt.Sprintf("Machine %s: WorkingDirectory: %s is not a directory", machine.Name, machine.WorkingDirectory))
+			}
+		}
+
+		if machine.Umask != "" {
+			if _, err := parseUmask(machine.Umask); err != nil {
+				errors = append(errors, fmt.Sprintf("Machine %s: Umask: %s", machine.Name, err))
+			}
+		}
+
+		if machine.LimitCPUSeconds < 0 || machine.LimitAddressSpaceMB < 0 || machine.LimitOpenFiles < 0 || machine.LimitProcesses < 0 {
+			errors = append(errors, fmt.Sprintf("Machine %s: limits must not be negative", machine.Name))
+		}
+	}
+
+	return errors
+}
+
+// commandExecState implements the internal "restatemachine exec-state"
+// command. It runs with the credentials of the state already applied, sets
+// the umask and resource limits and then replaces itself with the state
+// executable. Errors are written to stderr where the scheduler reports them as
+// the state's status.
+func commandExecState(args []string) int {
+	var limits StateLimits
+	flagSet := flag.NewFlagSet("restatemachine exec-state", flag.ContinueOnError)
+	flagSet.StringVar(&limits.Umask, "umask", "", "octal umask")
+	flagSet.IntVar(&limits.LimitCPUSeconds, "cpu", 0, "CPU time limit in seconds")
+	flagSet.IntVar(&limits.LimitAddressSpaceMB, "as", 0, "address space limit in MB")
+	flagSet.IntVar(&limits.LimitOpenFiles, "nofile", 0, "open files limit")
+	flagSet.IntVar(&limits.LimitProcesses, "nproc", 0, "processes limit")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "usage: restatemachine exec-state [flags] -- <state> [args]\n")
+		return 2
+	}
+
+	// The arguments of execve are prepared before the limits are applied, as
+	// the Go runtime can fail to allocate memory under a low address space
+	// limit, which syscall.Exec would need to do
+	argv0, err := syscall.BytePtrFromString(flagSet.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error executing state %s: %s\n", flagSet.Arg(0), err)
+		return 127
+	}
+	argv, err := syscall.SlicePtrFromStrings(flagSet.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error executing state %s: %s\n", flagSet.Arg(0), err)
+		return 127
+	}
+	envv, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error executing state %s: %s\n", flagSet.Arg(0), err)
+		return 127
+	}
+
+	if err := applyStateLimits(limits); err != nil {
+		fmt.Fprintf(os.Stderr, "error applying limits for state %s: %s\n", flagSet.Arg(0), err)
+		return 126
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(argv0)),
+		uintptr(unsafe.Pointer(&argv[0])), uintptr(unsafe.Pointer(&envv[0])))
+	fmt.Fprintf(os.Stderr, "error executing state %s: %s\n", flagSet.Arg(0), errno)
+	return 127
+}
+
+func applyStateLimits(limits StateLimits) error {
+	if limits.Umask != "" {
+		umask, err := parseUmask(limits.Umask)
+		if err != nil {
+			return err
+		}
+		syscall.Umask(umask)
+	}
+
+	rlimits := []struct {
+		name     string
+		resource int
+		value    uint64
+	}{
+		{"cpu", syscall.RLIMIT_CPU, uint64(limits.LimitCPUSeconds)},
+		{"address space", syscall.RLIMIT_AS, uint64(limits.LimitAddressSpaceMB) * 1024 * 1024},
+		{"open files", syscall.RLIMIT_NOFILE, uint64(limits.LimitOpenFiles)},
+		{"processes", rlimitNproc, uint64(limits.LimitProcesses)},
+	}
+
+	for _, rlimit := range rlimits {
+		if rlimit.value == 0 {
+			continue
+		}
+
+		limit := syscall.Rlimit{Cur: rlimit.value, Max: rlimit.value}
+		if err := syscall.Setrlimit(rlimit.resource, &limit); err != nil {
+			return fmt.Errorf("error setting %s limit to %d: %s", rlimit.name, rlimit.value, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sandboxTestState prints what the sandbox applied to it as name=value lines.
+const sandboxTestState = `#!/bin/sh
+echo "umask=$(umask)"
+echo "keep=${RESTATEMACHINE_TEST_KEEP-unset}"
+echo "drop=${RESTATEMACHINE_TEST_DROP-unset}"
+echo "extra=${RESTATEMACHINE_TEST_EXTRA-unset}"
+echo "path=${PATH-unset}"
+echo "uid=$(id -u)"
+echo "gid=$(id -g)"
+while read -r line; do
+	echo "limit $line"
+done < /proc/self/limits
+`
+
+// runSandboxTestState runs the test state of machine as the scheduler does
+// and returns what it printed.
+func runSandboxTestState(t *testing.T, machine string) map[string]string {
+	// The state may run as another user, so it must be readable by everyone
+	dir, err := ioutil.TempDir("", "restatemachine-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	statePath := filepath.Join(dir, "start")
+	if err := ioutil.WriteFile(statePath, []byte(sandboxTestState), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := stateCommand(machine, statePath, []string{"RESTATEMACHINE_TEST_EXTRA=extra"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error executing state: %s, output was: %s", err, output)
+	}
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "limit Max ") {
+			// e.g. "Max open files 64 64 files", the soft limit follows the name
+			fields := strings.Fields(strings.TrimPrefix(line, "limit Max "))
+			for idx, field := range fields {
+				if _, err := strconv.Atoi(field); err == nil || field == "unlimited" {
+					values["limit "+strings.Join(fields[:idx], " ")] = field
+					break
+				}
+			}
+		} else if idx := strings.Index(line, "="); idx != -1 {
+			values[line[:idx]] = line[idx+1:]
+		}
+	}
+
+	return values
+}
+
+func TestSandboxWithoutConfig(t *testing.T) {
+	testConfig(t)
+	t.Setenv("RESTATEMACHINE_TEST_KEEP", "keep")
+
+	values := runSandboxTestState(t, "unconfigured")
+	if values["keep"] != "keep" || values["extra"] != "extra" || values["path"] == "unset" {
+		t.Errorf("state didn't get the daemon's environment: %v", values)
+	}
+	if values["uid"] != strconv.Itoa(os.Getuid()) {
+		t.Errorf("state ran as uid %s", values["uid"])
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	config := testConfig(t)
+	config.Machine = []MachineConfig{{
+		Name:                "limited",
+		Umask:               "027",
+		LimitCPUSeconds:     30,
+		LimitAddressSpaceMB: 1024,
+		LimitOpenFiles:      64,
+		LimitProcesses:      512,
+	}}
+
+	values := runSandboxTestState(t, "limited")
+	if umask, err := strconv.ParseUint(values["umask"], 8, 32); err != nil || umask != 027 {
+		t.Errorf("umask is %s, expected 027", values["umask"])
+	}
+
+	limits := map[string]string{
+		"cpu time":      "30",
+		"address space": strconv.Itoa(1024 * 1024 * 1024),
+		"open files":    "64",
+		"processes":     "512",
+	}
+	for name, expected := range limits {
+		if value := values["limit "+name]; value != expected {
+			t.Errorf("%s limit is %q, expected %s", name, value, expected)
+		}
+	}
+}
+
+func TestSandboxEnvironment(t *testing.T) {
+	config := testConfig(t)
+	config.Machine = []MachineConfig{
+		{Name: "cleared", ClearEnvironment: true},
+		{Name: "allowlisted", EnvironmentAllowlist: []string{"RESTATEMACHINE_TEST_KEEP", "RESTATEMACHINE_TEST_MISSING"}},
+	}
+	t.Setenv("RESTATEMACHINE_TEST_KEEP", "keep")
+	t.Setenv("RESTATEMACHINE_TEST_DROP", "drop")
+
+	values := runSandboxTestState(t, "cleared")
+	if values["keep"] != "unset" || values["drop"] != "unset" {
+		t.Errorf("cleared environment contains the daemon's variables: %v", values)
+	}
+	if values["extra"] != "extra" {
+		t.Errorf("cleared environment lacks the variables of the state: %v", values)
+	}
+
+	values = runSandboxTestState(t, "allowlisted")
+	if values["keep"] != "keep" || values["drop"] != "unset" || values["extra"] != "extra" {
+		t.Errorf("allowlisted environment is wrong: %v", values)
+	}
+}
+
+func TestSandboxCredentials(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the user of states requires running the tests as root")
+	}
+
+	nobody, err := lookupUser("nobody")
+	if err != nil {
+		t.Skip("no user nobody to run the state as")
+	}
+	group, err := lookupGroup(nobody.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(t)
+	config.Machine = []MachineConfig{
+		{Name: "user", User: "nobody"},
+		{Name: "group", Group: group.Gid},
+	}
+
+	values := runSandboxTestState(t, "user")
+	if values["uid"] != nobody.Uid || values["gid"] != nobody.Gid {
+		t.Errorf("state ran as %s:%s, expected nobody %s:%s", values["uid"], values["gid"], nobody.Uid, nobody.Gid)
+	}
+
+	values = runSandboxTestState(t, "group")
+	if values["uid"] != "0" || values["gid"] != group.Gid {
+		t.Errorf("state ran as %s:%s, expected 0:%s", values["uid"], values["gid"], group.Gid)
+	}
+}
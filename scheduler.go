@@ -2,14 +2,16 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"github.com/boltdb/bolt"
+	"io"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,17 +20,38 @@ type RunningMachine struct {
 	Name             string
 	Path             string
 	Input            string
+	InputBlob        string
 	LastState        string
 	NextState        string
 	StatusMessage    string
 	RunningStateCode bool
 	NextStateRun     time.Time
+	StateStarted     time.Time
+	StartedBy        string
+	CancelledBy      string
+	Labels           map[string]string
+	CallbackUrl      string
+	Paused           bool
+}
+
+// RunOptions are the optional settings of a new run. A StartAt in the future
+// delays the start state until then.
+type RunOptions struct {
+	Labels      map[string]string
+	StartAt     time.Time
+	CallbackUrl string
 }
 
 type Scheduler struct {
 	SchedulerLock   *sync.Mutex
 	RunningMachines []*RunningMachine
-	Database        *bolt.DB
+	Storage         Storage
+	LastTick        int64 // unix nanoseconds of the last handled tick, accessed atomically
+	Draining        int32 // set while no new runs are accepted and no states dispatched, accessed atomically
+
+	executing sync.WaitGroup
+	processes map[uint64]*os.Process        // state code being executed, by run id, protected by SchedulerLock
+	requests  map[uint64]context.CancelFunc // HTTP states being executed, by run id, protected by SchedulerLock
 }
 
 var globalScheduler Scheduler
@@ -42,80 +65,42 @@ func (s *Scheduler) GetRunningMachines() *[]*RunningMachine {
 }
 
 func (s *Scheduler) GetMachineRun(id string) (*RunningMachine, error) {
-	var machine RunningMachine
-
-	returnErr := s.Database.View(func(tx *bolt.Tx) error {
-		runsBucket := tx.Bucket([]byte("MachineRuns"))
-		if runsBucket == nil {
-			return fmt.Errorf("error getting database bucket")
-		}
-
-		machineJson := runsBucket.Get([]byte(id))
-		if machineJson == nil {
-			return fmt.Errorf("no running state machine with id %s found", id)
-		}
-
-		err := json.Unmarshal(machineJson, &machine)
-		if err != nil {
-			return fmt.Errorf("error deserializing machine run from persisted db: %s", err)
-		}
-
-		return nil
-	})
-
-	if returnErr != nil {
-		return nil, returnErr
-	} else {
-		return &machine, nil
+	runId, err := parseRunId(id)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (s *Scheduler) UpdatePersistedMachine(machine *RunningMachine) (id uint64, returnErr error) {
-	returnErr = s.Database.Update(func(tx *bolt.Tx) error {
-		runningBucket := tx.Bucket([]byte("RunningMachines"))
-		runsBucket := tx.Bucket([]byte("MachineRuns"))
-		if runningBucket == nil || runsBucket == nil {
-			return fmt.Errorf("error getting database bucket")
-		}
-
-		if machine.Id == 0 {
-			var seqErr error
-			id, seqErr = runsBucket.NextSequence()
-			if seqErr != nil {
-				return fmt.Errorf("error getting next value in MachineRuns sequence: %s", seqErr)
-			}
-			machine.Id = id
-		} else {
-			id = machine.Id
-		}
-
-		machineJson, err := json.Marshal(machine)
-		if err != nil {
-			return fmt.Errorf("error serializing machine as json for persisting: %s", err)
-		}
+	return s.Storage.GetRun(runId)
+}
 
-		idKey := []byte(fmt.Sprintf("%d", id))
-		err = runsBucket.Put(idKey, machineJson)
-		if err != nil {
-			return fmt.Errorf("error persisting machine run: %s", err)
-		}
+// UpdatePersistedMachine stores machine, assigning it an id first if it is new.
+// Existing runs are only stored while they are active so that a run finished
+// in the meantime isn't made active again, the caller must hold SchedulerLock.
+func (s *Scheduler) UpdatePersistedMachine(machine *RunningMachine) (uint64, error) {
+	if machine.Id == 0 {
+		err := s.Storage.CreateRun(machine)
+		return machine.Id, err
+	}
 
-		err = runningBucket.Put(idKey, nil)
-		if err != nil {
-			return fmt.Errorf("error persisting machine run: %s", err)
+	for _, running := range s.RunningMachines {
+		if running == machine {
+			return machine.Id, s.Storage.UpdateRun(machine)
 		}
+	}
 
-		return nil
-	})
-
-	return
+	return machine.Id, RunNotActiveError{Id: fmt.Sprintf("%d", machine.Id)}
 }
 
-func (s *Scheduler) ScheduleMachine(name string, path string, input string) (id uint64, returnErr error) {
-	machine := RunningMachine{Id: 0, Name: name, Path: path, Input: input, NextState: "start", RunningStateCode: false, NextStateRun: time.Time{}}
+func (s *Scheduler) ScheduleMachine(name string, path string, input string, inputBlob string, startedBy string, options RunOptions) (id uint64, returnErr error) {
+	machine := RunningMachine{Id: 0, Name: name, Path: path, Input: input, InputBlob: inputBlob, NextState: "start", RunningStateCode: false,
+		NextStateRun: options.StartAt, StartedBy: startedBy, Labels: options.Labels, CallbackUrl: options.CallbackUrl}
 	id, returnErr = s.UpdatePersistedMachine(&machine)
 	if returnErr == nil {
 		s.AddMachine(&machine)
+		metricRunsStarted.Inc(name)
+		logFields := runLogFields(&machine)
+		logFields["user"] = startedBy
+		logInfo(logFields, "state machine run scheduled")
 	}
 
 	return
@@ -127,109 +112,340 @@ func (s *Scheduler) AddMachine(machine *RunningMachine) {
 	s.SchedulerLock.Unlock()
 }
 
-func (s *Scheduler) CancelMachineRun(id string) error {
-	return s.Database.Update(func(tx *bolt.Tx) error {
-		s.SchedulerLock.Lock()
+// RunNotActiveError is returned when cancelling a run that has already stopped.
+type RunNotActiveError struct {
+	Id string
+}
 
-		machineIdx := -1
-		var machine *RunningMachine
-		var idx int
-		for idx, machine = range s.RunningMachines {
-			if fmt.Sprintf("%d", machine.Id) == id {
-				machineIdx = idx
-				break
-			}
-		}
+func (e RunNotActiveError) Error() string {
+	return fmt.Sprintf("state machine run with id %s is not currently active", e.Id)
+}
 
-		if machineIdx == -1 {
-			s.SchedulerLock.Unlock()
-			return fmt.Errorf("state machine run with id %s is not currently active", id)
-		} else {
-			// Delete from in-memory representation right away so that we can drop lock
-			s.RunningMachines = append(s.RunningMachines[:machineIdx], s.RunningMachines[machineIdx+1:]...)
-			s.SchedulerLock.Unlock()
-		}
+// RunExecutingError is returned when changing a run while one of its states is
+// executing, ExecuteState owns the run until the state finishes.
+type RunExecutingError struct {
+	Id string
+}
 
-		runningBucket := tx.Bucket([]byte("RunningMachines"))
-		runsBucket := tx.Bucket([]byte("MachineRuns"))
-		if runningBucket == nil || runsBucket == nil {
-			return fmt.Errorf("error getting database bucket")
+func (e RunExecutingError) Error() string {
+	return fmt.Sprintf("state machine run with id %s is executing a state, try again once it finishes", e.Id)
+}
+
+// CancelMachineRun removes a run from the active set, cancelledBy is recorded on
+// the run if it hadn't already reached the stop state. Runs that are executing a
+// state can't be cancelled, ExecuteState owns them until the state finishes.
+func (s *Scheduler) CancelMachineRun(id string, cancelledBy string) error {
+	s.SchedulerLock.Lock()
+
+	machineIdx := -1
+	var machine *RunningMachine
+	var idx int
+	for idx, machine = range s.RunningMachines {
+		if fmt.Sprintf("%d", machine.Id) == id {
+			machineIdx = idx
+			break
 		}
+	}
 
-		err := runningBucket.Delete([]byte(id))
-		if err != nil {
+	if machineIdx == -1 {
+		s.SchedulerLock.Unlock()
+		if _, err := s.GetMachineRun(id); err != nil {
 			return err
 		}
+		return RunNotActiveError{Id: id}
+	} else if machine.RunningStateCode {
+		s.SchedulerLock.Unlock()
+		return RunExecutingError{Id: id}
+	}
 
-		if machine.NextState != "stop" {
-			machine.StatusMessage = "State machine run cancelled manually"
-			machine.NextState = "stop"
-			machine.RunningStateCode = false
+	var historyEntry *HistoryEntry
+	if machine.NextState != "stop" {
+		logFields := runLogFields(machine)
+		logFields["user"] = cancelledBy
+		logInfo(logFields, "state machine run cancelled manually")
+		machine.StatusMessage = "State machine run cancelled manually by " + cancelledBy
+		machine.CancelledBy = cancelledBy
+		machine.NextState = "stop"
+		metricRunsCancelled.Inc(machine.Name)
+
+		historyEntry = &HistoryEntry{Time: time.Now(), NextState: "stop", StatusMessage: machine.StatusMessage, Success: true}
+	}
 
-			machineJson, jsonErr := json.Marshal(machine)
-			if jsonErr != nil {
-				return fmt.Errorf("error serializing machine as json for persisting: %s", err)
-			}
+	// Delete from in-memory representation right away so that we can drop lock
+	s.RunningMachines = append(s.RunningMachines[:machineIdx], s.RunningMachines[machineIdx+1:]...)
+	s.SchedulerLock.Unlock()
+
+	if err := s.Storage.FinishRun(machine, historyEntry); err != nil {
+		return err
+	}
+
+	finishWorkspace(machine.Id)
+	notifyCallback(machine)
+	return nil
+}
 
-			runsBucket.Put([]byte(id), machineJson)
+// changeMachineRun applies change to the active run with the given id and
+// persists it. The change is recorded in the history of the run as message.
+// Runs that are executing a state can't be changed.
+func (s *Scheduler) changeMachineRun(id string, message string, change func(machine *RunningMachine)) (*RunningMachine, error) {
+	s.SchedulerLock.Lock()
+
+	var machine *RunningMachine
+	for _, running := range s.RunningMachines {
+		if fmt.Sprintf("%d", running.Id) == id && running.NextState != "stop" {
+			machine = running
+			break
+		}
+	}
+
+	if machine == nil {
+		s.SchedulerLock.Unlock()
+		if _, err := s.GetMachineRun(id); err != nil {
+			return nil, err
 		}
+		return nil, RunNotActiveError{Id: id}
+	} else if machine.RunningStateCode {
+		s.SchedulerLock.Unlock()
+		return nil, RunExecutingError{Id: id}
+	}
 
-		return nil
+	change(machine)
+	_, err := s.UpdatePersistedMachine(machine)
+	run := *machine
+	s.SchedulerLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	historyEntry := HistoryEntry{Time: time.Now(), NextState: run.NextState, NextStateRun: run.NextStateRun, StatusMessage: message, Success: true}
+	if err := s.Storage.AppendHistory(run.Id, historyEntry); err != nil {
+		logPersistenceError(runLogFields(&run), err)
+	}
+
+	return &run, nil
+}
+
+// PauseMachineRun keeps the scheduler from executing further states of a run
+// until it is resumed.
+func (s *Scheduler) PauseMachineRun(id string, pausedBy string) (*RunningMachine, error) {
+	run, err := s.changeMachineRun(id, "State machine run paused by "+pausedBy, func(machine *RunningMachine) {
+		machine.Paused = true
 	})
+	if err == nil {
+		logFields := runLogFields(run)
+		logFields["user"] = pausedBy
+		logInfo(logFields, "state machine run paused")
+	}
+
+	return run, err
+}
+
+func (s *Scheduler) ResumeMachineRun(id string, resumedBy string) (*RunningMachine, error) {
+	run, err := s.changeMachineRun(id, "State machine run resumed by "+resumedBy, func(machine *RunningMachine) {
+		machine.Paused = false
+	})
+	if err == nil {
+		logFields := runLogFields(run)
+		logFields["user"] = resumedBy
+		logInfo(logFields, "state machine run resumed")
+	}
+
+	return run, err
+}
+
+// RetryMachineRun resumes a run and executes its next state on the next tick
+// instead of waiting for NextStateRun, e.g. to retry a failing state right away.
+func (s *Scheduler) RetryMachineRun(id string, retriedBy string) (*RunningMachine, error) {
+	run, err := s.changeMachineRun(id, "Next state retried by "+retriedBy, func(machine *RunningMachine) {
+		machine.Paused = false
+		machine.NextStateRun = time.Time{}
+	})
+	if err == nil {
+		logFields := runLogFields(run)
+		logFields["user"] = retriedBy
+		logInfo(logFields, "state machine run retried")
+	}
+
+	return run, err
 }
 
 func (s *Scheduler) ExecuteState(machine *RunningMachine) {
+	defer s.executing.Done()
+
+	executedState := machine.NextState
+	logFields := runLogFields(machine)
+	logDebug(logFields, "executing state")
+
+	startTime := time.Now()
+	var success bool
+	var duration float64
+	if state := machineHttpState(machine.Name, machine.NextState); state != nil {
+		success, duration = s.executeHttpState(machine, state, startTime, logFields)
+	} else {
+		success, duration = s.executeStateCode(machine, startTime, logFields)
+	}
+
+	// The run is handed back under the lock, from here on it can be changed
+	// by changeMachineRun so only the copy is used
+	s.SchedulerLock.Lock()
+	machine.StatusMessage = redactSecrets(machine.StatusMessage)
+	machine.RunningStateCode = false
+	if _, err := s.UpdatePersistedMachine(machine); err != nil {
+		logPersistenceError(runLogFields(machine), err)
+	}
+	run := *machine
+	s.SchedulerLock.Unlock()
+
+	historyEntry := HistoryEntry{
+		Time:          startTime,
+		State:         executedState,
+		NextState:     run.NextState,
+		NextStateRun:  run.NextStateRun,
+		StatusMessage: run.StatusMessage,
+		Duration:      duration,
+		Success:       success,
+	}
+	if err := s.Storage.AppendHistory(run.Id, historyEntry); err != nil {
+		logPersistenceError(runLogFields(&run), err)
+	}
+
+	if run.NextState == "stop" {
+		metricRunsFinished.Inc(run.Name)
+		logInfo(runLogFields(&run), "state machine run finished")
+		if err := s.CancelMachineRun(fmt.Sprintf("%d", run.Id), ""); err != nil {
+			logPersistenceError(runLogFields(&run), err)
+		}
+	}
+}
+
+// executeStateCode runs the executable of the next state of machine and
+// applies its result to machine.
+func (s *Scheduler) executeStateCode(machine *RunningMachine, startTime time.Time, logFields LogFields) (success bool, duration float64) {
 	cmdPath := machine.Path + "/" + machine.NextState
-	cmd := exec.Command(cmdPath)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	cmd.Stdin = strings.NewReader(machine.Input)
-	err := cmd.Run()
+	stdout := newPayloadWriter(int64(globalConfig.MaxOutputBytes))
+	defer stdout.Discard()
+	var stderr bytes.Buffer
+
+	workspace, err := prepareWorkspace(machine)
+	var secretsEnv []string
+	if err == nil {
+		secretsEnv, err = secretsEnvironment(machine.Name)
+	}
+	var cmd *exec.Cmd
+	if err == nil {
+		cmd, err = stateCommand(machine.Name, cmdPath, append([]string{workspaceEnv + "=" + workspace}, secretsEnv...))
+	}
+	var stdin io.ReadCloser
+	if err == nil {
+		stdin, err = openPayload(machine)
+	}
+	if err == nil {
+		defer stdin.Close()
+		cmd.Stdout = stdout
+		cmd.Stderr = &stderr
+		cmd.Stdin = stdin
+		err = cmd.Start()
+	}
+	if err == nil {
+		s.SchedulerLock.Lock()
+		s.processes[machine.Id] = cmd.Process
+		s.SchedulerLock.Unlock()
+
+		err = cmd.Wait()
+
+		s.SchedulerLock.Lock()
+		delete(s.processes, machine.Id)
+		s.SchedulerLock.Unlock()
+	}
+	duration = observeStateDuration(machine, startTime, logFields)
 
 	if err != nil {
 		machine.StatusMessage = fmt.Sprintf("error executing state code at %s (will keep retrying): %s", cmdPath, err)
+		metricStateFailures.Inc(machine.Name, machine.NextState)
+		logFields["error"] = err
+		logWarn(logFields, "error executing state code, will keep retrying")
 	} else {
 		stderrStr := string(stderr.Bytes())
 		stderrLines := strings.Split(stderrStr, "\n")
 		if len(stderrLines) < 3 {
 			machine.StatusMessage = fmt.Sprintf("state code at %s didn't return at least 3 lines correctly at stderr (will keep retrying), stderr was: %s",
 				cmdPath, stderrStr)
+			metricStateFailures.Inc(machine.Name, machine.NextState)
+			logFields["stderr"] = redactSecrets(stderrStr)
+			logWarn(logFields, "state code didn't return at least 3 lines on stderr, will keep retrying")
+		} else if input, inputBlob, outputErr := stdout.Finish(); outputErr != nil {
+			machine.StatusMessage = fmt.Sprintf("error storing output of state code at %s (will keep retrying): %s", cmdPath, outputErr)
+			metricStateFailures.Inc(machine.Name, machine.NextState)
+			logFields["error"] = outputErr
+			logWarn(logFields, "error storing state output, will keep retrying")
 		} else {
-			machine.LastState = machine.NextState
-			machine.NextState = strings.TrimSpace(stderrLines[0])
-
 			numSeconds, intConvertError := strconv.Atoi(strings.TrimSpace(stderrLines[1]))
-			if intConvertError != nil || numSeconds <= 0 {
-				machine.NextStateRun = time.Time{}
-			} else {
-				machine.NextStateRun = time.Now().Add(time.Duration(numSeconds) * time.Second)
+			if intConvertError != nil {
+				numSeconds = 0
 			}
 
-			machine.Input = string(stdout.Bytes())
-			machine.StatusMessage = strings.TrimSpace(stderrLines[2])
+			machine.Input = input
+			machine.InputBlob = inputBlob
+			applyStateResult(machine, strings.TrimSpace(stderrLines[0]), numSeconds, strings.TrimSpace(stderrLines[2]))
+
+			success = true
+			logFields["next_state"] = machine.NextState
+			logFields["status"] = machine.StatusMessage
+			logInfo(logFields, "state executed")
 		}
 	}
 
-	machine.RunningStateCode = false
+	return success, duration
+}
 
-	s.UpdatePersistedMachine(machine)
+func observeStateDuration(machine *RunningMachine, startTime time.Time, logFields LogFields) float64 {
+	duration := time.Since(startTime).Seconds()
+	metricStateDuration.Observe(duration, machine.Name, machine.NextState)
+	logFields["duration"] = duration
+	return duration
+}
+
+// applyStateResult moves machine on to nextState after delaySeconds, or right
+// away if delaySeconds isn't positive.
+func applyStateResult(machine *RunningMachine, nextState string, delaySeconds int, statusMessage string) {
+	machine.LastState = machine.NextState
+	machine.NextState = nextState
 
-	if machine.NextState == "stop" {
-		s.CancelMachineRun(fmt.Sprintf("%d", machine.Id))
+	if delaySeconds <= 0 {
+		machine.NextStateRun = time.Time{}
+	} else {
+		machine.NextStateRun = time.Now().Add(time.Duration(delaySeconds) * time.Second)
 	}
+
+	machine.StatusMessage = redactSecrets(statusMessage)
 }
 
 func (s *Scheduler) HandleTick() {
-	s.SchedulerLock.Lock()
-
 	currentTime := time.Now()
+	atomic.StoreInt64(&s.LastTick, currentTime.UnixNano())
+
+	if s.IsDraining() {
+		return
+	}
+
+	s.SchedulerLock.Lock()
 
 	for idx, machine := range s.RunningMachines {
-		if !machine.RunningStateCode && machine.NextState != "stop" && machine.NextStateRun.Before(currentTime) {
+		// SetDraining takes the lock, so once it returns no state is dispatched
+		// that WaitForStates doesn't wait for
+		if s.IsDraining() {
+			break
+		}
+
+		if !machine.RunningStateCode && !machine.Paused && machine.NextState != "stop" && machine.NextStateRun.Before(currentTime) {
 			var machinePtr *RunningMachine = s.RunningMachines[idx]
 			machinePtr.RunningStateCode = true
-			s.UpdatePersistedMachine(machinePtr)
+			machinePtr.StateStarted = currentTime
+			if _, err := s.UpdatePersistedMachine(machinePtr); err != nil {
+				logPersistenceError(runLogFields(machinePtr), err)
+			}
+			s.executing.Add(1)
 			go s.ExecuteState(machinePtr)
 		}
 	}
@@ -237,10 +453,117 @@ func (s *Scheduler) HandleTick() {
 	s.SchedulerLock.Unlock()
 }
 
+// SetDraining enters or leaves drain mode. While draining no new runs are
+// accepted and no new states are dispatched, states already executing finish.
+// It waits for a tick that is dispatching states to finish doing so.
+func (s *Scheduler) SetDraining(draining bool) {
+	s.SchedulerLock.Lock()
+	defer s.SchedulerLock.Unlock()
+
+	if draining {
+		atomic.StoreInt32(&s.Draining, 1)
+	} else {
+		atomic.StoreInt32(&s.Draining, 0)
+	}
+}
+
+func (s *Scheduler) IsDraining() bool {
+	return atomic.LoadInt32(&s.Draining) == 1
+}
+
+func (s *Scheduler) ExecutingStates() int {
+	s.SchedulerLock.Lock()
+	defer s.SchedulerLock.Unlock()
+
+	return len(s.processes) + len(s.requests)
+}
+
+// WaitForStates waits up to timeout for executing states to finish and
+// returns whether they all did.
+func (s *Scheduler) WaitForStates(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.executing.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// KillStates kills the state code still executing and cancels the HTTP states.
+// The runs record the failure like any other and retry the state when the
+// daemon runs again.
+func (s *Scheduler) KillStates() {
+	s.SchedulerLock.Lock()
+	defer s.SchedulerLock.Unlock()
+
+	for id, process := range s.processes {
+		logWarn(LogFields{"run": id, "pid": process.Pid}, "killing state code that didn't finish within the shutdown grace period")
+		syscall.Kill(-process.Pid, syscall.SIGKILL)
+	}
+
+	for id, cancel := range s.requests {
+		logWarn(LogFields{"run": id}, "cancelling HTTP state that didn't finish within the shutdown grace period")
+		cancel()
+	}
+}
+
+// GetStuckRuns returns the ids of runs that have been executing state code for longer
+// than threshold. It gives up if the scheduler lock can't be acquired within a second,
+// so that a deadlocked scheduler can be reported instead of blocking the caller.
+func (s *Scheduler) GetStuckRuns(threshold time.Duration) (stuck []uint64, acquired bool) {
+	deadline := time.Now().Add(1 * time.Second)
+	for !s.SchedulerLock.TryLock() {
+		if time.Now().After(deadline) {
+			return nil, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	currentTime := time.Now()
+	for _, machine := range s.RunningMachines {
+		if machine.RunningStateCode && currentTime.Sub(machine.StateStarted) > threshold {
+			stuck = append(stuck, machine.Id)
+		}
+	}
+
+	s.SchedulerLock.Unlock()
+	return stuck, true
+}
+
+func (s *Scheduler) CollectMetrics() {
+	s.SchedulerLock.Lock()
+
+	currentTime := time.Now()
+	active, waiting, due := 0, 0, 0
+	for _, machine := range s.RunningMachines {
+		if machine.RunningStateCode {
+			active++
+		} else if machine.NextState != "stop" {
+			waiting++
+			if !machine.Paused && machine.NextStateRun.Before(currentTime) {
+				due++
+			}
+		}
+	}
+
+	s.SchedulerLock.Unlock()
+
+	metricRunsActive.Set(float64(active))
+	metricRunsWaiting.Set(float64(waiting))
+	metricWorkerQueueDepth.Set(float64(due))
+}
+
 func (s *Scheduler) SchedulerTick(ticker *time.Ticker, quitChannel chan struct{}) {
 	for {
 		select {
-		case <-ticker.C:
+		case tickTime := <-ticker.C:
+			metricSchedulerTickLag.Set(time.Since(tickTime).Seconds())
 			s.HandleTick()
 		case <-quitChannel:
 			ticker.Stop()
@@ -249,47 +572,35 @@ func (s *Scheduler) SchedulerTick(ticker *time.Ticker, quitChannel chan struct{}
 	}
 }
 
-func (s *Scheduler) Init(db *bolt.DB) chan struct{} {
+func (s *Scheduler) Init(storage Storage) error {
 	s.SchedulerLock = &sync.Mutex{}
-	s.Database = db
+	s.Storage = storage
 	s.RunningMachines = make([]*RunningMachine, 0, 0)
+	s.processes = make(map[uint64]*os.Process)
+	s.requests = make(map[uint64]context.CancelFunc)
 
-	// Initialize database
-	dbInitErr := db.Update(func(tx *bolt.Tx) error {
-		runningBucket, err := tx.CreateBucketIfNotExists([]byte("RunningMachines"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
-		}
-
-		var runsBucket *bolt.Bucket
-		runsBucket, err = tx.CreateBucketIfNotExists([]byte("MachineRuns"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
-		}
-
-		c := runningBucket.Cursor()
-
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			machineJson := runsBucket.Get(k)
-
-			var machine RunningMachine
-			err := json.Unmarshal(machineJson, &machine)
-			if err != nil {
-				return fmt.Errorf("error deserializing currently running machine from persisted db: %s", err)
-			}
+	// Resume the runs that were active when the daemon stopped
+	runs, err := storage.ActiveRuns()
+	if err != nil {
+		return fmt.Errorf("error loading active runs: %s", err)
+	}
 
-			s.AddMachine(&machine)
+	for _, machine := range runs {
+		// The daemon stopped while the state code was executing, it is
+		// executed again since its result was never recorded.
+		if machine.RunningStateCode {
+			logWarn(runLogFields(machine), "state was executing when the daemon stopped, it will be executed again")
+			machine.RunningStateCode = false
 		}
-
-		return nil
-	})
-
-	if dbInitErr != nil {
-		fmt.Printf("error initializing database: %s\n", dbInitErr)
-		os.Exit(1)
+		s.AddMachine(machine)
 	}
 
-	// Setup the timer that powers the scheduler
+	return nil
+}
+
+// Start starts the timer that powers the scheduler, it must be called after
+// everything the states depend on has been initialized.
+func (s *Scheduler) Start() chan struct{} {
 	ticker := time.NewTicker(1 * time.Second)
 	stopSchedulerChannel := make(chan struct{})
 	go s.SchedulerTick(ticker, stopSchedulerChannel)
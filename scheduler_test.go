@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCancelExecutingRun(t *testing.T) {
+	testConfig(t)
+
+	scheduler := newTestScheduler(newMemoryStorage())
+	id, err := scheduler.ScheduleMachine("cancel-test", "/machines/cancel-test", "", "", "alice", RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := scheduler.RunningMachines[0]
+
+	run.RunningStateCode = true
+	if err := scheduler.CancelMachineRun("1", "alice"); !reflect.DeepEqual(err, RunExecutingError{Id: "1"}) {
+		t.Fatalf("cancelling an executing run returned %v", err)
+	}
+	if len(scheduler.RunningMachines) != 1 || run.NextState != "start" || run.CancelledBy != "" {
+		t.Errorf("refused cancel changed the run to %+v", run)
+	}
+
+	run.RunningStateCode = false
+	if err := scheduler.CancelMachineRun("1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := scheduler.Storage.GetRun(id); err != nil || stored.CancelledBy != "alice" || stored.NextState != "stop" {
+		t.Errorf("cancelled run is stored as %+v, error %v", stored, err)
+	}
+
+	// A state finishing after the run was cancelled doesn't make it active again
+	run.NextState = "next"
+	if _, err := scheduler.UpdatePersistedMachine(run); !reflect.DeepEqual(err, RunNotActiveError{Id: "1"}) {
+		t.Errorf("updating a cancelled run returned %v", err)
+	}
+	if active, err := scheduler.Storage.ActiveRuns(); err != nil || len(active) != 0 {
+		t.Errorf("active runs after cancelling are %v, error %v", runIds(active), err)
+	}
+	if stored, err := scheduler.Storage.GetRun(id); err != nil || stored.NextState != "stop" {
+		t.Errorf("cancelled run was overwritten with %+v, error %v", stored, err)
+	}
+}
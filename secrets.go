@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretsRedacted replaces secret values in status messages, history and API
+// output.
+const secretsRedacted = "********"
+
+// secretsMinRedactLength is the shortest value that is redacted, replacing
+// shorter values would mangle unrelated text.
+const secretsMinRedactLength = 4
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SecretsFileContents is the on-disk format of SecretsFile. Data is the JSON
+// encoded map of secret names to values, sealed with AES-256-GCM using the
+// master key from SecretsKeyFile.
+type SecretsFileContents struct {
+	Version int
+	Nonce   []byte
+	Data    []byte
+}
+
+// SecretStore reads the secrets file, reloading it when it changes so that
+// secrets can be managed with "restatemachine secrets" while the daemon runs.
+type SecretStore struct {
+	Path    string
+	key     []byte
+	lock    sync.Mutex
+	modTime time.Time
+	secrets map[string]string
+}
+
+var globalSecrets *SecretStore
+
+func loadSecretsKey(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain a hex encoded 32 byte key, generate one with \"restatemachine secrets genkey\"", path)
+	}
+
+	return key, nil
+}
+
+func newSecretStore(path string, keyPath string) (*SecretStore, error) {
+	key, err := loadSecretsKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &SecretStore{Path: path, key: key}
+	if _, err := store.Secrets(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Secrets returns all secrets. A missing secrets file holds no secrets.
+func (s *SecretStore) Secrets() (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(s.Path)
+	if os.IsNotExist(err) {
+		s.secrets = make(map[string]string)
+		return s.secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if s.secrets != nil && info.ModTime().Equal(s.modTime) {
+		return s.secrets, nil
+	}
+
+	secrets, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	s.secrets = secrets
+	s.modTime = info.ModTime()
+	return secrets, nil
+}
+
+func (s *SecretStore) read() (map[string]string, error) {
+	raw, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents SecretsFileContents
+	if err := json.Unmarshal(raw, &contents); err != nil {
+		return nil, fmt.Errorf("error parsing secrets file %s: %s", s.Path, err)
+	}
+
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, contents.Nonce, contents.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting secrets file %s, is SecretsKeyFile the right key? %s", s.Path, err)
+	}
+
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("error parsing decrypted secrets file %s: %s", s.Path, err)
+	}
+
+	return secrets, nil
+}
+
+// write encrypts secrets and replaces the secrets file with them.
+func (s *SecretStore) write(secrets map[string]string) error {
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(SecretsFileContents{Version: 1, Nonce: nonce, Data: gcm.Seal(nil, nonce, plaintext, nil)})
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), s.Path)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// machineSecrets returns the secrets machine references by name.
+func machineSecrets(machine string) (map[string]string, error) {
+	config := machineConfig(machine)
+	if config == nil || len(config.Secrets) == 0 {
+		return nil, nil
+	}
+
+	if globalSecrets == nil {
+		return nil, fmt.Errorf("machine %s references secrets but no SecretsFile is configured", machine)
+	}
+
+	secrets, err := globalSecrets.Secrets()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]string, len(config.Secrets))
+	for _, name := range config.Secrets {
+		value, ok := secrets[name]
+		if !ok {
+			return nil, fmt.Errorf("secret %s referenced by machine %s doesn't exist", name, machine)
+		}
+		referenced[name] = value
+	}
+
+	return referenced, nil
+}
+
+// secretsEnvironment returns the secrets machine references as environment
+// variables named after the secrets.
+func secretsEnvironment(machine string) ([]string, error) {
+	secrets, err := machineSecrets(machine)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for name, value := range secrets {
+		env = append(env, name+"="+value)
+	}
+
+	return env, nil
+}
+
+// redactedValues returns the secret values that are redacted.
+func redactedValues() []string {
+	if globalSecrets == nil {
+		return nil
+	}
+
+	secrets, err := globalSecrets.Secrets()
+	if err != nil {
+		logWarn(LogFields{"error": err}, "error reading secrets for redaction")
+		return nil
+	}
+
+	var values []string
+	for _, value := range secrets {
+		if len(value) >= secretsMinRedactLength {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// redactSecrets replaces the values of all secrets in text.
+func redactSecrets(text string) string {
+	if globalSecrets == nil || text == "" {
+		return text
+	}
+
+	for _, value := range redactedValues() {
+		text = strings.Replace(text, value, secretsRedacted, -1)
+	}
+
+	return text
+}
+
+// redactingReader replaces the values of secrets in a stream. It holds back
+// the end of what it read as long as a secret could start there.
+type redactingReader struct {
+	in      io.Reader
+	values  [][]byte
+	keep    int
+	pending []byte
+	out     []byte
+	err     error
+}
+
+// redactReader returns a reader of in with the values of all secrets
+// replaced, or in itself and false if there is nothing to redact.
+func redactReader(in io.Reader) (io.Reader, bool) {
+	values := redactedValues()
+	if len(values) == 0 {
+		return in, false
+	}
+
+	reader := &redactingReader{in: in}
+	for _, value := range values {
+		reader.values = append(reader.values, []byte(value))
+		if len(value)-1 > reader.keep {
+			reader.keep = len(value) - 1
+		}
+	}
+
+	return reader, true
+}
+
+func (r *redactingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		buffer := make([]byte, 32*1024)
+		n, err := r.in.Read(buffer)
+		r.err = err
+		r.pending = append(r.pending, buffer[:n]...)
+		for _, value := range r.values {
+			r.pending = bytes.Replace(r.pending, value, []byte(secretsRedacted), -1)
+		}
+
+		ready := len(r.pending) - r.keep
+		if r.err != nil {
+			ready = len(r.pending)
+		}
+		if ready > 0 {
+			r.out = append([]byte(nil), r.pending[:ready]...)
+			r.pending = append(r.pending[:0], r.pending[ready:]...)
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// redactRun returns a copy of run with secrets redacted from the fields that
+// contain state output.
+func redactRun(run *RunningMachine) *RunningMachine {
+	redacted := *run
+	redacted.Input = redactSecrets(run.Input)
+	redacted.StatusMessage = redactSecrets(run.StatusMessage)
+	return &redacted
+}
+
+func initSecrets() error {
+	if globalConfig.SecretsFile == "" {
+		return nil
+	}
+
+	store, err := newSecretStore(globalConfig.SecretsFile, globalConfig.SecretsKeyFile)
+	if err != nil {
+		return err
+	}
+
+	globalSecrets = store
+	return nil
+}
+
+func validateSecretsConfig(config *Config) []string {
+	var errors []string
+
+	if (config.SecretsFile == "") != (config.SecretsKeyFile == "") {
+		errors = append(errors, "SecretsFile and SecretsKeyFile must be set together")
+	} else if config.SecretsFile != "" {
+		if _, err := newSecretStore(config.SecretsFile, config.SecretsKeyFile); err != nil {
+			errors = append(errors, fmt.Sprintf("SecretsFile/SecretsKeyFile: %s", err))
+		}
+	}
+
+	for _, machine := range config.Machine {
+		if len(machine.Secrets) > 0 && config.SecretsFile == "" {
+			errors = append(errors, fmt.Sprintf("Machine %s: Secrets requires SecretsFile and SecretsKeyFile", machine.Name))
+		}
+	}
+
+	return errors
+}
+
+type secretsCommand struct {
+	Usage string
+	Args  int
+	Run   func(store *SecretStore, args []string) error
+}
+
+var secretsCommands = map[string]secretsCommand{
+	"list":   {"list", 0, secretsList},
+	"set":    {"set <name> < value", 1, secretsSet},
+	"delete": {"delete <name>", 1, secretsDelete},
+}
+
+func secretsUsage() {
+	var usages []string
+	for _, command := range secretsCommands {
+		usages = append(usages, command.Usage)
+	}
+	usages = append(usages, "genkey")
+	sort.Strings(usages)
+	fmt.Fprintf(os.Stderr, "usage: restatemachine secrets <command> [-config path] [args]\n\ncommands:\n  %s\n", strings.Join(usages, "\n  "))
+}
+
+// commandSecrets implements "restatemachine secrets", which manages the
+// secrets file configured with SecretsFile and SecretsKeyFile.
+func commandSecrets(args []string) int {
+	if len(args) == 1 && args[0] == "genkey" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Fprintf(os.Stderr, "error generating key: %s\n", err)
+			return 1
+		}
+
+		fmt.Println(hex.EncodeToString(key))
+		return 0
+	}
+
+	if len(args) < 1 {
+		secretsUsage()
+		return 2
+	}
+
+	command, ok := secretsCommands[args[0]]
+	if !ok {
+		secretsUsage()
+		return 2
+	}
+
+	var flags ConfigFlags
+	flagSet := flag.NewFlagSet("restatemachine secrets "+args[0], flag.ContinueOnError)
+	flagSet.StringVar(&flags.ConfigFile, "config", "", "path to the config file to read SecretsFile and SecretsKeyFile from")
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: restatemachine secrets %s [flags]\n\nflags:\n", command.Usage)
+		flagSet.PrintDefaults()
+	}
+
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if flagSet.NArg() != command.Args {
+		flagSet.Usage()
+		return 2
+	}
+
+	config, err := loadConfig(&flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	if config.SecretsFile == "" {
+		fmt.Fprintf(os.Stderr, "SecretsFile and SecretsKeyFile are not configured\n")
+		return 1
+	}
+
+	store, err := newSecretStore(config.SecretsFile, config.SecretsKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	if err := command.Run(store, flagSet.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func secretsList(store *SecretStore, args []string) error {
+	secrets, err := store.Secrets()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Println(name)
+	}
+
+	return nil
+}
+
+// secretsSet reads the value from stdin so that it doesn't end up in the shell
+// history or the process list. A single trailing newline is removed.
+func secretsSet(store *SecretStore, args []string) error {
+	name := args[0]
+	if !secretNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid secret name %s, secrets are passed as environment variables and must match %s", name, secretNamePattern)
+	}
+
+	value, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := store.Secrets()
+	if err != nil {
+		return err
+	}
+
+	secrets[name] = strings.TrimSuffix(strings.TrimSuffix(string(value), "\n"), "\r")
+	return store.write(secrets)
+}
+
+func secretsDelete(store *SecretStore, args []string) error {
+	secrets, err := store.Secrets()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := secrets[args[0]]; !ok {
+		return fmt.Errorf("secret %s doesn't exist", args[0])
+	}
+
+	delete(secrets, args[0])
+	return store.write(secrets)
+}
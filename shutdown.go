@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type DrainStatus struct {
+	Draining        bool
+	ExecutingStates int
+}
+
+// serve runs server until SIGTERM or SIGINT and then shuts down gracefully: new
+// runs are refused and no new states dispatched, executing states get
+// ShutdownGraceSeconds to finish before they are killed, and finally the
+// storage is closed. A second signal exits immediately.
+func serve(server *http.Server, useTLS bool, storage Storage, timerQuitChannel chan struct{}) {
+	listenErrors := make(chan error, 1)
+	go func() {
+		if useTLS {
+			listenErrors <- server.ListenAndServeTLS("", "")
+		} else {
+			listenErrors <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-listenErrors:
+		logError(LogFields{"address": globalConfig.ListenOn, "error": err}, "error listening")
+		os.Exit(1)
+	case sig := <-signals:
+		logInfo(LogFields{"signal": sig, "grace_seconds": globalConfig.ShutdownGraceSeconds}, "shutting down")
+	}
+
+	go func() {
+		sig := <-signals
+		logWarn(LogFields{"signal": sig}, "second signal received, exiting immediately")
+		os.Exit(1)
+	}()
+
+	globalScheduler.SetDraining(true)
+	grace := time.Duration(globalConfig.ShutdownGraceSeconds) * time.Second
+	if !globalScheduler.WaitForStates(grace) {
+		globalScheduler.KillStates()
+		globalScheduler.WaitForStates(5 * time.Second)
+	}
+
+	close(timerQuitChannel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logWarn(LogFields{"error": err}, "error closing API connections")
+	}
+
+	if err := storage.Close(); err != nil {
+		logError(LogFields{"error": err}, "error closing database")
+		os.Exit(1)
+	}
+
+	logInfo(LogFields{}, "restatemachine stopped")
+}
+
+func drainStatus() DrainStatus {
+	return DrainStatus{Draining: globalScheduler.IsDraining(), ExecutingStates: globalScheduler.ExecutingStates()}
+}
+
+func apiGetDrain(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	resp.WriteEntity(drainStatus())
+}
+
+func apiStartDrain(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	globalScheduler.SetDraining(true)
+	logInfo(LogFields{"user": requestIdentity(req).Name}, "drain mode entered")
+	resp.WriteEntity(drainStatus())
+}
+
+func apiStopDrain(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	globalScheduler.SetDraining(false)
+	logInfo(LogFields{"user": requestIdentity(req).Name}, "drain mode left")
+	resp.WriteEntity(drainStatus())
+}
+
+func healthCheckDrain() HealthCheck {
+	check := HealthCheck{Name: "drain", Healthy: !globalScheduler.IsDraining(), Details: drainStatus()}
+	if check.Healthy {
+		check.Message = "accepting new runs"
+	} else {
+		check.Message = "draining, new runs are refused"
+	}
+
+	return check
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStateMachine creates a machine whose start state is script and returns
+// its path.
+func testStateMachine(t *testing.T, config *Config, name string, script string) string {
+	path := filepath.Join(config.StateMachinePath, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "start"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func waitForExecutingStates(t *testing.T, scheduler *Scheduler, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for scheduler.ExecutingStates() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d states are executing, expected %d", scheduler.ExecutingStates(), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrainWaitsForStates(t *testing.T) {
+	config := testConfig(t)
+	path := testStateMachine(t, config, "quick", "sleep 0.2\necho stop >&2\necho 0 >&2\necho done >&2\n")
+
+	scheduler := newTestScheduler(newMemoryStorage())
+	id, err := scheduler.ScheduleMachine("quick", path, "", "", "alice", RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler.HandleTick()
+	waitForExecutingStates(t, scheduler, 1)
+	scheduler.SetDraining(true)
+
+	if !scheduler.WaitForStates(5 * time.Second) {
+		t.Fatal("state didn't finish while draining")
+	}
+	if run, err := scheduler.Storage.GetRun(id); err != nil || run.NextState != "stop" || run.StatusMessage != "done" {
+		t.Errorf("run after draining is %+v, error %v", run, err)
+	}
+	if len(scheduler.RunningMachines) != 0 {
+		t.Errorf("%d runs are still active", len(scheduler.RunningMachines))
+	}
+}
+
+func TestDrainKillStates(t *testing.T) {
+	config := testConfig(t)
+	path := testStateMachine(t, config, "slow", "sleep 30\n")
+
+	scheduler := newTestScheduler(newMemoryStorage())
+	slow, err := scheduler.ScheduleMachine("slow", path, "", "", "alice", RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler.HandleTick()
+	waitForExecutingStates(t, scheduler, 1)
+
+	// No further states are dispatched while draining
+	scheduler.SetDraining(true)
+	waiting, err := scheduler.ScheduleMachine("slow", path, "", "", "alice", RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.HandleTick()
+	if run, _ := scheduler.Storage.GetRun(waiting); run.RunningStateCode || scheduler.ExecutingStates() != 1 {
+		t.Errorf("a state was dispatched while draining")
+	}
+
+	if scheduler.WaitForStates(100 * time.Millisecond) {
+		t.Fatal("WaitForStates returned before the state finished")
+	}
+
+	started := time.Now()
+	scheduler.KillStates()
+	if !scheduler.WaitForStates(5*time.Second) || time.Since(started) > 5*time.Second {
+		t.Fatal("killed state didn't finish")
+	}
+
+	// The killed state failed like any other and is retried later
+	run, err := scheduler.Storage.GetRun(slow)
+	if err != nil || run.RunningStateCode || run.NextState != "start" || !strings.Contains(run.StatusMessage, "error executing state code") {
+		t.Errorf("run after killing its state is %+v, error %v", run, err)
+	}
+	if history, err := scheduler.Storage.GetHistory(slow); err != nil || len(history) != 1 || history[0].Success {
+		t.Errorf("history after killing the state is %+v, error %v", history, err)
+	}
+
+	scheduler.SetDraining(false)
+	if scheduler.IsDraining() {
+		t.Error("scheduler is still draining")
+	}
+}
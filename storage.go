@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Storage persists runs and the rest of the daemon state. The scheduler keeps
+// the active set in memory and writes every change through to the storage, so
+// implementations must be safe for concurrent use.
+//
+// A run's schedule is its NextState and NextStateRun, which are stored with
+// the run. Run ids come from a sequence owned by the storage.
+type Storage interface {
+	// CreateRun assigns run the next id from the run sequence, stores it and
+	// adds it to the active set.
+	CreateRun(run *RunningMachine) error
+	// UpdateRun stores run and its schedule.
+	UpdateRun(run *RunningMachine) error
+	GetRun(id uint64) (*RunningMachine, error)
+	// ActiveRuns returns the runs in the active set, used to resume them at
+	// startup.
+	ActiveRuns() ([]*RunningMachine, error)
+	// ListRuns returns up to filter.Limit runs selected by filter, newest
+	// first.
+	ListRuns(filter RunFilter) ([]*RunningMachine, error)
+	// FinishRun removes run from the active set, stores it and appends entry,
+	// unless it is nil, to its history in one transaction.
+	FinishRun(run *RunningMachine, entry *HistoryEntry) error
+
+	AppendHistory(id uint64, entry HistoryEntry) error
+	GetHistory(id uint64) ([]HistoryEntry, error)
+
+	PutApiToken(hash string, token *ApiToken) error
+	GetApiToken(hash string) (*ApiToken, error)
+	GetApiTokens() ([]ApiToken, error)
+	DeleteApiToken(id string) (bool, error)
+
+	// AppendAuditEntry stores entry and sets its Id from the audit sequence.
+	AppendAuditEntry(entry *AuditEntry) error
+	// QueryAuditEntries returns up to limit entries, newest first, optionally
+	// filtered by identity and a start time.
+	QueryAuditEntries(limit int, identity string, since time.Time) ([]AuditEntry, error)
+
+	// Check returns an error if the storage isn't usable, for health checks.
+	Check() error
+	String() string
+	Close() error
+}
+
+// BackupStorage is implemented by backends that can write a consistent
+// snapshot which "restatemachine db restore" can restore.
+type BackupStorage interface {
+	Backup(w io.Writer) error
+}
+
+var errBackupNotSupported = fmt.Errorf("backups are only supported by the bolt storage backend, use the backup tools of your database instead")
+
+var storageBackends = []string{"bolt", "memory", "sql"}
+
+// RunNotFoundError is returned for a run id that was never assigned.
+type RunNotFoundError struct {
+	Id string
+}
+
+func (e RunNotFoundError) Error() string {
+	return fmt.Sprintf("no running state machine with id %s found", e.Id)
+}
+
+// InvalidRunIdError is returned for a run id that isn't a number.
+type InvalidRunIdError struct {
+	Id string
+}
+
+func (e InvalidRunIdError) Error() string {
+	return fmt.Sprintf("invalid state machine run id %q, run ids are numbers", e.Id)
+}
+
+func runNotFound(id uint64) error {
+	return RunNotFoundError{Id: strconv.FormatUint(id, 10)}
+}
+
+// openStorage opens the storage backend selected in the configuration,
+// wrapped in an EncryptedStorage if EncryptionKeyFile is set.
+func openStorage(config Config) (Storage, error) {
+	var storage Storage
+	var err error
+	switch config.StorageBackend {
+	case "bolt":
+		storage, err = openBoltStorage(config.DatabasePath)
+	case "memory":
+		storage = newMemoryStorage()
+	case "sql":
+		storage, err = openSQLStorage(config.StorageDriver, config.StorageDSN)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %s", config.StorageBackend)
+	}
+
+	if err != nil || config.EncryptionKeyFile == "" {
+		return storage, err
+	}
+
+	keyRing, err := loadKeyRing(config.EncryptionKeyFile)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	return &EncryptedStorage{Storage: storage, Keys: keyRing}, nil
+}
+
+// backupStorage returns the backend of storage if it supports backups.
+// Backups of an EncryptedStorage contain the encrypted values.
+func backupStorage(storage Storage) (BackupStorage, bool) {
+	if encrypted, ok := storage.(*EncryptedStorage); ok {
+		storage = encrypted.Storage
+	}
+
+	backup, ok := storage.(BackupStorage)
+	return backup, ok
+}
+
+func validateStorageConfig(config *Config) []string {
+	var errors []string
+
+	switch config.StorageBackend {
+	case "bolt", "memory":
+	case "sql":
+		if config.StorageDriver == "" || config.StorageDSN == "" {
+			errors = append(errors, "StorageDriver and StorageDSN are required with the sql storage backend")
+		} else if !containsString(sql.Drivers(), config.StorageDriver) {
+			errors = append(errors, fmt.Sprintf("StorageDriver: database driver %s is not compiled in, available drivers: %v (build with -tags sqlite for sqlite3)",
+				config.StorageDriver, sql.Drivers()))
+		}
+	default:
+		errors = append(errors, fmt.Sprintf("StorageBackend: unknown storage backend %s, expected one of %v", config.StorageBackend, storageBackends))
+	}
+
+	if config.EncryptionKeyFile != "" {
+		if _, err := loadKeyRing(config.EncryptionKeyFile); err != nil {
+			errors = append(errors, fmt.Sprintf("EncryptionKeyFile: %s", err))
+		}
+	}
+
+	if config.BackupPath != "" && config.StorageBackend != "bolt" {
+		errors = append(errors, "BackupPath: "+errBackupNotSupported.Error())
+	}
+
+	return errors
+}
+
+func parseRunId(id string) (uint64, error) {
+	runId, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, InvalidRunIdError{Id: id}
+	}
+
+	return runId, nil
+}
+
+// filterAuditEntries applies the QueryAuditEntries filters to entries that
+// are sorted newest first.
+func filterAuditEntries(entries []AuditEntry, limit int, identity string, since time.Time) []AuditEntry {
+	result := make([]AuditEntry, 0)
+	for _, entry := range entries {
+		if len(result) >= limit || entry.Time.Before(since) {
+			break
+		}
+
+		if identity == "" || entry.Identity == identity {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+func sortRunsById(runs []*RunningMachine) {
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Id < runs[j].Id })
+}
+
+const (
+	runStatusActive   = "active"
+	runStatusFinished = "finished"
+)
+
+// RunFilter selects the runs returned by ListRuns.
+type RunFilter struct {
+	Machine string // only runs of this state machine if set
+	Status  string // runStatusActive, runStatusFinished or empty for all runs
+	Limit   int
+}
+
+func (f RunFilter) matches(run *RunningMachine, active bool) bool {
+	if f.Machine != "" && run.Name != f.Machine {
+		return false
+	}
+
+	switch f.Status {
+	case runStatusActive:
+		return active
+	case runStatusFinished:
+		return !active
+	}
+
+	return true
+}
+
+// newestRuns sorts runs newest first and returns up to limit of them.
+func newestRuns(runs []*RunningMachine, limit int) []*RunningMachine {
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Id > runs[j].Id })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	return runs
+}
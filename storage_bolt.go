@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"time"
+)
+
+// BoltStorage is the default storage backend, a single bolt database file.
+// Runs are stored as JSON in MachineRuns keyed by their decimal id, the active
+// set is the keys of RunningMachines and the history of each run is a nested
+// bucket in RunHistory.
+type BoltStorage struct {
+	DB *bolt.DB
+}
+
+func openBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %s: %s", path, err)
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{DB: db}, nil
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func runKey(id uint64) []byte {
+	return []byte(fmt.Sprintf("%d", id))
+}
+
+func putRun(tx *bolt.Tx, run *RunningMachine, active bool) error {
+	runningBucket := tx.Bucket([]byte("RunningMachines"))
+	runsBucket := tx.Bucket([]byte("MachineRuns"))
+	if runningBucket == nil || runsBucket == nil {
+		return fmt.Errorf("error getting database bucket")
+	}
+
+	machineJson, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("error serializing machine as json for persisting: %s", err)
+	}
+
+	if err := runsBucket.Put(runKey(run.Id), machineJson); err != nil {
+		return fmt.Errorf("error persisting machine run: %s", err)
+	}
+
+	if active {
+		err = runningBucket.Put(runKey(run.Id), nil)
+	} else {
+		err = runningBucket.Delete(runKey(run.Id))
+	}
+
+	if err != nil {
+		return fmt.Errorf("error persisting machine run: %s", err)
+	}
+
+	return nil
+}
+
+func (s *BoltStorage) CreateRun(run *RunningMachine) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		runsBucket := tx.Bucket([]byte("MachineRuns"))
+		if runsBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		id, err := runsBucket.NextSequence()
+		if err != nil {
+			return fmt.Errorf("error getting next value in MachineRuns sequence: %s", err)
+		}
+		run.Id = id
+
+		return putRun(tx, run, true)
+	})
+}
+
+func (s *BoltStorage) UpdateRun(run *RunningMachine) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return putRun(tx, run, true)
+	})
+}
+
+func (s *BoltStorage) GetRun(id uint64) (*RunningMachine, error) {
+	var machine RunningMachine
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		runsBucket := tx.Bucket([]byte("MachineRuns"))
+		if runsBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		machineJson := runsBucket.Get(runKey(id))
+		if machineJson == nil {
+			return runNotFound(id)
+		}
+
+		if err := json.Unmarshal(machineJson, &machine); err != nil {
+			return fmt.Errorf("error deserializing machine run from persisted db: %s", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &machine, nil
+}
+
+func (s *BoltStorage) ListRuns(filter RunFilter) ([]*RunningMachine, error) {
+	runs := make([]*RunningMachine, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		runningBucket := tx.Bucket([]byte("RunningMachines"))
+		runsBucket := tx.Bucket([]byte("MachineRuns"))
+		if runningBucket == nil || runsBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		return runsBucket.ForEach(func(k, v []byte) error {
+			var machine RunningMachine
+			if err := json.Unmarshal(v, &machine); err != nil {
+				return fmt.Errorf("error deserializing machine run %s from persisted db: %s", k, err)
+			}
+
+			if filter.matches(&machine, runningBucket.Get(k) != nil) {
+				runs = append(runs, &machine)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newestRuns(runs, filter.Limit), nil
+}
+
+// ActiveRuns loads the active set. A bad record must not keep the daemon from
+// starting, so undecodable runs are quarantined and skipped.
+func (s *BoltStorage) ActiveRuns() ([]*RunningMachine, error) {
+	runs := make([]*RunningMachine, 0)
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		runningBucket := tx.Bucket([]byte("RunningMachines"))
+		runsBucket := tx.Bucket([]byte("MachineRuns"))
+		if runningBucket == nil || runsBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		var keys [][]byte
+		c := runningBucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		for _, k := range keys {
+			machineJson := runsBucket.Get(k)
+			if machineJson == nil {
+				if err := quarantineRecord(tx, "RunningMachines", k, fmt.Errorf("no MachineRuns record")); err != nil {
+					return err
+				}
+				continue
+			}
+
+			var machine RunningMachine
+			err := json.Unmarshal(machineJson, &machine)
+			if err != nil {
+				if err := runningBucket.Delete(k); err != nil {
+					return err
+				}
+				if err := quarantineRecord(tx, "MachineRuns", k, fmt.Errorf("error deserializing currently running machine from persisted db: %s", err)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			runs = append(runs, &machine)
+		}
+
+		return nil
+	})
+
+	sortRunsById(runs)
+	return runs, err
+}
+
+func (s *BoltStorage) FinishRun(run *RunningMachine, entry *HistoryEntry) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		if entry != nil {
+			if err := appendHistory(tx, run.Id, *entry); err != nil {
+				return err
+			}
+		}
+
+		return putRun(tx, run, false)
+	})
+}
+
+func appendHistory(tx *bolt.Tx, id uint64, entry HistoryEntry) error {
+	historyBucket := tx.Bucket([]byte("RunHistory"))
+	if historyBucket == nil {
+		return fmt.Errorf("error getting database bucket")
+	}
+
+	runBucket, err := historyBucket.CreateBucketIfNotExists(runKey(id))
+	if err != nil {
+		return fmt.Errorf("error creating history bucket for run %d: %s", id, err)
+	}
+
+	seq, err := runBucket.NextSequence()
+	if err != nil {
+		return fmt.Errorf("error getting next value in history sequence: %s", err)
+	}
+
+	entryJson, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error serializing history entry as json for persisting: %s", err)
+	}
+
+	return runBucket.Put(sequenceKey(seq), entryJson)
+}
+
+func (s *BoltStorage) AppendHistory(id uint64, entry HistoryEntry) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return appendHistory(tx, id, entry)
+	})
+}
+
+func (s *BoltStorage) GetHistory(id uint64) ([]HistoryEntry, error) {
+	entries := make([]HistoryEntry, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		historyBucket := tx.Bucket([]byte("RunHistory"))
+		if historyBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		runBucket := historyBucket.Bucket(runKey(id))
+		if runBucket == nil {
+			return nil
+		}
+
+		return runBucket.ForEach(func(k, v []byte) error {
+			var entry HistoryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error deserializing history entry from persisted db: %s", err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+func (s *BoltStorage) PutApiToken(hash string, token *ApiToken) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		tokensBucket := tx.Bucket([]byte("ApiTokens"))
+		if tokensBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		tokenJson, err := json.Marshal(token)
+		if err != nil {
+			return fmt.Errorf("error serializing token as json for persisting: %s", err)
+		}
+
+		return tokensBucket.Put([]byte(hash), tokenJson)
+	})
+}
+
+func (s *BoltStorage) GetApiToken(hash string) (*ApiToken, error) {
+	var apiToken *ApiToken
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		tokensBucket := tx.Bucket([]byte("ApiTokens"))
+		if tokensBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		tokenJson := tokensBucket.Get([]byte(hash))
+		if tokenJson == nil {
+			return nil
+		}
+
+		apiToken = &ApiToken{}
+		return json.Unmarshal(tokenJson, apiToken)
+	})
+
+	return apiToken, err
+}
+
+func (s *BoltStorage) GetApiTokens() ([]ApiToken, error) {
+	tokens := make([]ApiToken, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		tokensBucket := tx.Bucket([]byte("ApiTokens"))
+		if tokensBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		return tokensBucket.ForEach(func(k, v []byte) error {
+			var apiToken ApiToken
+			if err := json.Unmarshal(v, &apiToken); err != nil {
+				return fmt.Errorf("error deserializing token from persisted db: %s", err)
+			}
+			tokens = append(tokens, apiToken)
+			return nil
+		})
+	})
+
+	return tokens, err
+}
+
+func (s *BoltStorage) DeleteApiToken(id string) (bool, error) {
+	found := false
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		tokensBucket := tx.Bucket([]byte("ApiTokens"))
+		if tokensBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		c := tokensBucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var apiToken ApiToken
+			if err := json.Unmarshal(v, &apiToken); err == nil && apiToken.Id == id {
+				found = true
+				return tokensBucket.Delete(k)
+			}
+		}
+
+		return nil
+	})
+
+	return found, err
+}
+
+func (s *BoltStorage) AppendAuditEntry(entry *AuditEntry) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		auditBucket := tx.Bucket([]byte("AuditLog"))
+		if auditBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		id, err := auditBucket.NextSequence()
+		if err != nil {
+			return fmt.Errorf("error getting next value in AuditLog sequence: %s", err)
+		}
+		entry.Id = id
+
+		entryJson, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error serializing audit entry as json for persisting: %s", err)
+		}
+
+		return auditBucket.Put(sequenceKey(id), entryJson)
+	})
+}
+
+func (s *BoltStorage) QueryAuditEntries(limit int, identity string, since time.Time) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		auditBucket := tx.Bucket([]byte("AuditLog"))
+		if auditBucket == nil {
+			return fmt.Errorf("error getting database bucket")
+		}
+
+		c := auditBucket.Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < limit; k, v = c.Prev() {
+			var entry AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error deserializing audit entry from persisted db: %s", err)
+			}
+
+			if entry.Time.Before(since) {
+				break
+			}
+
+			if identity == "" || entry.Identity == identity {
+				entries = append(entries, entry)
+			}
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+func (s *BoltStorage) Check() error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"RunningMachines", "MachineRuns"} {
+			if tx.Bucket([]byte(bucket)) == nil {
+				return fmt.Errorf("bucket %s is missing", bucket)
+			}
+		}
+		return nil
+	})
+}
+
+// Backup streams a consistent snapshot from a read transaction, so the
+// scheduler can keep writing while it runs.
+func (s *BoltStorage) Backup(w io.Writer) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+func (s *BoltStorage) String() string {
+	return "bolt database " + s.DB.Path()
+}
+
+func (s *BoltStorage) Close() error {
+	return s.DB.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps everything in memory and loses it on restart. It is
+// meant for tests and for trying out state machines.
+type MemoryStorage struct {
+	lock          sync.Mutex
+	runs          map[uint64]RunningMachine
+	active        map[uint64]bool
+	history       map[uint64][]HistoryEntry
+	tokens        map[string]ApiToken
+	audit         []AuditEntry
+	runSequence   uint64
+	auditSequence uint64
+}
+
+func newMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		runs:    make(map[uint64]RunningMachine),
+		active:  make(map[uint64]bool),
+		history: make(map[uint64][]HistoryEntry),
+		tokens:  make(map[string]ApiToken),
+	}
+}
+
+func (s *MemoryStorage) CreateRun(run *RunningMachine) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.runSequence++
+	run.Id = s.runSequence
+	s.runs[run.Id] = *run
+	s.active[run.Id] = true
+	return nil
+}
+
+func (s *MemoryStorage) UpdateRun(run *RunningMachine) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.runs[run.Id] = *run
+	s.active[run.Id] = true
+	return nil
+}
+
+func (s *MemoryStorage) GetRun(id uint64) (*RunningMachine, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	run, ok := s.runs[id]
+	if !ok {
+		return nil, runNotFound(id)
+	}
+
+	return &run, nil
+}
+
+func (s *MemoryStorage) ActiveRuns() ([]*RunningMachine, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	runs := make([]*RunningMachine, 0, len(s.active))
+	for id := range s.active {
+		run := s.runs[id]
+		runs = append(runs, &run)
+	}
+
+	sortRunsById(runs)
+	return runs, nil
+}
+
+func (s *MemoryStorage) ListRuns(filter RunFilter) ([]*RunningMachine, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	runs := make([]*RunningMachine, 0)
+	for id := range s.runs {
+		run := s.runs[id]
+		if filter.matches(&run, s.active[id]) {
+			runs = append(runs, &run)
+		}
+	}
+
+	return newestRuns(runs, filter.Limit), nil
+}
+
+func (s *MemoryStorage) FinishRun(run *RunningMachine, entry *HistoryEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if entry != nil {
+		s.history[run.Id] = append(s.history[run.Id], *entry)
+	}
+
+	s.runs[run.Id] = *run
+	delete(s.active, run.Id)
+	return nil
+}
+
+func (s *MemoryStorage) AppendHistory(id uint64, entry HistoryEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.history[id] = append(s.history[id], entry)
+	return nil
+}
+
+func (s *MemoryStorage) GetHistory(id uint64) ([]HistoryEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append(make([]HistoryEntry, 0), s.history[id]...), nil
+}
+
+func (s *MemoryStorage) PutApiToken(hash string, token *ApiToken) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens[hash] = *token
+	return nil
+}
+
+func (s *MemoryStorage) GetApiToken(hash string) (*ApiToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, ok := s.tokens[hash]
+	if !ok {
+		return nil, nil
+	}
+
+	return &token, nil
+}
+
+func (s *MemoryStorage) GetApiTokens() ([]ApiToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tokens := make([]ApiToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+func (s *MemoryStorage) DeleteApiToken(id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for hash, token := range s.tokens {
+		if token.Id == id {
+			delete(s.tokens, hash)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *MemoryStorage) AppendAuditEntry(entry *AuditEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.auditSequence++
+	entry.Id = s.auditSequence
+	s.audit = append(s.audit, *entry)
+	return nil
+}
+
+func (s *MemoryStorage) QueryAuditEntries(limit int, identity string, since time.Time) ([]AuditEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	newestFirst := make([]AuditEntry, len(s.audit))
+	for idx, entry := range s.audit {
+		newestFirst[len(s.audit)-1-idx] = entry
+	}
+
+	return filterAuditEntries(newestFirst, limit, identity, since), nil
+}
+
+func (s *MemoryStorage) Check() error {
+	return nil
+}
+
+func (s *MemoryStorage) String() string {
+	return "in-memory storage"
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLStorage stores runs in plain tables of a database/sql database, so that
+// run data can be queried with standard tools. The vendored sqlite3 driver is
+// compiled in with "-tags sqlite", other drivers can be added the same way.
+type SQLStorage struct {
+	DB     *sql.DB
+	Driver string
+}
+
+// sqlMigrations are the schema versions of the SQL backend, applied in order
+// like the bolt migrations.
+var sqlMigrations = []string{
+	`CREATE TABLE runs (
+		id INTEGER PRIMARY KEY,
+		machine TEXT NOT NULL,
+		path TEXT NOT NULL,
+		input TEXT NOT NULL,
+		last_state TEXT NOT NULL,
+		next_state TEXT NOT NULL,
+		status_message TEXT NOT NULL,
+		running_state_code INTEGER NOT NULL,
+		next_state_run TEXT NOT NULL,
+		state_started TEXT NOT NULL,
+		started_by TEXT NOT NULL,
+		cancelled_by TEXT NOT NULL,
+		active INTEGER NOT NULL
+	);
+	CREATE INDEX runs_active ON runs (active);
+	CREATE TABLE history (
+		run_id INTEGER NOT NULL,
+		seq INTEGER NOT NULL,
+		time TEXT NOT NULL,
+		state TEXT NOT NULL,
+		next_state TEXT NOT NULL,
+		next_state_run TEXT NOT NULL,
+		status_message TEXT NOT NULL,
+		duration REAL NOT NULL,
+		success INTEGER NOT NULL,
+		PRIMARY KEY (run_id, seq)
+	);
+	CREATE TABLE sequences (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+	CREATE TABLE api_tokens (
+		hash TEXT PRIMARY KEY,
+		id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY,
+		time TEXT NOT NULL,
+		identity TEXT NOT NULL,
+		auth_method TEXT NOT NULL,
+		remote TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		outcome TEXT NOT NULL
+	)`,
+	`ALTER TABLE runs ADD COLUMN input_blob TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE runs ADD COLUMN labels TEXT NOT NULL DEFAULT '';
+	ALTER TABLE runs ADD COLUMN callback_url TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE runs ADD COLUMN paused INTEGER NOT NULL DEFAULT 0`,
+}
+
+// Times are stored as fixed width UTC text, which sorts correctly and reads
+// the same in every database.
+const sqlTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+func formatSQLTime(t time.Time) string {
+	return t.UTC().Format(sqlTimeFormat)
+}
+
+func parseSQLTime(value string) time.Time {
+	t, _ := time.Parse(sqlTimeFormat, value)
+	return t
+}
+
+func sqlBool(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func openSQLStorage(driver string, dsn string) (*SQLStorage, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s database: %s", driver, err)
+	}
+
+	// sqlite only allows one writer, more connections just fail with
+	// "database is locked"
+	if driver == "sqlite3" {
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLStorage{DB: db, Driver: driver}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// rebind rewrites ? placeholders for drivers that use numbered ones.
+func (s *SQLStorage) rebind(query string) string {
+	if s.Driver != "postgres" && s.Driver != "pgx" {
+		return query
+	}
+
+	var builder strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+
+	return builder.String()
+}
+
+func (s *SQLStorage) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStorage) exec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Exec(s.rebind(query), args...)
+}
+
+func (s *SQLStorage) migrate() error {
+	if _, err := s.DB.Exec("CREATE TABLE IF NOT EXISTS metadata (name TEXT PRIMARY KEY, value TEXT NOT NULL)"); err != nil {
+		return fmt.Errorf("error creating metadata table: %s", err)
+	}
+
+	version := 0
+	var versionValue string
+	err := s.DB.QueryRow(s.rebind("SELECT value FROM metadata WHERE name = ?"), "schema_version").Scan(&versionValue)
+	if err == nil {
+		version, err = strconv.Atoi(versionValue)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error reading schema version: %s", err)
+	}
+
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, len(sqlMigrations))
+	}
+
+	for idx := version; idx < len(sqlMigrations); idx++ {
+		logInfo(LogFields{"version": idx + 1}, "migrating database")
+		err := s.inTx(func(tx *sql.Tx) error {
+			var err error
+			for _, statement := range strings.Split(sqlMigrations[idx], ";") {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+
+			if idx == 0 {
+				_, err = s.exec(tx, "INSERT INTO metadata (name, value) VALUES (?, ?)", "schema_version", "1")
+			} else {
+				_, err = s.exec(tx, "UPDATE metadata SET value = ? WHERE name = ?", strconv.Itoa(idx+1), "schema_version")
+			}
+			return err
+		})
+
+		if err != nil {
+			return fmt.Errorf("migration to schema version %d failed: %s", idx+1, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStorage) nextSequence(tx *sql.Tx, name string) (uint64, error) {
+	result, err := s.exec(tx, "UPDATE sequences SET value = value + 1 WHERE name = ?", name)
+	if err != nil {
+		return 0, fmt.Errorf("error getting next value in %s sequence: %s", name, err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if _, err := s.exec(tx, "INSERT INTO sequences (name, value) VALUES (?, 1)", name); err != nil {
+			return 0, fmt.Errorf("error getting next value in %s sequence: %s", name, err)
+		}
+	}
+
+	var value uint64
+	err = tx.QueryRow(s.rebind("SELECT value FROM sequences WHERE name = ?"), name).Scan(&value)
+	return value, err
+}
+
+func (s *SQLStorage) putRun(tx *sql.Tx, run *RunningMachine, active bool) error {
+	labels := ""
+	if len(run.Labels) > 0 {
+		encoded, err := json.Marshal(run.Labels)
+		if err != nil {
+			return fmt.Errorf("error encoding run labels: %s", err)
+		}
+		labels = string(encoded)
+	}
+
+	args := []interface{}{run.Name, run.Path, run.Input, run.InputBlob, run.LastState, run.NextState, run.StatusMessage,
+		sqlBool(run.RunningStateCode), formatSQLTime(run.NextStateRun), formatSQLTime(run.StateStarted),
+		run.StartedBy, run.CancelledBy, labels, run.CallbackUrl, sqlBool(run.Paused), sqlBool(active), run.Id}
+
+	// MySQL counts only changed rows as affected, so an UPDATE that changes
+	// nothing can't tell that the run is new
+	var count int
+	if err := tx.QueryRow(s.rebind("SELECT COUNT(*) FROM runs WHERE id = ?"), run.Id).Scan(&count); err != nil {
+		return fmt.Errorf("error persisting machine run: %s", err)
+	}
+
+	var err error
+	if count > 0 {
+		_, err = s.exec(tx, `UPDATE runs SET machine = ?, path = ?, input = ?, input_blob = ?, last_state = ?, next_state = ?,
+			status_message = ?, running_state_code = ?, next_state_run = ?, state_started = ?, started_by = ?,
+			cancelled_by = ?, labels = ?, callback_url = ?, paused = ?, active = ? WHERE id = ?`, args...)
+	} else {
+		_, err = s.exec(tx, `INSERT INTO runs (machine, path, input, input_blob, last_state, next_state, status_message,
+			running_state_code, next_state_run, state_started, started_by, cancelled_by, labels, callback_url, paused, active, id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
+	}
+	if err != nil {
+		return fmt.Errorf("error persisting machine run: %s", err)
+	}
+
+	return nil
+}
+
+const sqlRunColumns = `id, machine, path, input, input_blob, last_state, next_state, status_message, running_state_code,
+	next_state_run, state_started, started_by, cancelled_by, labels, callback_url, paused`
+
+func scanRun(row interface{ Scan(...interface{}) error }) (*RunningMachine, error) {
+	var run RunningMachine
+	var runningStateCode, paused int
+	var nextStateRun, stateStarted, labels string
+
+	err := row.Scan(&run.Id, &run.Name, &run.Path, &run.Input, &run.InputBlob, &run.LastState, &run.NextState, &run.StatusMessage,
+		&runningStateCode, &nextStateRun, &stateStarted, &run.StartedBy, &run.CancelledBy, &labels, &run.CallbackUrl, &paused)
+	if err != nil {
+		return nil, err
+	}
+
+	if labels != "" {
+		if err := json.Unmarshal([]byte(labels), &run.Labels); err != nil {
+			return nil, fmt.Errorf("error decoding labels of run %d: %s", run.Id, err)
+		}
+	}
+
+	run.RunningStateCode = runningStateCode != 0
+	run.Paused = paused != 0
+	run.NextStateRun = parseSQLTime(nextStateRun)
+	run.StateStarted = parseSQLTime(stateStarted)
+	return &run, nil
+}
+
+func (s *SQLStorage) CreateRun(run *RunningMachine) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		id, err := s.nextSequence(tx, "runs")
+		if err != nil {
+			return err
+		}
+		run.Id = id
+
+		return s.putRun(tx, run, true)
+	})
+}
+
+func (s *SQLStorage) UpdateRun(run *RunningMachine) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return s.putRun(tx, run, true)
+	})
+}
+
+func (s *SQLStorage) GetRun(id uint64) (*RunningMachine, error) {
+	run, err := scanRun(s.DB.QueryRow(s.rebind("SELECT "+sqlRunColumns+" FROM runs WHERE id = ?"), id))
+	if err == sql.ErrNoRows {
+		return nil, runNotFound(id)
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading machine run: %s", err)
+	}
+
+	return run, nil
+}
+
+func (s *SQLStorage) ActiveRuns() ([]*RunningMachine, error) {
+	rows, err := s.DB.Query("SELECT " + sqlRunColumns + " FROM runs WHERE active = 1 ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error reading active runs: %s", err)
+	}
+	defer rows.Close()
+
+	runs := make([]*RunningMachine, 0)
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading active runs: %s", err)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *SQLStorage) ListRuns(filter RunFilter) ([]*RunningMachine, error) {
+	query := "SELECT " + sqlRunColumns + " FROM runs WHERE 1 = 1"
+	var args []interface{}
+	if filter.Machine != "" {
+		query += " AND machine = ?"
+		args = append(args, filter.Machine)
+	}
+	switch filter.Status {
+	case runStatusActive:
+		query += " AND active = 1"
+	case runStatusFinished:
+		query += " AND active = 0"
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := s.DB.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing runs: %s", err)
+	}
+	defer rows.Close()
+
+	runs := make([]*RunningMachine, 0)
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading runs: %s", err)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *SQLStorage) FinishRun(run *RunningMachine, entry *HistoryEntry) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if entry != nil {
+			if err := s.appendHistory(tx, run.Id, *entry); err != nil {
+				return err
+			}
+		}
+
+		return s.putRun(tx, run, false)
+	})
+}
+
+func (s *SQLStorage) appendHistory(tx *sql.Tx, id uint64, entry HistoryEntry) error {
+	var seq uint64
+	if err := tx.QueryRow(s.rebind("SELECT COALESCE(MAX(seq), 0) + 1 FROM history WHERE run_id = ?"), id).Scan(&seq); err != nil {
+		return fmt.Errorf("error getting next value in history sequence: %s", err)
+	}
+
+	_, err := s.exec(tx, `INSERT INTO history (run_id, seq, time, state, next_state, next_state_run, status_message,
+		duration, success) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, id, seq, formatSQLTime(entry.Time), entry.State,
+		entry.NextState, formatSQLTime(entry.NextStateRun), entry.StatusMessage, entry.Duration, sqlBool(entry.Success))
+	if err != nil {
+		return fmt.Errorf("error persisting history entry: %s", err)
+	}
+
+	return nil
+}
+
+func (s *SQLStorage) AppendHistory(id uint64, entry HistoryEntry) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return s.appendHistory(tx, id, entry)
+	})
+}
+
+func (s *SQLStorage) GetHistory(id uint64) ([]HistoryEntry, error) {
+	rows, err := s.DB.Query(s.rebind(`SELECT time, state, next_state, next_state_run, status_message, duration, success
+		FROM history WHERE run_id = ? ORDER BY seq`), id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading history: %s", err)
+	}
+	defer rows.Close()
+
+	entries := make([]HistoryEntry, 0)
+	for rows.Next() {
+		var entry HistoryEntry
+		var entryTime, nextStateRun string
+		var success int
+		if err := rows.Scan(&entryTime, &entry.State, &entry.NextState, &nextStateRun, &entry.StatusMessage,
+			&entry.Duration, &success); err != nil {
+			return nil, fmt.Errorf("error reading history: %s", err)
+		}
+
+		entry.Time = parseSQLTime(entryTime)
+		entry.NextStateRun = parseSQLTime(nextStateRun)
+		entry.Success = success != 0
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *SQLStorage) PutApiToken(hash string, token *ApiToken) error {
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return fmt.Errorf("error serializing token scopes: %s", err)
+	}
+
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := s.exec(tx, `INSERT INTO api_tokens (hash, id, name, scopes, expires_at, created_by, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, hash, token.Id, token.Name, string(scopes), formatSQLTime(token.ExpiresAt),
+			token.CreatedBy, formatSQLTime(token.CreatedAt))
+		return err
+	})
+}
+
+func (s *SQLStorage) queryApiTokens(where string, args ...interface{}) ([]ApiToken, error) {
+	rows, err := s.DB.Query(s.rebind("SELECT id, name, scopes, expires_at, created_by, created_at FROM api_tokens"+where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens: %s", err)
+	}
+	defer rows.Close()
+
+	tokens := make([]ApiToken, 0)
+	for rows.Next() {
+		var token ApiToken
+		var scopes, expiresAt, createdAt string
+		if err := rows.Scan(&token.Id, &token.Name, &scopes, &expiresAt, &token.CreatedBy, &createdAt); err != nil {
+			return nil, fmt.Errorf("error reading tokens: %s", err)
+		}
+
+		if err := json.Unmarshal([]byte(scopes), &token.Scopes); err != nil {
+			return nil, fmt.Errorf("error deserializing token scopes: %s", err)
+		}
+
+		token.ExpiresAt = parseSQLTime(expiresAt)
+		token.CreatedAt = parseSQLTime(createdAt)
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (s *SQLStorage) GetApiToken(hash string) (*ApiToken, error) {
+	tokens, err := s.queryApiTokens(" WHERE hash = ?", hash)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+
+	return &tokens[0], nil
+}
+
+func (s *SQLStorage) GetApiTokens() ([]ApiToken, error) {
+	return s.queryApiTokens("")
+}
+
+func (s *SQLStorage) DeleteApiToken(id string) (bool, error) {
+	found := false
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		result, err := s.exec(tx, "DELETE FROM api_tokens WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+
+		affected, _ := result.RowsAffected()
+		found = affected > 0
+		return nil
+	})
+
+	return found, err
+}
+
+func (s *SQLStorage) AppendAuditEntry(entry *AuditEntry) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		id, err := s.nextSequence(tx, "audit_log")
+		if err != nil {
+			return err
+		}
+		entry.Id = id
+
+		_, err = s.exec(tx, `INSERT INTO audit_log (id, time, identity, auth_method, remote, action, target, status, outcome)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, entry.Id, formatSQLTime(entry.Time), entry.Identity, entry.AuthMethod,
+			entry.Remote, entry.Action, entry.Target, entry.Status, entry.Outcome)
+		return err
+	})
+}
+
+func (s *SQLStorage) QueryAuditEntries(limit int, identity string, since time.Time) ([]AuditEntry, error) {
+	query := "SELECT id, time, identity, auth_method, remote, action, target, status, outcome FROM audit_log WHERE time >= ?"
+	args := []interface{}{formatSQLTime(since)}
+	if identity != "" {
+		query += " AND identity = ?"
+		args = append(args, identity)
+	}
+	query += " ORDER BY id DESC LIMIT " + strconv.Itoa(limit)
+
+	rows, err := s.DB.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying audit log: %s", err)
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		var entryTime string
+		if err := rows.Scan(&entry.Id, &entryTime, &entry.Identity, &entry.AuthMethod, &entry.Remote, &entry.Action,
+			&entry.Target, &entry.Status, &entry.Outcome); err != nil {
+			return nil, fmt.Errorf("error querying audit log: %s", err)
+		}
+
+		entry.Time = parseSQLTime(entryTime)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *SQLStorage) Check() error {
+	var count int
+	return s.DB.QueryRow("SELECT COUNT(*) FROM metadata").Scan(&count)
+}
+
+func (s *SQLStorage) String() string {
+	return s.Driver + " database"
+}
+
+func (s *SQLStorage) Close() error {
+	return s.DB.Close()
+}
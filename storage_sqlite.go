@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The sqlite3 driver needs cgo, so it is only compiled in when building with
+// "-tags sqlite" (make tags=sqlite).
+import _ "github.com/mattn/go-sqlite3"
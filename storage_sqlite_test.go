@@ -0,0 +1,19 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	testStorageBackends["sql"] = func(t *testing.T) Storage {
+		storage, err := openSQLStorage("sqlite3", filepath.Join(t.TempDir(), "state.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}
+}
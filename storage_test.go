@@ -0,0 +1,279 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testStorageBackends opens an empty storage of each backend. The sql
+// backend is added by storage_sqlite_test.go when building with -tags sqlite.
+var testStorageBackends = map[string]func(t *testing.T) Storage{
+	"memory": func(t *testing.T) Storage {
+		return newMemoryStorage()
+	},
+	"bolt": func(t *testing.T) Storage {
+		storage, err := openBoltStorage(filepath.Join(t.TempDir(), "state.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	},
+}
+
+// forEachStorage runs test against every backend.
+func forEachStorage(t *testing.T, test func(t *testing.T, storage Storage)) {
+	for name, open := range testStorageBackends {
+		t.Run(name, func(t *testing.T) {
+			storage := open(t)
+			defer storage.Close()
+			test(t, storage)
+		})
+	}
+}
+
+func runIds(runs []*RunningMachine) []uint64 {
+	ids := make([]uint64, 0, len(runs))
+	for _, run := range runs {
+		ids = append(ids, run.Id)
+	}
+	return ids
+}
+
+func TestStorageRuns(t *testing.T) {
+	testConfig(t)
+
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		nextStateRun := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+		first := &RunningMachine{Name: "first", Path: "/machines/first", Input: "input", NextState: "start",
+			NextStateRun: nextStateRun, StartedBy: "alice", Labels: map[string]string{"env": "test"}}
+		second := &RunningMachine{Name: "second", NextState: "start", NextStateRun: nextStateRun}
+
+		for _, run := range []*RunningMachine{first, second} {
+			if err := storage.CreateRun(run); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if first.Id != 1 || second.Id != 2 {
+			t.Fatalf("runs got ids %d and %d, expected 1 and 2", first.Id, second.Id)
+		}
+
+		stored, err := storage.GetRun(first.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stored.NextStateRun.Equal(nextStateRun) {
+			t.Errorf("NextStateRun is %s, expected %s", stored.NextStateRun, nextStateRun)
+		}
+		stored.NextStateRun = first.NextStateRun
+		stored.StateStarted = first.StateStarted
+		if !reflect.DeepEqual(stored, first) {
+			t.Errorf("stored run is %+v, expected %+v", stored, first)
+		}
+
+		// Updates that change nothing must succeed as well
+		for _, input := range []string{"input", "input", "changed"} {
+			first.Input = input
+			if err := storage.UpdateRun(first); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stored, err := storage.GetRun(first.Id); err != nil || stored.Input != "changed" {
+			t.Errorf("updated run has input %q, error %v", stored.Input, err)
+		}
+
+		if _, err := storage.GetRun(3); !reflect.DeepEqual(err, runNotFound(3)) {
+			t.Errorf("getting a missing run returned %v", err)
+		}
+
+		if active, err := storage.ActiveRuns(); err != nil || !reflect.DeepEqual(runIds(active), []uint64{1, 2}) {
+			t.Errorf("active runs are %v, error %v", runIds(active), err)
+		}
+
+		first.LastState, first.NextState = "start", "stop"
+		entry := &HistoryEntry{Time: nextStateRun, State: "start", NextState: "stop", StatusMessage: "finished", Duration: 1.5, Success: true}
+		if err := storage.FinishRun(first, entry); err != nil {
+			t.Fatal(err)
+		}
+
+		if active, err := storage.ActiveRuns(); err != nil || !reflect.DeepEqual(runIds(active), []uint64{2}) {
+			t.Errorf("active runs after finishing run 1 are %v, error %v", runIds(active), err)
+		}
+		if stored, err := storage.GetRun(first.Id); err != nil || stored.NextState != "stop" {
+			t.Errorf("finished run wasn't stored, error %v", err)
+		}
+		if history, err := storage.GetHistory(first.Id); err != nil || len(history) != 1 || history[0].StatusMessage != "finished" {
+			t.Errorf("history of finished run is %+v, error %v", history, err)
+		}
+
+		filters := []struct {
+			filter RunFilter
+			ids    []uint64
+		}{
+			{RunFilter{Limit: 10}, []uint64{2, 1}},
+			{RunFilter{Limit: 1}, []uint64{2}},
+			{RunFilter{Status: runStatusActive, Limit: 10}, []uint64{2}},
+			{RunFilter{Status: runStatusFinished, Limit: 10}, []uint64{1}},
+			{RunFilter{Machine: "first", Limit: 10}, []uint64{1}},
+			{RunFilter{Machine: "other", Limit: 10}, []uint64{}},
+		}
+		for _, test := range filters {
+			runs, err := storage.ListRuns(test.filter)
+			if err != nil || !reflect.DeepEqual(runIds(runs), test.ids) {
+				t.Errorf("runs matching %+v are %v, expected %v, error %v", test.filter, runIds(runs), test.ids, err)
+			}
+		}
+
+		if err := storage.Check(); err != nil {
+			t.Errorf("check failed: %s", err)
+		}
+	})
+}
+
+func TestStorageHistory(t *testing.T) {
+	testConfig(t)
+
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		run := &RunningMachine{Name: "history", NextState: "start"}
+		if err := storage.CreateRun(run); err != nil {
+			t.Fatal(err)
+		}
+
+		if history, err := storage.GetHistory(run.Id); err != nil || len(history) != 0 {
+			t.Errorf("new run has history %+v, error %v", history, err)
+		}
+
+		entryTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		for _, state := range []string{"start", "second", "third"} {
+			entry := HistoryEntry{Time: entryTime, State: state, NextState: "next", StatusMessage: state + " done", Success: state != "second"}
+			if err := storage.AppendHistory(run.Id, entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		history, err := storage.GetHistory(run.Id)
+		if err != nil || len(history) != 3 {
+			t.Fatalf("history is %+v, error %v", history, err)
+		}
+		for idx, state := range []string{"start", "second", "third"} {
+			if history[idx].State != state || history[idx].Success != (state != "second") || !history[idx].Time.Equal(entryTime) {
+				t.Errorf("history entry %d is %+v", idx, history[idx])
+			}
+		}
+	})
+}
+
+func TestStorageApiTokens(t *testing.T) {
+	testConfig(t)
+
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		expiresAt := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+		token := &ApiToken{Id: "token-1", Name: "ci", Scopes: []string{"start:build"}, ExpiresAt: expiresAt, CreatedBy: "alice", CreatedAt: expiresAt.AddDate(-1, 0, 0)}
+		if err := storage.PutApiToken("hash-1", token); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := storage.GetApiToken("hash-1")
+		if err != nil || stored == nil {
+			t.Fatalf("token wasn't stored, error %v", err)
+		}
+		if stored.Name != "ci" || !reflect.DeepEqual(stored.Scopes, token.Scopes) || !stored.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("stored token is %+v, expected %+v", stored, token)
+		}
+
+		if missing, err := storage.GetApiToken("hash-2"); err != nil || missing != nil {
+			t.Errorf("getting a missing token returned %+v, error %v", missing, err)
+		}
+
+		if tokens, err := storage.GetApiTokens(); err != nil || len(tokens) != 1 || tokens[0].Id != "token-1" {
+			t.Errorf("tokens are %+v, error %v", tokens, err)
+		}
+
+		if found, err := storage.DeleteApiToken("token-1"); err != nil || !found {
+			t.Errorf("deleting the token returned %t, error %v", found, err)
+		}
+		if found, err := storage.DeleteApiToken("token-1"); err != nil || found {
+			t.Errorf("deleting the token again returned %t, error %v", found, err)
+		}
+		if deleted, err := storage.GetApiToken("hash-1"); err != nil || deleted != nil {
+			t.Errorf("deleted token is still returned: %+v, error %v", deleted, err)
+		}
+	})
+}
+
+func TestStorageAuditEntries(t *testing.T) {
+	testConfig(t)
+
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		start := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+		for idx, identity := range []string{"alice", "bob", "alice"} {
+			entry := &AuditEntry{Time: start.Add(time.Duration(idx) * time.Hour), Identity: identity, Action: "start", Status: 200}
+			if err := storage.AppendAuditEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.Id != uint64(idx+1) {
+				t.Errorf("audit entry %d got id %d", idx+1, entry.Id)
+			}
+		}
+
+		queries := []struct {
+			limit    int
+			identity string
+			since    time.Time
+			ids      []uint64
+		}{
+			{10, "", time.Time{}, []uint64{3, 2, 1}},
+			{2, "", time.Time{}, []uint64{3, 2}},
+			{10, "alice", time.Time{}, []uint64{3, 1}},
+			{10, "", start.Add(time.Hour), []uint64{3, 2}},
+		}
+		for _, query := range queries {
+			entries, err := storage.QueryAuditEntries(query.limit, query.identity, query.since)
+			ids := make([]uint64, 0)
+			for _, entry := range entries {
+				ids = append(ids, entry.Id)
+			}
+			if err != nil || !reflect.DeepEqual(ids, query.ids) {
+				t.Errorf("audit entries for %+v are %v, expected %v, error %v", query, ids, query.ids, err)
+			}
+		}
+	})
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	testConfig(t)
+
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		keyRing := testKeyRing(t, "current")
+		encrypted := &EncryptedStorage{Storage: storage, Keys: keyRing}
+		run := &RunningMachine{Name: "encrypted", Input: "input", StatusMessage: "status", NextState: "start"}
+		if err := encrypted.CreateRun(run); err != nil {
+			t.Fatal(err)
+		}
+
+		if stored, err := storage.GetRun(run.Id); err != nil || !isEncrypted(stored.Input) || !isEncrypted(stored.StatusMessage) {
+			t.Errorf("run is stored as %+v, error %v", stored, err)
+		}
+		if decrypted, err := encrypted.GetRun(run.Id); err != nil || decrypted.Input != "input" || decrypted.StatusMessage != "status" {
+			t.Errorf("run is read as %+v, error %v", decrypted, err)
+		}
+
+		// A run encrypted with a key that was removed from the key file is
+		// skipped instead of failing the other runs
+		other := &EncryptedStorage{Storage: storage, Keys: testKeyRing(t, "removed")}
+		if err := other.CreateRun(&RunningMachine{Name: "removed", Input: "input", NextState: "start"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if active, err := encrypted.ActiveRuns(); err != nil || !reflect.DeepEqual(runIds(active), []uint64{1}) {
+			t.Errorf("active runs are %v, error %v", runIds(active), err)
+		}
+		if runs, err := encrypted.ListRuns(RunFilter{Limit: 10}); err != nil || !reflect.DeepEqual(runIds(runs), []uint64{1}) {
+			t.Errorf("listed runs are %v, error %v", runIds(runs), err)
+		}
+		if _, err := encrypted.GetRun(2); err == nil {
+			t.Error("run encrypted with a removed key was read")
+		}
+	})
+}
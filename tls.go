@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ClientCertificateMapping maps a client certificate, matched on its subject
+// common name or any of its subject alternative names, to a user identity.
+type ClientCertificateMapping struct {
+	Subject  string
+	User     string
+	Role     string
+	Machines []string
+}
+
+// TLSReloader holds the server certificate and client CA pool so that they can
+// be replaced on SIGHUP without restarting the listener.
+type TLSReloader struct {
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+var globalTLSReloader *TLSReloader
+
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA bundle %s: %s", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", path)
+	}
+
+	return pool, nil
+}
+
+func (r *TLSReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(globalConfig.TLSCertificateFile, globalConfig.TLSKeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if globalConfig.TLSClientCAFile != "" {
+		clientCAs, err = loadClientCAs(globalConfig.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.lock.Lock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.lock.Unlock()
+
+	return nil
+}
+
+func (r *TLSReloader) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*r.certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.clientCAs != nil {
+		config.ClientCAs = r.clientCAs
+		if globalConfig.TLSClientCertificateRequired {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return config, nil
+}
+
+// initTLS loads the certificates and returns the server TLS configuration, or nil
+// if TLS isn't enabled.
+func initTLS() (*tls.Config, error) {
+	if globalConfig.TLSCertificateFile == "" || globalConfig.TLSKeyFile == "" {
+		return nil, nil
+	}
+
+	reloader := &TLSReloader{}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	globalTLSReloader = reloader
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloader.Reload(); err != nil {
+				logError(LogFields{"error": err}, "error reloading TLS certificates, keeping the previous ones")
+			} else {
+				logInfo(LogFields{"certificate": globalConfig.TLSCertificateFile, "client_ca": globalConfig.TLSClientCAFile}, "reloaded TLS certificates")
+			}
+		}
+	}()
+
+	return &tls.Config{GetConfigForClient: reloader.getConfigForClient}, nil
+}
+
+func certificateNames(certificate *x509.Certificate) []string {
+	names := []string{certificate.Subject.CommonName}
+	names = append(names, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// authenticateCertificate maps a verified client certificate to an identity, it
+// returns nil if no certificate was presented or none of its names are mapped.
+func authenticateCertificate(req *restful.Request) *Identity {
+	if req.Request.TLS == nil || len(req.Request.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	certificate := req.Request.TLS.VerifiedChains[0][0]
+	for _, mapping := range globalConfig.ClientCertificate {
+		if !containsString(certificateNames(certificate), mapping.Subject) {
+			continue
+		}
+
+		name := mapping.User
+		if name == "" {
+			name = mapping.Subject
+		}
+
+		user := &User{Name: name, Role: mapping.Role, Machines: mapping.Machines}
+		return &Identity{Name: name, Role: mapping.Role, Method: "certificate", User: user}
+	}
+
+	logWarn(LogFields{"subject": certificate.Subject.String(), "remote": remoteHost(req)}, "client certificate is not mapped to a user")
+	return nil
+}
+
+func validateTLSConfig(config *Config) []string {
+	var errors []string
+
+	if config.TLSClientCAFile != "" {
+		if config.TLSCertificateFile == "" {
+			errors = append(errors, "TLSClientCAFile requires TLSCertificateFile and TLSKeyFile")
+		}
+		if _, err := loadClientCAs(config.TLSClientCAFile); err != nil {
+			errors = append(errors, fmt.Sprintf("TLSClientCAFile: %s", err))
+		}
+	} else if config.TLSClientCertificateRequired {
+		errors = append(errors, "TLSClientCertificateRequired requires TLSClientCAFile")
+	}
+
+	for idx, mapping := range config.ClientCertificate {
+		if mapping.Subject == "" {
+			errors = append(errors, fmt.Sprintf("ClientCertificate #%d has no Subject", idx+1))
+		}
+		if _, ok := roleActions[mapping.Role]; !ok {
+			errors = append(errors, fmt.Sprintf("ClientCertificate %s has unknown role %q, expected viewer, operator or admin", mapping.Subject, mapping.Role))
+		}
+	}
+
+	return errors
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"strings"
+	"time"
+)
+
+const tokenPrefix = "rsm_"
+
+// scopeActions maps the scope names used in tokens to the actions they grant. A
+// scope can be restricted to a single machine by appending ":<machine>".
+var scopeActions = map[string]string{
+	"runs:read":     actionList,
+	"runs:start":    actionStart,
+	"runs:cancel":   actionCancel,
+	"runs:override": actionOverride,
+	"admin":         actionAdmin,
+}
+
+type ApiToken struct {
+	Id        string
+	Name      string
+	Scopes    []string
+	ExpiresAt time.Time
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+type CreateTokenRequest struct {
+	Name      string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+type CreateTokenResponse struct {
+	Token   string
+	Details ApiToken
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitScope splits a scope like runs:start:provisioning into its name and the
+// machine it is restricted to.
+func splitScope(scope string) (name string, machine string) {
+	if strings.Count(scope, ":") == 2 {
+		idx := strings.LastIndex(scope, ":")
+		return scope[:idx], scope[idx+1:]
+	}
+	return scope, ""
+}
+
+func validateScope(scope string) error {
+	name, machine := splitScope(scope)
+	if _, ok := scopeActions[name]; !ok {
+		return fmt.Errorf("unknown scope %s", scope)
+	}
+
+	if name == "admin" && machine != "" {
+		return fmt.Errorf("the admin scope can't be restricted to a machine")
+	}
+
+	if strings.HasSuffix(scope, ":") {
+		return fmt.Errorf("scope %s has an empty machine name", scope)
+	}
+
+	return nil
+}
+
+// tokenAllows reports whether scopes grant action on machine.
+func tokenAllows(scopes []string, action string, machine string) bool {
+	for _, scope := range scopes {
+		name, restriction := splitScope(scope)
+		if scopeActions[name] == action && (restriction == "" || restriction == "*" || restriction == machine) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Scheduler) CreateApiToken(request CreateTokenRequest, createdBy string) (string, *ApiToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("error generating token: %s", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("error generating token id: %s", err)
+	}
+
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	apiToken := &ApiToken{
+		Id:        hex.EncodeToString(id),
+		Name:      request.Name,
+		Scopes:    request.Scopes,
+		ExpiresAt: request.ExpiresAt,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+
+	err := s.Storage.PutApiToken(tokenHash(token), apiToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, apiToken, nil
+}
+
+func (s *Scheduler) GetApiTokens() ([]ApiToken, error) {
+	return s.Storage.GetApiTokens()
+}
+
+// LookupApiToken returns the token details if token exists and hasn't expired.
+func (s *Scheduler) LookupApiToken(token string) (*ApiToken, error) {
+	apiToken, err := s.Storage.GetApiToken(tokenHash(token))
+	if err != nil || apiToken == nil {
+		return nil, err
+	}
+
+	if time.Now().After(apiToken.ExpiresAt) {
+		return nil, nil
+	}
+
+	return apiToken, nil
+}
+
+func (s *Scheduler) DeleteApiToken(id string) (bool, error) {
+	return s.Storage.DeleteApiToken(id)
+}
+
+func (a *Authenticator) authenticateBearer(req *restful.Request, resp *restful.Response, token string) *Identity {
+	hostKey := "host:" + remoteHost(req)
+	if locked, remaining := a.lockedOut(hostKey); locked {
+		resp.AddHeader("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
+		errorResponse(429, errorTooManyAttempts, "Too many failed authentication attempts, try again later", resp)
+		return nil
+	}
+
+	apiToken, err := globalScheduler.LookupApiToken(token)
+	if err != nil {
+		logError(LogFields{"error": err}, "error looking up api token")
+		errorResponse(500, errorInternal, "Error verifying token", resp)
+		return nil
+	}
+
+	if apiToken == nil {
+		a.recordFailure(hostKey)
+		logWarn(LogFields{"remote": remoteHost(req)}, "invalid or expired api token")
+		resp.AddHeader("WWW-Authenticate", `Bearer realm="restatemachine", error="invalid_token"`)
+		errorResponse(401, errorUnauthorized, "Invalid or expired token", resp)
+		return nil
+	}
+
+	// Token names aren't unique, the id tells tokens of the same name apart
+	return &Identity{Name: "token:" + apiToken.Name + ":" + apiToken.Id, Method: "token", Scopes: apiToken.Scopes}
+}
+
+func apiListTokens(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	tokens, err := globalScheduler.GetApiTokens()
+	if err != nil {
+		errorResponse(500, errorInternal, "Error listing tokens: "+err.Error(), resp)
+		return
+	}
+
+	resp.WriteEntity(tokens)
+}
+
+func apiGetToken(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	tokens, err := globalScheduler.GetApiTokens()
+	if err != nil {
+		errorResponse(500, errorInternal, "Error listing tokens: "+err.Error(), resp)
+		return
+	}
+
+	for _, token := range tokens {
+		if token.Id == req.PathParameter("id") {
+			resp.WriteEntity(token)
+			return
+		}
+	}
+
+	errorResponse(404, errorTokenNotFound, "Token not found", resp)
+}
+
+func apiCreateToken(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	var request CreateTokenRequest
+	if err := req.ReadEntity(&request); err != nil {
+		errorResponse(400, errorInvalidRequest, "Error parsing token request: "+err.Error(), resp)
+		return
+	}
+
+	if request.Name == "" {
+		writeError(422, ApiError{Code: errorValidationFailed, Message: "Token name is required", Details: map[string]interface{}{"field": "Name"}}, resp)
+		return
+	}
+
+	if len(request.Scopes) == 0 {
+		writeError(422, ApiError{Code: errorValidationFailed, Message: "At least one scope is required", Details: map[string]interface{}{"field": "Scopes"}}, resp)
+		return
+	}
+
+	for _, scope := range request.Scopes {
+		if err := validateScope(scope); err != nil {
+			writeError(422, ApiError{Code: errorValidationFailed, Message: err.Error(), Details: map[string]interface{}{"field": "Scopes"}}, resp)
+			return
+		}
+	}
+
+	if !request.ExpiresAt.After(time.Now()) {
+		writeError(422, ApiError{Code: errorValidationFailed, Message: "ExpiresAt must be set to a time in the future", Details: map[string]interface{}{"field": "ExpiresAt"}}, resp)
+		return
+	}
+
+	identity := requestIdentity(req)
+	token, apiToken, err := globalScheduler.CreateApiToken(request, identity.Name)
+	if err != nil {
+		errorResponse(500, errorInternal, "Error creating token: "+err.Error(), resp)
+		return
+	}
+
+	logInfo(LogFields{"user": identity.Name, "token": apiToken.Id, "name": apiToken.Name}, "api token created")
+	resp.AddHeader("Location", apiPath(req, "/tokens/"+apiToken.Id))
+	resp.WriteHeader(201)
+	resp.WriteEntity(CreateTokenResponse{Token: token, Details: *apiToken})
+}
+
+func apiDeleteToken(req *restful.Request, resp *restful.Response) {
+	if !authorize(req, resp, actionAdmin, "") {
+		return
+	}
+
+	id := req.PathParameter("id")
+	found, err := globalScheduler.DeleteApiToken(id)
+	if err != nil {
+		errorResponse(500, errorInternal, "Error deleting token: "+err.Error(), resp)
+	} else if !found {
+		errorResponse(404, errorTokenNotFound, "Token not found", resp)
+	} else {
+		logInfo(LogFields{"user": requestIdentity(req).Name, "token": id}, "api token deleted")
+		resp.WriteEntity(MessageResponse{Message: "Token deleted successfully"})
+	}
+}
@@ -0,0 +1,244 @@
+// Dashboard for the restatemachine /v1 API. The browser sends the credentials
+// it authenticated /ui with along with the API requests.
+"use strict";
+
+var api = "/v1";
+
+function request(method, path) {
+  var options = { method: method, headers: { "Accept": "application/json" } };
+  if (method === "POST") {
+    options.headers["Content-Type"] = "application/json";
+  }
+
+  return fetch(path, options).then(function (resp) {
+    return resp.json().catch(function () { return null; }).then(function (body) {
+      if (!resp.ok) {
+        throw new Error(body && body.message ? body.message : resp.status + " " + resp.statusText);
+      }
+      return body;
+    });
+  });
+}
+
+function el(tag, attrs, children) {
+  var node = document.createElement(tag);
+  Object.keys(attrs || {}).forEach(function (name) {
+    if (name.indexOf("on") === 0) {
+      node.addEventListener(name.substring(2), attrs[name]);
+    } else {
+      node.setAttribute(name, attrs[name]);
+    }
+  });
+  (children || []).forEach(function (child) {
+    node.appendChild(typeof child === "string" ? document.createTextNode(child) : child);
+  });
+  return node;
+}
+
+function formatTime(value) {
+  if (!value || value.indexOf("0001-01-01") === 0) {
+    return "-";
+  }
+  return new Date(value).toLocaleString();
+}
+
+function formatInput(input) {
+  return typeof input === "string" ? input : JSON.stringify(input, null, 2);
+}
+
+function showError(err) {
+  var box = document.getElementById("error");
+  box.textContent = err ? err.message : "";
+  box.hidden = !err;
+}
+
+function render(nodes) {
+  var view = document.getElementById("view");
+  view.textContent = "";
+  nodes.forEach(function (node) { view.appendChild(node); });
+}
+
+function runBadge(run) {
+  if (run.NextState === "stop") {
+    return el("span", { "class": "badge" }, [run.CancelledBy ? "cancelled" : "finished"]);
+  } else if (run.Paused) {
+    return el("span", { "class": "badge paused" }, ["paused"]);
+  } else if (run.StatusMessage.indexOf("will keep retrying") !== -1) {
+    return el("span", { "class": "badge failed" }, ["failing"]);
+  }
+  return el("span", { "class": "badge active" }, [run.RunningStateCode ? "executing" : "active"]);
+}
+
+function showMachines() {
+  return request("GET", api + "/machines").then(function (machines) {
+    var rows = machines.map(function (machine) {
+      return el("tr", {}, [
+        el("td", {}, [el("a", { href: "#/runs?machine=" + encodeURIComponent(machine.Name) + "&status=all" }, [machine.Name])]),
+        el("td", {}, [(machine.States || []).join(", ")]),
+        el("td", {}, [el("pre", {}, [machine.Usage])])
+      ]);
+    });
+
+    render([
+      el("h2", {}, ["Machines"]),
+      el("table", {}, [
+        el("thead", {}, [el("tr", {}, [el("th", {}, ["Name"]), el("th", {}, ["States"]), el("th", {}, ["Usage"])])]),
+        el("tbody", {}, rows)
+      ])
+    ]);
+  });
+}
+
+function showRuns(params) {
+  var status = params.get("status") || "active";
+  var machine = params.get("machine") || "";
+  var query = "?status=" + encodeURIComponent(status) + "&limit=200";
+  if (machine) {
+    query += "&machine=" + encodeURIComponent(machine);
+  }
+
+  return Promise.all([request("GET", api + "/runs" + query), request("GET", api + "/machines")]).then(function (results) {
+    var runs = results[0];
+    var machines = results[1];
+
+    function applyFilters() {
+      location.hash = "#/runs?status=" + encodeURIComponent(statusSelect.value) +
+        "&machine=" + encodeURIComponent(machineSelect.value);
+    }
+
+    var statusSelect = el("select", { onchange: applyFilters }, ["active", "finished", "all"].map(function (value) {
+      return el("option", { value: value }, [value]);
+    }));
+    statusSelect.value = status;
+
+    var machineSelect = el("select", { onchange: applyFilters }, [el("option", { value: "" }, ["all machines"])].concat(
+      machines.map(function (m) { return el("option", { value: m.Name }, [m.Name]); })));
+    machineSelect.value = machine;
+
+    var rows = runs.map(function (run) {
+      return el("tr", { "class": "link", onclick: function () { location.hash = "#/runs/" + run.Id; } }, [
+        el("td", {}, [String(run.Id)]),
+        el("td", {}, [run.Name]),
+        el("td", {}, [runBadge(run)]),
+        el("td", {}, [run.LastState || "-"]),
+        el("td", {}, [run.NextState]),
+        el("td", {}, [formatTime(run.NextStateRun)]),
+        el("td", {}, [run.StartedBy]),
+        el("td", {}, [run.StatusMessage])
+      ]);
+    });
+
+    render([
+      el("h2", {}, ["Runs"]),
+      el("div", { "class": "filters" }, [
+        el("label", {}, ["Status ", statusSelect]),
+        el("label", {}, ["Machine ", machineSelect]),
+        el("button", { onclick: route }, ["Refresh"])
+      ]),
+      el("table", {}, [
+        el("thead", {}, [el("tr", {}, ["Id", "Machine", "Status", "Last state", "Next state", "Next run", "Started by", "Message"].map(function (name) {
+          return el("th", {}, [name]);
+        }))]),
+        el("tbody", {}, rows.length ? rows : [el("tr", {}, [el("td", { colspan: "8" }, ["No runs"])])])
+      ])
+    ]);
+  });
+}
+
+function showRun(id) {
+  var path = api + "/runs/" + encodeURIComponent(id);
+  return Promise.all([request("GET", path), request("GET", path + "/history")]).then(function (results) {
+    var run = results[0];
+    var history = results[1];
+    var active = run.NextState !== "stop";
+
+    function action(name, confirmation) {
+      return function () {
+        if (confirmation && !confirm(confirmation)) {
+          return;
+        }
+        var method = name === "cancel" ? "DELETE" : "POST";
+        request(method, name === "cancel" ? path : path + "/" + name).then(route).catch(showError);
+      };
+    }
+
+    var details = [
+      ["Id", String(run.Id)],
+      ["Machine", run.Name],
+      ["Status", runBadge(run)],
+      ["Last state", run.LastState || "-"],
+      ["Next state", run.NextState],
+      ["Next run", formatTime(run.NextStateRun)],
+      ["Started by", run.StartedBy],
+      ["Status message", run.StatusMessage]
+    ];
+    if (run.CancelledBy) {
+      details.push(["Cancelled by", run.CancelledBy]);
+    }
+    Object.keys(run.Labels || {}).sort().forEach(function (name) {
+      details.push(["Label " + name, run.Labels[name]]);
+    });
+    if (run.InputBlob) {
+      details.push(["Output", el("a", { href: path + "/output" }, ["download"])]);
+    } else {
+      details.push(["Output", el("pre", {}, [formatInput(run.Input)])]);
+    }
+
+    var timeline = history.slice().reverse().map(function (entry) {
+      var transition = entry.State ? entry.State + " → " + entry.NextState : entry.NextState;
+      return el("li", { "class": entry.Success ? "" : "failed" }, [
+        el("div", { "class": "time" }, [formatTime(entry.Time) + (entry.Duration ? " (" + entry.Duration.toFixed(2) + "s)" : "")]),
+        el("div", {}, [el("strong", {}, [transition])]),
+        el("div", {}, [entry.StatusMessage])
+      ]);
+    });
+
+    // Runs can't be changed while a state is executing
+    var change = run.RunningStateCode ? { disabled: "", title: "A state is executing" } : {};
+    function changeButton(name, label) {
+      return el("button", Object.assign({ onclick: action(name) }, change), [label]);
+    }
+
+    var actions = [];
+    if (active) {
+      actions.push(run.Paused ? changeButton("resume", "Resume") : changeButton("pause", "Pause"));
+      actions.push(changeButton("retry", "Retry now"));
+      actions.push(el("button", { onclick: action("cancel", "Cancel run " + run.Id + "?") }, ["Cancel"]));
+    }
+    actions.push(el("a", { href: path + "/files" }, ["Workspace files"]));
+
+    render([
+      el("h2", {}, ["Run " + run.Id]),
+      el("div", { "class": "actions" }, actions),
+      el("dl", {}, details.reduce(function (nodes, detail) {
+        return nodes.concat([el("dt", {}, [detail[0]]), el("dd", {}, [detail[1]])]);
+      }, [])),
+      el("h3", {}, ["Timeline"]),
+      el("ul", { "class": "timeline" }, timeline.length ? timeline : [el("li", {}, ["No states executed yet"])])
+    ]);
+  });
+}
+
+function route() {
+  var hash = location.hash.replace(/^#/, "") || "/runs";
+  var parts = hash.split("?");
+  var params = new URLSearchParams(parts[1] || "");
+  var match;
+
+  var shown;
+  if (parts[0] === "/machines") {
+    shown = showMachines();
+  } else if ((match = parts[0].match(/^\/runs\/(\d+)$/))) {
+    shown = showRun(match[1]);
+  } else {
+    shown = showRuns(params);
+  }
+
+  shown.then(function () { showError(null); }).catch(showError);
+}
+
+window.addEventListener("hashchange", route);
+request("GET", "/").then(function (index) {
+  document.getElementById("version").textContent = index.Version;
+}).catch(function () {});
+route();
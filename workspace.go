@@ -0,0 +1,240 @@
+package main
+
+import (
+	"github.com/emicklei/go-restful"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// workspaceEnv is the environment variable that passes a run's workspace
+// directory to its states.
+const workspaceEnv = "RESTATEMACHINE_WORKSPACE"
+
+const workspaceCleanupInterval = time.Hour
+
+type WorkspaceFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+func workspacePath(id uint64) string {
+	return filepath.Join(globalConfig.WorkspacePath, strconv.FormatUint(id, 10))
+}
+
+// prepareWorkspace creates the workspace of run unless it already exists from
+// an earlier state, owned by the user the machine's states run as.
+func prepareWorkspace(run *RunningMachine) (string, error) {
+	path := workspacePath(run.Id)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return "", err
+	}
+
+	if config := machineConfig(run.Name); config != nil {
+		credential, err := config.credential()
+		if err != nil {
+			return "", err
+		}
+
+		if credential != nil {
+			if err := os.Chown(path, int(credential.Uid), int(credential.Gid)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return path, nil
+}
+
+// finishWorkspace removes the workspace of a terminated run, or marks the
+// time it terminated if workspaces are retained.
+func finishWorkspace(id uint64) {
+	path := workspacePath(id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+
+	var err error
+	if globalConfig.WorkspaceRetentionDays == 0 {
+		err = os.RemoveAll(path)
+	} else {
+		now := time.Now()
+		err = os.Chtimes(path, now, now)
+	}
+
+	if err != nil {
+		logWarn(LogFields{"run": id, "path": path, "error": err}, "error finishing run workspace")
+	}
+}
+
+// cleanupWorkspaces removes the workspaces of runs that are no longer active
+// and terminated longer than WorkspaceRetentionDays ago.
+func cleanupWorkspaces() {
+	entries, err := ioutil.ReadDir(globalConfig.WorkspacePath)
+	if err != nil {
+		logWarn(LogFields{"path": globalConfig.WorkspacePath, "error": err}, "error listing workspaces")
+		return
+	}
+
+	active := make(map[uint64]bool)
+	for _, run := range *globalScheduler.GetRunningMachines() {
+		active[run.Id] = true
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -globalConfig.WorkspaceRetentionDays)
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() || active[id] || entry.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(globalConfig.WorkspacePath, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			logWarn(LogFields{"run": id, "path": path, "error": err}, "error removing run workspace")
+		} else {
+			logDebug(LogFields{"run": id, "path": path}, "removed run workspace")
+		}
+	}
+}
+
+func initWorkspaces() error {
+	if err := os.MkdirAll(globalConfig.WorkspacePath, 0755); err != nil {
+		return err
+	}
+
+	go func() {
+		cleanupWorkspaces()
+		ticker := time.NewTicker(workspaceCleanupInterval)
+		for range ticker.C {
+			cleanupWorkspaces()
+		}
+	}()
+
+	return nil
+}
+
+// openWorkspaceFile opens a path requested through the API in the workspace of
+// run id. The path is opened one component at a time without following
+// symlinks, so states can't use them to expose files outside their workspace,
+// not even by swapping them in while the file is being opened.
+func openWorkspaceFile(id uint64, requested string) (*os.File, error) {
+	fd, err := syscall.Open(workspacePath(id), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: workspacePath(id), Err: err}
+	}
+
+	file := os.NewFile(uintptr(fd), workspacePath(id))
+	for _, name := range strings.Split(filepath.Clean("/"+requested), "/") {
+		if name == "" {
+			continue
+		}
+
+		next, err := openWorkspaceEntry(file, name)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		file = next
+	}
+
+	return file, nil
+}
+
+// openWorkspaceEntry opens the entry name of the directory dir, unless it is
+// a symlink.
+func openWorkspaceEntry(dir *os.File, name string) (*os.File, error) {
+	path := filepath.Join(dir.Name(), name)
+	fd, err := syscall.Openat(int(dir.Fd()), name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// listWorkspaceFiles lists the directory dir recursively, the paths are
+// relative to prefix. Subdirectories are opened like in openWorkspaceFile.
+func listWorkspaceFiles(dir *os.File, prefix string) ([]WorkspaceFile, error) {
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	files := make([]WorkspaceFile, 0, len(entries))
+	for _, info := range entries {
+		path := strings.TrimPrefix(prefix+"/"+info.Name(), "/")
+		files = append(files, WorkspaceFile{Path: path, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()})
+		if !info.IsDir() {
+			continue
+		}
+
+		subdir, err := openWorkspaceEntry(dir, info.Name())
+		if err != nil {
+			return nil, err
+		}
+		subdirFiles, err := listWorkspaceFiles(subdir, path)
+		subdir.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, subdirFiles...)
+	}
+
+	return files, nil
+}
+
+// apiGetRunFiles lists the workspace of a run, or downloads a file from it
+// when a path is given. Directories are listed recursively.
+func apiGetRunFiles(req *restful.Request, resp *restful.Response) {
+	id := req.PathParameter("id")
+	machine, err := globalScheduler.GetMachineRun(id)
+	if err != nil {
+		runError("Error retrieving information about state machine run", err, id, resp)
+		return
+	}
+
+	if !authorize(req, resp, actionList, machine.Name) {
+		return
+	}
+
+	requested := req.PathParameter("path")
+	file, err := openWorkspaceFile(machine.Id, requested)
+	if err != nil {
+		errorResponse(404, errorFileNotFound, "File not found in the workspace of the state machine run", resp)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		errorResponse(500, errorInternal, "Error reading workspace: "+err.Error(), resp)
+		return
+	}
+
+	if info.Mode().IsRegular() {
+		resp.AddHeader("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+		http.ServeContent(resp.ResponseWriter, req.Request, info.Name(), info.ModTime(), file)
+		return
+	} else if !info.IsDir() {
+		errorResponse(404, errorFileNotFound, "File not found in the workspace of the state machine run", resp)
+		return
+	}
+
+	files, err := listWorkspaceFiles(file, strings.Trim(filepath.Clean("/"+requested), "/"))
+	if err != nil {
+		errorResponse(500, errorInternal, "Error listing workspace: "+err.Error(), resp)
+		return
+	}
+
+	resp.WriteEntity(files)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testWorkspace creates the workspace of run 1 with a file, a directory and
+// symlinks to a secret file outside of it.
+func testWorkspace(t *testing.T) string {
+	config := testConfig(t)
+
+	workspace := workspacePath(1)
+	secret := filepath.Join(filepath.Dir(config.WorkspacePath), "secret")
+	files := map[string]string{"output.txt": "output", "dir/nested.txt": "nested", "../../secret": "secret"}
+	for name, content := range files {
+		path := filepath.Join(workspace, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for link, target := range map[string]string{"link": secret, "dir/link": "../output.txt", "outside": filepath.Dir(secret)} {
+		if err := os.Symlink(target, filepath.Join(workspace, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return workspace
+}
+
+func TestOpenWorkspaceFile(t *testing.T) {
+	testWorkspace(t)
+
+	for requested, expected := range map[string]string{"output.txt": "output", "/dir/nested.txt": "nested", "../../dir/./nested.txt": "nested"} {
+		file, err := openWorkspaceFile(1, requested)
+		if err != nil {
+			t.Errorf("opening %s failed: %s", requested, err)
+			continue
+		}
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+		if string(content) != expected {
+			t.Errorf("%s contains %q, expected %q", requested, content, expected)
+		}
+	}
+
+	for _, requested := range []string{"link", "dir/link", "outside/secret", "../secret", "missing"} {
+		if file, err := openWorkspaceFile(1, requested); err == nil {
+			file.Close()
+			t.Errorf("%s was opened", requested)
+		}
+	}
+}
+
+func TestApiRunFiles(t *testing.T) {
+	testWorkspace(t)
+	if err := ioutil.WriteFile(filepath.Join(workspacePath(1), "say \"hi\".txt"), []byte("hi"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := testApiServer(t)
+
+	previous := globalScheduler.Storage
+	globalScheduler.Storage = newMemoryStorage()
+	t.Cleanup(func() { globalScheduler.Storage = previous })
+	if _, err := globalScheduler.UpdatePersistedMachine(&RunningMachine{Name: "files-test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(fmt.Sprintf("%s/runs/1/files%s", server.URL, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/say%20%22hi%22.txt")
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if disposition := resp.Header.Get("Content-Disposition"); string(content) != "hi" || disposition != `attachment; filename="say \"hi\".txt"` {
+		t.Errorf("file download returned %q with Content-Disposition %s", content, disposition)
+	}
+
+	resp = get("/link")
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("symlink out of the workspace returned %s", resp.Status)
+	}
+
+	resp = get("")
+	var files []WorkspaceFile
+	err := json.NewDecoder(resp.Body).Decode(&files)
+	resp.Body.Close()
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	expected := []string{"dir", "dir/link", "dir/nested.txt", "link", "output.txt", "outside", "say \"hi\".txt"}
+	if err != nil || !reflect.DeepEqual(paths, expected) {
+		t.Errorf("workspace listing is %q, error %v", paths, err)
+	}
+}